@@ -0,0 +1,362 @@
+// Admin REST API of the plugin, served as JSON on a local Unix socket
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"phocs/vde_plug_docker/capture"
+	"phocs/vde_plug_docker/vdenet"
+
+	"github.com/docker/libnetwork/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// permissions of the admin socket, only root can manipulate the networks
+const SockMode = 0600
+
+// content type of the requests and responses
+const ContentType = "application/json"
+
+// body of the error responses
+type ErrorResponse struct {
+	Err string `json:"Err"`
+}
+
+// body of the request moving a network to another VNL
+type MoveRequest struct {
+	Sock string `json:"Sock"`
+}
+
+// body of the request changing the impairments, the same options of docker network create (e.g. "delay": "100ms"),
+// "0" clears an impairment
+type NetemRequest map[string]string
+
+// body of the request starting a capture in background, written by the daemon to File
+type CaptureRequest struct {
+	File     string `json:"File"`
+	Filter   string `json:"Filter"`
+	MaxBytes int64  `json:"MaxBytes"`
+	Duration string `json:"Duration"`
+}
+
+// content type of the streamed captures
+const PcapngContentType = "application/x-pcapng"
+
+// Returns the HTTP handler of the admin API:
+//
+//	GET  /networks                 status of every network
+//	GET  /networks/<id>            status of a network and its endpoints
+//	POST /networks/<id>/move       plugs the network to the VNL in the MoveRequest body
+//	POST /networks/<id>/netem      changes the impairments of the network and its endpoints with the options of the NetemRequest body
+//	GET  /networks/<id>/capture    streams a pcapng capture of all the endpoints of the network
+//	POST /networks/<id>/capture    starts a capture of the network written by the daemon, see CaptureRequest
+//	GET  /endpoints/<id>           status of an endpoint, its plug and its counters
+//	POST /endpoints/<id>/replug    plugs the endpoint again to its network
+//	POST /endpoints/<id>/detach    unplugs the endpoint until it is replugged
+//	POST /endpoints/<id>/netem     changes the impairments of the endpoint with the options of the NetemRequest body
+//	GET  /endpoints/<id>/capture   streams a pcapng capture of the endpoint, see the query parameters of captureOptions
+//	POST /endpoints/<id>/capture   starts a capture of the endpoint written by the daemon, see CaptureRequest
+//	GET  /captures                 status of the running captures
+//	POST /captures/<id>/stop       stops a capture
+//	POST /gc                       cleans up after the containers gone without leaving, returns what it did
+//
+// networks and endpoints can be referred to by a unique prefix of their ID
+func Handler(driver *vdenet.Driver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		writeResponse(w, driver.NetworksStatus(), nil)
+	})
+	mux.HandleFunc("/networks/", func(w http.ResponseWriter, r *http.Request) {
+		id, action := splitPath(r.URL.Path, "/networks/")
+		switch action {
+		case "":
+			if allow(w, r, http.MethodGet) {
+				status, err := driver.NetworkStatus(id)
+				writeResponse(w, status, err)
+			}
+		case "move":
+			if allow(w, r, http.MethodPost) {
+				var req MoveRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					writeResponse(w, nil, types.BadRequestErrorf("Bad move request: %s", err))
+					return
+				}
+				writeResponse(w, nil, driver.MoveNetwork(id, req.Sock))
+			}
+		case "netem":
+			if opt, ok := netemOptions(w, r); ok {
+				netem, err := driver.SetNetworkNetem(id, opt)
+				writeResponse(w, netem, err)
+			}
+		case "capture":
+			switch r.Method {
+			case http.MethodGet:
+				streamCapture(w, r, func(out io.WriteCloser, opts capture.Options) (*capture.Session, error) {
+					return driver.CaptureNetwork(id, out, "stream", opts)
+				})
+			case http.MethodPost:
+				fileCapture(w, r, func(out io.WriteCloser, output string, opts capture.Options) (*capture.Session, error) {
+					return driver.CaptureNetwork(id, out, output, opts)
+				})
+			default:
+				allow(w, r, http.MethodGet)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/endpoints/", func(w http.ResponseWriter, r *http.Request) {
+		id, action := splitPath(r.URL.Path, "/endpoints/")
+		switch action {
+		case "":
+			if allow(w, r, http.MethodGet) {
+				status, err := driver.EndpointStatus(id)
+				writeResponse(w, status, err)
+			}
+		case "replug":
+			if allow(w, r, http.MethodPost) {
+				writeResponse(w, nil, driver.ReplugEndpoint(id))
+			}
+		case "detach":
+			if allow(w, r, http.MethodPost) {
+				writeResponse(w, nil, driver.DetachEndpoint(id))
+			}
+		case "netem":
+			if opt, ok := netemOptions(w, r); ok {
+				netem, err := driver.SetEndpointNetem(id, opt)
+				writeResponse(w, netem, err)
+			}
+		case "capture":
+			switch r.Method {
+			case http.MethodGet:
+				streamCapture(w, r, func(out io.WriteCloser, opts capture.Options) (*capture.Session, error) {
+					return driver.CaptureEndpoint(id, out, "stream", opts)
+				})
+			case http.MethodPost:
+				fileCapture(w, r, func(out io.WriteCloser, output string, opts capture.Options) (*capture.Session, error) {
+					return driver.CaptureEndpoint(id, out, output, opts)
+				})
+			default:
+				allow(w, r, http.MethodGet)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/captures", func(w http.ResponseWriter, r *http.Request) {
+		if allow(w, r, http.MethodGet) {
+			writeResponse(w, driver.Captures(), nil)
+		}
+	})
+	mux.HandleFunc("/captures/", func(w http.ResponseWriter, r *http.Request) {
+		id, action := splitPath(r.URL.Path, "/captures/")
+		if action != "stop" {
+			http.NotFound(w, r)
+			return
+		}
+		if allow(w, r, http.MethodPost) {
+			writeResponse(w, nil, driver.StopCapture(id))
+		}
+	})
+	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		if allow(w, r, http.MethodPost) {
+			writeResponse(w, driver.GC(), nil)
+		}
+	})
+	return mux
+}
+
+// Serves the admin API on the Unix socket at path, a stale socket left by a previous daemon is replaced
+func ListenAndServe(path string, driver *vdenet.Driver) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(path, SockMode); err != nil {
+		return err
+	}
+	log.Infof("Admin API: [ %s ]", path)
+	return http.Serve(listener, Handler(driver))
+}
+
+// Decodes the options of a NetemRequest, replies with an error if they can't be decoded
+func netemOptions(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	if !allow(w, r, http.MethodPost) {
+		return nil, false
+	}
+	var req NetemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, nil, types.BadRequestErrorf("Bad netem request: %s", err))
+		return nil, false
+	}
+	opt := make(map[string]interface{}, len(req))
+	for key, value := range req {
+		opt[key] = value
+	}
+	return opt, true
+}
+
+// starts a capture writing to out
+type captureFunc func(out io.WriteCloser, opts capture.Options) (*capture.Session, error)
+
+// starts a capture writing to out, a file described by output
+type fileCaptureFunc func(out io.WriteCloser, output string, opts capture.Options) (*capture.Session, error)
+
+// Streams a capture in the response until the client goes away or the capture stops
+func streamCapture(w http.ResponseWriter, r *http.Request, start captureFunc) {
+	opts, err := captureOptions(r.URL.Query().Get("filter"), r.URL.Query().Get("max-bytes"), r.URL.Query().Get("duration"))
+	if err != nil {
+		writeResponse(w, nil, err)
+		return
+	}
+
+	// the headers are sent along with the section header of the capture
+	w.Header().Set("Content-Type", PcapngContentType)
+	session, err := start(&flushWriter{w: w}, opts)
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeResponse(w, nil, err)
+		return
+	}
+	select {
+	case <-session.Done():
+	case <-r.Context().Done():
+		session.Stop(nil)
+		<-session.Done()
+	}
+}
+
+// Starts a capture written by the daemon to the file of the request, replies with its status
+func fileCapture(w http.ResponseWriter, r *http.Request, start fileCaptureFunc) {
+	var req CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, nil, types.BadRequestErrorf("Bad capture request: %s", err))
+		return
+	}
+	if !filepath.IsAbs(req.File) {
+		writeResponse(w, nil, types.BadRequestErrorf("Capture file must be an absolute path."))
+		return
+	}
+	opts, err := captureOptions(req.Filter, strconv.FormatInt(req.MaxBytes, 10), req.Duration)
+	if err != nil {
+		writeResponse(w, nil, err)
+		return
+	}
+	out, err := os.OpenFile(req.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, CaptureFileMode)
+	if err != nil {
+		writeResponse(w, nil, types.BadRequestErrorf("Failed capture file: %s", err))
+		return
+	}
+	session, err := start(out, req.File, opts)
+	if err != nil {
+		writeResponse(w, nil, err)
+		return
+	}
+	writeResponse(w, session.Status(), nil)
+}
+
+// permissions of the capture files written by the daemon, they may hold sensitive traffic
+const CaptureFileMode = 0600
+
+// Parses the options of a capture, empty values are not set
+func captureOptions(filter, maxBytes, duration string) (capture.Options, error) {
+	opts := capture.Options{Filter: filter}
+	if maxBytes != "" {
+		n, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || n < 0 {
+			return opts, types.BadRequestErrorf("Bad max-bytes %s.", maxBytes)
+		}
+		opts.MaxBytes = n
+	}
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d < 0 {
+			return opts, types.BadRequestErrorf("Bad duration %s.", duration)
+		}
+		opts.Duration = d
+	}
+	return opts, nil
+}
+
+// Writer flushing every write to the client, the response is closed by the handler
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (this *flushWriter) Write(buf []byte) (int, error) {
+	n, err := this.w.Write(buf)
+	if flusher, ok := this.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func (this *flushWriter) Close() error {
+	return nil
+}
+
+// Splits /prefix/<id>/<action> in id and action
+func splitPath(path, prefix string) (string, string) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(path, prefix), "/")
+	return id, action
+}
+
+// Replies 405 if the request method is not method
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, r.Method+" not allowed.")
+		return false
+	}
+	return true
+}
+
+// Writes res as JSON, or err with the HTTP status matching its libnetwork type
+func writeResponse(w http.ResponseWriter, res interface{}, err error) {
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Err: msg})
+}
+
+// Returns the HTTP status of an error returned by the driver
+func errorStatus(err error) int {
+	switch err.(type) {
+	case types.NotFoundError:
+		return http.StatusNotFound
+	case types.BadRequestError:
+		return http.StatusBadRequest
+	case types.ForbiddenError:
+		return http.StatusForbidden
+	case types.NotImplementedError:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
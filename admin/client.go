@@ -0,0 +1,207 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"phocs/vde_plug_docker/capture"
+	"phocs/vde_plug_docker/endpoint"
+	"phocs/vde_plug_docker/vdenet"
+)
+
+// timeout of the requests to the daemon, moving a network replugs all its endpoints
+const ClientTimeout = 30 * time.Second
+
+// Client of the admin API of a running daemon
+type Client struct {
+	http http.Client
+}
+
+// Returns a client talking to the daemon through the admin socket at path
+func NewClient(path string) *Client {
+	return &Client{http: http.Client{
+		Timeout: ClientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// Returns the status of every network
+func (this *Client) Networks() ([]*vdenet.NetworkStatus, error) {
+	var res []*vdenet.NetworkStatus
+	return res, this.call(http.MethodGet, "/networks", nil, &res)
+}
+
+// Returns the status of a network and its endpoints
+func (this *Client) Network(id string) (*vdenet.NetworkStatus, error) {
+	var res vdenet.NetworkStatus
+	if err := this.call(http.MethodGet, "/networks/"+url.PathEscape(id), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Returns the status of an endpoint
+func (this *Client) Endpoint(id string) (*vdenet.EndpointStatus, error) {
+	var res vdenet.EndpointStatus
+	if err := this.call(http.MethodGet, "/endpoints/"+url.PathEscape(id), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Moves a network to another VNL
+func (this *Client) Move(id string, sock string) error {
+	return this.call(http.MethodPost, "/networks/"+url.PathEscape(id)+"/move", &MoveRequest{Sock: sock}, nil)
+}
+
+// Plugs an endpoint again to its network
+func (this *Client) Replug(id string) error {
+	return this.call(http.MethodPost, "/endpoints/"+url.PathEscape(id)+"/replug", nil, nil)
+}
+
+// Unplugs an endpoint from its network
+func (this *Client) Detach(id string) error {
+	return this.call(http.MethodPost, "/endpoints/"+url.PathEscape(id)+"/detach", nil, nil)
+}
+
+// Changes the impairments of an endpoint with netem options, returns the new ones
+func (this *Client) EndpointNetem(id string, opt NetemRequest) (*endpoint.Netem, error) {
+	var res endpoint.Netem
+	if err := this.call(http.MethodPost, "/endpoints/"+url.PathEscape(id)+"/netem", opt, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Changes the impairments of a network and its endpoints with netem options, returns the new ones of the network
+func (this *Client) NetworkNetem(id string, opt NetemRequest) (*endpoint.Netem, error) {
+	var res endpoint.Netem
+	if err := this.call(http.MethodPost, "/networks/"+url.PathEscape(id)+"/netem", opt, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Starts a capture of an endpoint written by the daemon to the file of req
+func (this *Client) CaptureEndpoint(id string, req *CaptureRequest) (*capture.Status, error) {
+	var res capture.Status
+	if err := this.call(http.MethodPost, "/endpoints/"+url.PathEscape(id)+"/capture", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Streams a capture of an endpoint to w until the capture stops, the options are those of CaptureRequest
+func (this *Client) StreamEndpoint(id string, req *CaptureRequest, w io.Writer) error {
+	return this.stream("/endpoints/"+url.PathEscape(id)+"/capture", req, w)
+}
+
+// Starts a capture of all the endpoints of a network written by the daemon to the file of req
+func (this *Client) CaptureNetwork(id string, req *CaptureRequest) (*capture.Status, error) {
+	var res capture.Status
+	if err := this.call(http.MethodPost, "/networks/"+url.PathEscape(id)+"/capture", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Streams a capture of all the endpoints of a network to w until the capture stops, the options are those of CaptureRequest
+func (this *Client) StreamNetwork(id string, req *CaptureRequest, w io.Writer) error {
+	return this.stream("/networks/"+url.PathEscape(id)+"/capture", req, w)
+}
+
+// Returns the status of the running captures
+func (this *Client) Captures() ([]capture.Status, error) {
+	var res []capture.Status
+	return res, this.call(http.MethodGet, "/captures", nil, &res)
+}
+
+// Stops a capture
+func (this *Client) StopCapture(id string) error {
+	return this.call(http.MethodPost, "/captures/"+url.PathEscape(id)+"/stop", nil, nil)
+}
+
+// Cleans up after the containers gone without leaving their networks
+func (this *Client) GC() ([]string, error) {
+	var res []string
+	return res, this.call(http.MethodPost, "/gc", nil, &res)
+}
+
+// Sends req as JSON and decodes the response in res, error responses are returned as errors
+func (this *Client) call(method, path string, req interface{}, res interface{}) error {
+	var body io.Reader
+	if req != nil {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	// the host is ignored, the request goes to the admin socket
+	request, err := http.NewRequest(method, "http://vde"+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", ContentType)
+	response, err := this.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := responseError(response); err != nil {
+		return err
+	}
+	if res == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(res)
+}
+
+// Copies to w the capture streamed at path with the options of req
+func (this *Client) stream(path string, req *CaptureRequest, w io.Writer) error {
+	query := url.Values{}
+	query.Set("filter", req.Filter)
+	query.Set("max-bytes", strconv.FormatInt(req.MaxBytes, 10))
+	query.Set("duration", req.Duration)
+
+	// the stream lasts as long as the capture
+	client := this.http
+	client.Timeout = 0
+	response, err := client.Get("http://vde" + path + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := responseError(response); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Returns the error of an error response, nil for the others
+func responseError(response *http.Response) error {
+	if response.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	var e ErrorResponse
+	if err := json.NewDecoder(response.Body).Decode(&e); err != nil || e.Err == "" {
+		return errors.New(response.Status)
+	}
+	return errors.New(e.Err)
+}
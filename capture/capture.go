@@ -0,0 +1,250 @@
+// Packet captures of the frames forwarded by the plugs, written in the pcapng format
+package capture
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// direction of a captured frame, In goes from the VDE network to the container and Out the other way
+type Direction int
+
+const (
+	In Direction = iota
+	Out
+)
+
+// frames queued for the writer of a capture, further frames are dropped
+const QueueLen = 1024
+
+// application written in the section header of the captures
+const Application = "vde_plug_docker"
+
+// ErrMaxBytes ends the captures that reached their maximum size
+var ErrMaxBytes = errors.New("capture: maximum size reached")
+
+// Limits and filter of a capture
+type Options struct {
+	// tcpdump-like filter expression, see Filter
+	Filter string
+
+	// the capture stops once it wrote MaxBytes bytes or ran for Duration, if not zero
+	MaxBytes int64
+	Duration time.Duration
+}
+
+// State of a capture, as reported by the admin API
+type Status struct {
+	ID       string    `json:"ID"`
+	Target   string    `json:"Target"`
+	Output   string    `json:"Output"`
+	Filter   string    `json:"Filter"`
+	Started  time.Time `json:"Started"`
+	Packets  uint64    `json:"Packets"`
+	Bytes    int64     `json:"Bytes"`
+	Drops    uint64    `json:"Drops"`
+	Stopped  bool      `json:"Stopped"`
+	Error    string    `json:"Error,omitempty"`
+	MaxBytes int64     `json:"MaxBytes,omitempty"`
+	Duration string    `json:"Duration,omitempty"`
+}
+
+// Capture writing the frames of one or more interfaces to a pcapng stream.
+// The frames are queued by the plugs and written by a goroutine of the session,
+// so that a slow output never stalls the forwarding
+type Session struct {
+	id      string
+	target  string
+	output  string
+	opts    Options
+	filter  *Filter
+	started time.Time
+
+	// pcapng writer and its output
+	mutex  sync.Mutex
+	writer *Writer
+	out    io.WriteCloser
+
+	queue   chan record
+	packets uint64
+	drops   uint64
+
+	// stop is closed when the capture is asked to stop, done when the output has been closed
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// frame waiting to be written
+type record struct {
+	ifid  uint32
+	time  time.Time
+	dir   Direction
+	frame []byte
+}
+
+// Starts a capture writing to out, target and output describe the captured interfaces and the output in the status
+func NewSession(id, target, output string, out io.WriteCloser, opts Options) (*Session, error) {
+	filter, err := ParseFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewWriter(out, Application)
+	if err != nil {
+		return nil, err
+	}
+	this := &Session{
+		id:      id,
+		target:  target,
+		output:  output,
+		opts:    opts,
+		filter:  filter,
+		started: time.Now(),
+		writer:  writer,
+		out:     out,
+		queue:   make(chan record, QueueLen),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go this.run()
+	if opts.Duration > 0 {
+		time.AfterFunc(opts.Duration, func() { this.Stop(nil) })
+	}
+	log.Debugf("Capture [ %s ] started: [ %s ] to [ %s ]", id, target, output)
+	return this, nil
+}
+
+// Returns the ID of the capture
+func (this *Session) ID() string {
+	return this.id
+}
+
+// Adds an interface to the capture, the frames captured through the returned tap are attributed to it
+func (this *Session) AddInterface(name, description string) (*Tap, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ifid, err := this.writer.AddInterface(name, description)
+	if err != nil {
+		return nil, err
+	}
+	return &Tap{session: this, ifid: ifid}, nil
+}
+
+// Writes the queued frames until the capture stops, then closes the output
+func (this *Session) run() {
+	defer close(this.done)
+loop:
+	for {
+		select {
+		case <-this.stop:
+			break loop
+		case rec := <-this.queue:
+			this.mutex.Lock()
+			err := this.writer.WritePacket(rec.ifid, rec.time, rec.dir, rec.frame)
+			written := this.writer.Written()
+			this.mutex.Unlock()
+			atomic.AddUint64(&this.packets, 1)
+			if err == nil && this.opts.MaxBytes > 0 && written >= this.opts.MaxBytes {
+				err = ErrMaxBytes
+			}
+			if err != nil {
+				this.Stop(err)
+				break loop
+			}
+		}
+	}
+	if err := this.out.Close(); err != nil && this.err == nil {
+		this.err = err
+	}
+	log.Debugf("Capture [ %s ] stopped: [ %v ]", this.id, this.err)
+}
+
+// Stops the capture, err is the reason if it is not a request
+func (this *Session) Stop(err error) {
+	this.once.Do(func() {
+		if err != ErrMaxBytes {
+			this.err = err
+		}
+		close(this.stop)
+	})
+}
+
+// Returns a channel closed when the capture has stopped and its output has been closed
+func (this *Session) Done() <-chan struct{} {
+	return this.done
+}
+
+// Waits for the capture to stop, returns the error that stopped it
+func (this *Session) Wait() error {
+	<-this.done
+	return this.err
+}
+
+// Returns the state of the capture
+func (this *Session) Status() Status {
+	status := Status{
+		ID:       this.id,
+		Target:   this.target,
+		Output:   this.output,
+		Filter:   this.filter.String(),
+		Started:  this.started,
+		Packets:  atomic.LoadUint64(&this.packets),
+		Drops:    atomic.LoadUint64(&this.drops),
+		MaxBytes: this.opts.MaxBytes,
+	}
+	if this.opts.Duration > 0 {
+		status.Duration = this.opts.Duration.String()
+	}
+	this.mutex.Lock()
+	status.Bytes = this.writer.Written()
+	this.mutex.Unlock()
+	select {
+	case <-this.done:
+		status.Stopped = true
+		if this.err != nil {
+			status.Error = this.err.Error()
+		}
+	default:
+	}
+	return status
+}
+
+// Capture point of an interface of a session, used by the plugs
+type Tap struct {
+	session *Session
+	ifid    uint32
+}
+
+// Queues a copy of a frame if it matches the filter, the frame is dropped if the writer can't keep up
+func (this *Tap) Capture(dir Direction, frame []byte) {
+	session := this.session
+	select {
+	case <-session.stop:
+		return
+	default:
+	}
+	if !session.filter.Match(frame) {
+		return
+	}
+	select {
+	case session.queue <- record{ifid: this.ifid, time: time.Now(), dir: dir, frame: append([]byte(nil), frame...)}:
+	default:
+		atomic.AddUint64(&session.drops, 1)
+	}
+}
+
+// Returns true once the capture of the tap has stopped
+func (this *Tap) Stopped() bool {
+	select {
+	case <-this.session.stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,381 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ethertypes and IP protocols known by the filters
+const (
+	etherIPv4  = 0x0800
+	etherARP   = 0x0806
+	etherIPv6  = 0x86DD
+	etherVLAN  = 0x8100
+	etherQinQ  = 0x88A8
+	protoICMP  = 1
+	protoTCP   = 6
+	protoUDP   = 17
+	protoICMP6 = 58
+)
+
+// Filter of the captured frames, a subset of the tcpdump syntax:
+//
+//	[ether] [src|dst] host MAC, ether proto N|ip|ip6|arp, broadcast, multicast,
+//	[src|dst] host IP, [src|dst] net CIDR, [src|dst] port N, vlan [ID],
+//	ip, ip6, arp, tcp, udp, icmp, icmp6
+//
+// combined with and, or, not and parentheses (also &&, || and !)
+type Filter struct {
+	expr  string
+	match func(p *packet) bool
+}
+
+// Parses a filter expression, an empty expression matches every frame
+func ParseFilter(expr string) (*Filter, error) {
+	this := &Filter{expr: expr, match: func(p *packet) bool { return true }}
+	tokens := tokenize(expr)
+	if len(tokens) == 0 {
+		return this, nil
+	}
+	parser := &parser{tokens: tokens}
+	match, err := parser.or()
+	if err == nil && parser.pos < len(tokens) {
+		err = fmt.Errorf("unexpected %q", tokens[parser.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %s", expr, err)
+	}
+	this.match = match
+	return this, nil
+}
+
+// Returns true if the frame matches the filter
+func (this *Filter) Match(frame []byte) bool {
+	if this == nil {
+		return true
+	}
+	var p packet
+	p.decode(frame)
+	return this.match(&p)
+}
+
+// Returns the filter expression
+func (this *Filter) String() string {
+	return this.expr
+}
+
+// fields of a frame used by the filters
+type packet struct {
+	src, dst   net.HardwareAddr
+	ethertype  uint16
+	vlans      []uint16
+	srcIP      net.IP
+	dstIP      net.IP
+	proto      int
+	srcPort    int
+	dstPort    int
+	hasPorts   bool
+	hasAddress bool
+}
+
+// Decodes the headers of an ethernet frame, as far as they are known
+func (this *packet) decode(frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	this.dst, this.src = frame[0:6], frame[6:12]
+	this.ethertype = binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+	for (this.ethertype == etherVLAN || this.ethertype == etherQinQ) && len(payload) >= 4 {
+		this.vlans = append(this.vlans, binary.BigEndian.Uint16(payload[0:2])&0x0FFF)
+		this.ethertype = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+
+	this.proto = -1
+	switch this.ethertype {
+	case etherIPv4:
+		if len(payload) < 20 {
+			return
+		}
+		ihl := int(payload[0]&0x0F) * 4
+		this.srcIP, this.dstIP, this.hasAddress = payload[12:16], payload[16:20], true
+		this.proto = int(payload[9])
+		// only the first fragment holds the ports
+		if binary.BigEndian.Uint16(payload[6:8])&0x1FFF == 0 && len(payload) >= ihl {
+			this.ports(payload[ihl:])
+		}
+	case etherIPv6:
+		if len(payload) < 40 {
+			return
+		}
+		this.srcIP, this.dstIP, this.hasAddress = payload[8:24], payload[24:40], true
+		this.proto = int(payload[6])
+		this.ports(payload[40:])
+	case etherARP:
+		// sender and target protocol addresses of IPv4 over ethernet
+		if len(payload) >= 28 && binary.BigEndian.Uint16(payload[2:4]) == etherIPv4 {
+			this.srcIP, this.dstIP, this.hasAddress = payload[14:18], payload[24:28], true
+		}
+	}
+}
+
+// Decodes the ports of TCP and UDP segments
+func (this *packet) ports(l4 []byte) {
+	if (this.proto == protoTCP || this.proto == protoUDP) && len(l4) >= 4 {
+		this.srcPort = int(binary.BigEndian.Uint16(l4[0:2]))
+		this.dstPort = int(binary.BigEndian.Uint16(l4[2:4]))
+		this.hasPorts = true
+	}
+}
+
+// Splits a filter expression in tokens, parentheses and ! are tokens on their own
+func tokenize(expr string) []string {
+	for _, sep := range []string{"(", ")", "!"} {
+		expr = strings.ReplaceAll(expr, sep, " "+sep+" ")
+	}
+	return strings.Fields(expr)
+}
+
+// recursive descent parser of the filter expressions
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (this *parser) peek() string {
+	return this.lookahead(0)
+}
+
+// returns the token n positions after the next one, "" past the end
+func (this *parser) lookahead(n int) string {
+	if this.pos+n < len(this.tokens) {
+		return this.tokens[this.pos+n]
+	}
+	return ""
+}
+
+func (this *parser) next() string {
+	token := this.peek()
+	this.pos++
+	return token
+}
+
+// or := and { (or | ||) and }
+func (this *parser) or() (func(p *packet) bool, error) {
+	left, err := this.and()
+	if err != nil {
+		return nil, err
+	}
+	for this.peek() == "or" || this.peek() == "||" {
+		this.next()
+		right, err := this.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *packet) bool { return l(p) || right(p) }
+	}
+	return left, nil
+}
+
+// and := not { (and | &&) not }
+func (this *parser) and() (func(p *packet) bool, error) {
+	left, err := this.not()
+	if err != nil {
+		return nil, err
+	}
+	for this.peek() == "and" || this.peek() == "&&" {
+		this.next()
+		right, err := this.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *packet) bool { return l(p) && right(p) }
+	}
+	return left, nil
+}
+
+// not := (not | !) not | ( or ) | primitive
+func (this *parser) not() (func(p *packet) bool, error) {
+	switch this.peek() {
+	case "not", "!":
+		this.next()
+		inner, err := this.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *packet) bool { return !inner(p) }, nil
+	case "(":
+		this.next()
+		inner, err := this.or()
+		if err != nil {
+			return nil, err
+		}
+		if this.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return this.primitive()
+}
+
+// primitive := [ether] [src|dst] qualifier value | protocol
+func (this *parser) primitive() (func(p *packet) bool, error) {
+	token := this.next()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "ip":
+		return ethertype(etherIPv4), nil
+	case "ip6":
+		return ethertype(etherIPv6), nil
+	case "arp":
+		return ethertype(etherARP), nil
+	case "tcp":
+		return this.transport(protoTCP)
+	case "udp":
+		return this.transport(protoUDP)
+	case "icmp":
+		return protocol(protoICMP), nil
+	case "icmp6":
+		return protocol(protoICMP6), nil
+	case "broadcast":
+		return func(p *packet) bool { return bytes.Equal(p.dst, broadcastMAC) }, nil
+	case "multicast":
+		return func(p *packet) bool { return len(p.dst) == 6 && p.dst[0]&1 == 1 }, nil
+	case "vlan":
+		// the identifier is optional
+		if id, err := strconv.Atoi(this.peek()); err == nil {
+			this.next()
+			return func(p *packet) bool {
+				for _, vlan := range p.vlans {
+					if int(vlan) == id {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		return func(p *packet) bool { return len(p.vlans) != 0 }, nil
+	case "ether":
+		return this.ether()
+	}
+
+	// optional direction
+	dir := ""
+	if token == "src" || token == "dst" {
+		dir, token = token, this.next()
+	}
+	value := this.next()
+	if value == "" {
+		return nil, fmt.Errorf("%s needs a value", token)
+	}
+	switch token {
+	case "host":
+		// MAC addresses are accepted without ether, as tcpdump does
+		if mac, err := net.ParseMAC(value); err == nil {
+			return macMatch(dir, mac), nil
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("bad host %q", value)
+		}
+		return ipMatch(dir, func(addr net.IP) bool { return addr.Equal(ip) }), nil
+	case "net":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad net %q", value)
+		}
+		return ipMatch(dir, ipnet.Contains), nil
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("bad port %q", value)
+		}
+		return func(p *packet) bool {
+			return p.hasPorts && (dir != "dst" && p.srcPort == port || dir != "src" && p.dstPort == port)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", token)
+}
+
+// tcp|udp [[src|dst] port N], the port restricts the protocol as in tcpdump
+func (this *parser) transport(proto int) (func(p *packet) bool, error) {
+	next := this.peek()
+	if next == "src" || next == "dst" {
+		next = this.lookahead(1)
+	}
+	if next != "port" {
+		return protocol(proto), nil
+	}
+	port, err := this.primitive()
+	if err != nil {
+		return nil, err
+	}
+	return func(p *packet) bool { return p.proto == proto && port(p) }, nil
+}
+
+// ether [src|dst] host MAC | ether proto N | ether broadcast | ether multicast
+func (this *parser) ether() (func(p *packet) bool, error) {
+	token := this.next()
+	switch token {
+	case "broadcast", "multicast":
+		this.pos--
+		return this.primitive()
+	case "proto":
+		value := this.next()
+		switch value {
+		case "ip":
+			return ethertype(etherIPv4), nil
+		case "ip6":
+			return ethertype(etherIPv6), nil
+		case "arp":
+			return ethertype(etherARP), nil
+		}
+		proto, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad ether proto %q", value)
+		}
+		return ethertype(uint16(proto)), nil
+	}
+	dir := ""
+	if token == "src" || token == "dst" {
+		dir, token = token, this.next()
+	}
+	if token != "host" {
+		return nil, fmt.Errorf("unknown ether primitive %q", token)
+	}
+	mac, err := net.ParseMAC(this.next())
+	if err != nil {
+		return nil, err
+	}
+	return macMatch(dir, mac), nil
+}
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func ethertype(kind uint16) func(p *packet) bool {
+	return func(p *packet) bool { return p.ethertype == kind }
+}
+
+func protocol(proto int) func(p *packet) bool {
+	return func(p *packet) bool { return p.proto == proto }
+}
+
+func macMatch(dir string, mac net.HardwareAddr) func(p *packet) bool {
+	return func(p *packet) bool {
+		return dir != "dst" && bytes.Equal(p.src, mac) || dir != "src" && bytes.Equal(p.dst, mac)
+	}
+}
+
+func ipMatch(dir string, match func(addr net.IP) bool) func(p *packet) bool {
+	return func(p *packet) bool {
+		return p.hasAddress && (dir != "dst" && match(p.srcIP) || dir != "src" && match(p.dstIP))
+	}
+}
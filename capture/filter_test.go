@@ -0,0 +1,180 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	macA = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+	ipA  = net.IPv4(10, 0, 0, 1).To4()
+	ipB  = net.IPv4(10, 0, 1, 2).To4()
+)
+
+// ethernet frame from macA to dst carrying payload, tagged with the given VLANs, outer first
+func ethFrame(dst net.HardwareAddr, ethertype uint16, payload []byte, vlans ...uint16) []byte {
+	frame := append(append([]byte{}, dst...), macA...)
+	for _, vlan := range vlans {
+		frame = binary.BigEndian.AppendUint16(frame, etherVLAN)
+		frame = binary.BigEndian.AppendUint16(frame, vlan)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	return append(frame, payload...)
+}
+
+// IPv4 packet from ipA to ipB of the given protocol, with the ports when they are not 0
+func ipv4Packet(proto byte, srcPort, dstPort uint16, fragment uint16) []byte {
+	pkt := make([]byte, 20, 28)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[6:], fragment)
+	pkt[9] = proto
+	copy(pkt[12:], ipA)
+	copy(pkt[16:], ipB)
+	if srcPort != 0 || dstPort != 0 {
+		pkt = binary.BigEndian.AppendUint16(pkt, srcPort)
+		pkt = binary.BigEndian.AppendUint16(pkt, dstPort)
+		pkt = append(pkt, 0, 0, 0, 0)
+	}
+	return pkt
+}
+
+// ARP request of ipA for ipB
+func arpPacket() []byte {
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:], 1)
+	binary.BigEndian.PutUint16(pkt[2:], etherIPv4)
+	pkt[4], pkt[5] = 6, 4
+	binary.BigEndian.PutUint16(pkt[6:], 1)
+	copy(pkt[8:], macA)
+	copy(pkt[14:], ipA)
+	copy(pkt[24:], ipB)
+	return pkt
+}
+
+// IPv6 UDP datagram
+func ipv6Packet(srcPort, dstPort uint16) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[6] = protoUDP
+	copy(pkt[8:], net.ParseIP("fd00::1"))
+	copy(pkt[24:], net.ParseIP("fd00::2"))
+	pkt = binary.BigEndian.AppendUint16(pkt, srcPort)
+	return binary.BigEndian.AppendUint16(pkt, dstPort)
+}
+
+func TestFilterMatch(t *testing.T) {
+	var (
+		tcp80     = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 40000, 80, 0))
+		tcpFrom80 = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 80, 40000, 0))
+		udp53     = ethFrame(macB, etherIPv4, ipv4Packet(protoUDP, 40000, 53, 0))
+		udp67     = ethFrame(macB, etherIPv4, ipv4Packet(protoUDP, 68, 67, 0))
+		udpFrom80 = ethFrame(macB, etherIPv4, ipv4Packet(protoUDP, 80, 40000, 0))
+		icmp      = ethFrame(macB, etherIPv4, ipv4Packet(protoICMP, 0, 0, 0))
+		arp       = ethFrame(broadcastMAC, etherARP, arpPacket())
+		udp6      = ethFrame(net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, etherIPv6, ipv6Packet(546, 547))
+		tagged5   = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 40000, 80, 0), 5)
+		tagged6   = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 40000, 80, 0), 6)
+		qinq      = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 40000, 80, 0), 100, 5)
+		// second fragment of a datagram, the bytes after the IP header are not ports
+		fragment = ethFrame(macB, etherIPv4, ipv4Packet(protoTCP, 40000, 80, 185))
+		runt     = []byte{0xff, 0xff}
+	)
+
+	tests := []struct {
+		expr    string
+		matches [][]byte
+		misses  [][]byte
+	}{
+		{"", [][]byte{tcp80, arp, runt}, nil},
+
+		// and binds tighter than or, not tighter than and
+		{"tcp or udp and port 53", [][]byte{tcp80, tcpFrom80, udp53}, [][]byte{udp67, arp}},
+		{"(tcp or udp) and port 53", [][]byte{udp53}, [][]byte{tcp80, udp67}},
+		{"not tcp and udp", [][]byte{udp53, udp67}, [][]byte{tcp80, arp}},
+		{"not (tcp or udp)", [][]byte{arp, icmp}, [][]byte{tcp80, udp53}},
+		{"! tcp && ! udp", [][]byte{arp, icmp}, [][]byte{tcp80, udp53}},
+		{"arp || icmp", [][]byte{arp, icmp}, [][]byte{tcp80}},
+		{"not not tcp", [][]byte{tcp80}, [][]byte{udp53}},
+		{"((tcp))", [][]byte{tcp80}, [][]byte{udp53}},
+
+		// the port restricts the protocol
+		{"tcp src port 80", [][]byte{tcpFrom80}, [][]byte{tcp80, udpFrom80}},
+		{"tcp port 80", [][]byte{tcp80, tcpFrom80}, [][]byte{udpFrom80, fragment}},
+		{"udp dst port 53", [][]byte{udp53}, [][]byte{tcp80, udp67}},
+		{"port 547", [][]byte{udp6}, [][]byte{udp53}},
+		{"src port 80", [][]byte{tcpFrom80, udpFrom80}, [][]byte{tcp80}},
+
+		// the VLAN tags are skipped to decode the rest of the frame
+		{"vlan", [][]byte{tagged5, qinq}, [][]byte{tcp80}},
+		{"vlan 5", [][]byte{tagged5, qinq}, [][]byte{tagged6, tcp80}},
+		{"vlan 100 and tcp port 80", [][]byte{qinq}, [][]byte{tagged5}},
+
+		{"ether proto 0x0806", [][]byte{arp}, [][]byte{tcp80}},
+		{"ether proto 2048", [][]byte{tcp80, icmp}, [][]byte{arp, udp6}},
+		{"ether proto arp", [][]byte{arp}, [][]byte{tcp80}},
+		{"ether proto ip6", [][]byte{udp6}, [][]byte{tcp80}},
+		{"ip6", [][]byte{udp6}, [][]byte{tcp80}},
+		{"ip", [][]byte{tcp80, tagged5}, [][]byte{arp, udp6}},
+
+		{"ether src host 02:00:00:00:00:0a", [][]byte{tcp80}, nil},
+		{"ether dst host 02:00:00:00:00:0a", nil, [][]byte{tcp80}},
+		{"host 02:00:00:00:00:0b", [][]byte{tcp80}, [][]byte{arp}},
+		{"broadcast", [][]byte{arp}, [][]byte{tcp80, udp6}},
+		{"ether multicast", [][]byte{arp, udp6}, [][]byte{tcp80}},
+
+		{"src host 10.0.0.1", [][]byte{tcp80, arp}, [][]byte{udp6}},
+		{"dst host 10.0.0.1", nil, [][]byte{tcp80, arp}},
+		{"dst net 10.0.1.0/24", [][]byte{tcp80, arp}, nil},
+		{"net 192.168.0.0/16", nil, [][]byte{tcp80}},
+		{"host fd00::2", [][]byte{udp6}, [][]byte{tcp80}},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			filter, err := ParseFilter(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, frame := range test.matches {
+				if !filter.Match(frame) {
+					t.Errorf("no match for %x", frame)
+				}
+			}
+			for _, frame := range test.misses {
+				if filter.Match(frame) {
+					t.Errorf("match for %x", frame)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"and tcp",
+		"(tcp",
+		"tcp)",
+		"not",
+		"port",
+		"port http",
+		"port 65536",
+		"src port -1",
+		"host nowhere",
+		"net 10.0.0.0",
+		"ether proto",
+		"ether proto 0x10000",
+		"ether foo",
+		"ether host 02:00",
+		"vlan and",
+		"tcp udp",
+		"bogus",
+	} {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParseFilter(expr); err == nil {
+				t.Errorf("%q parsed", expr)
+			}
+		})
+	}
+}
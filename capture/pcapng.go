@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types
+const (
+	blockSHB = 0x0A0D0D0A
+	blockIDB = 0x00000001
+	blockEPB = 0x00000006
+)
+
+// pcapng options
+const (
+	optEnd         = 0
+	optShbUserAppl = 4
+	optIfName      = 2
+	optIfDescr     = 3
+	optIfTsresol   = 9
+	optEpbFlags    = 2
+)
+
+// values of the pcapng header fields
+const (
+	byteOrderMagic = 0x1A2B3C4D
+	linkEthernet   = 1
+	tsresolNano    = 9
+	epbInbound     = 1
+	epbOutbound    = 2
+)
+
+// largest frame written in a capture, as tcpdump
+const SnapLen = 262144
+
+// byte order of the written files, readers detect it from the byte order magic
+var order = binary.LittleEndian
+
+// Writer of a pcapng section holding one or more ethernet interfaces
+type Writer struct {
+	w          io.Writer
+	interfaces uint32
+	written    int64
+}
+
+// Returns a writer with the section header block already written
+func NewWriter(w io.Writer, application string) (*Writer, error) {
+	this := &Writer{w: w}
+	body := make([]byte, 16)
+	order.PutUint32(body[0:], byteOrderMagic)
+	order.PutUint16(body[4:], 1)
+	order.PutUint16(body[6:], 0)
+	// section length not specified
+	order.PutUint64(body[8:], 0xFFFFFFFFFFFFFFFF)
+	body = appendOption(body, optShbUserAppl, []byte(application))
+	body = appendOption(body, optEnd, nil)
+	return this, this.writeBlock(blockSHB, body)
+}
+
+// Writes an interface description block, returns the ID of the interface
+func (this *Writer) AddInterface(name, description string) (uint32, error) {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:], linkEthernet)
+	order.PutUint32(body[4:], SnapLen)
+	body = appendOption(body, optIfName, []byte(name))
+	if description != "" {
+		body = appendOption(body, optIfDescr, []byte(description))
+	}
+	body = appendOption(body, optIfTsresol, []byte{tsresolNano})
+	body = appendOption(body, optEnd, nil)
+	if err := this.writeBlock(blockIDB, body); err != nil {
+		return 0, err
+	}
+	this.interfaces++
+	return this.interfaces - 1, nil
+}
+
+// Writes an enhanced packet block with a frame captured on the interface ifid
+func (this *Writer) WritePacket(ifid uint32, t time.Time, dir Direction, frame []byte) error {
+	length := len(frame)
+	if length > SnapLen {
+		frame = frame[:SnapLen]
+	}
+	ts := uint64(t.UnixNano())
+	body := make([]byte, 20, 20+len(frame)+16)
+	order.PutUint32(body[0:], ifid)
+	order.PutUint32(body[4:], uint32(ts>>32))
+	order.PutUint32(body[8:], uint32(ts))
+	order.PutUint32(body[12:], uint32(len(frame)))
+	order.PutUint32(body[16:], uint32(length))
+	body = append(body, frame...)
+	body = pad(body)
+
+	flags := make([]byte, 4)
+	if dir == In {
+		order.PutUint32(flags, epbInbound)
+	} else {
+		order.PutUint32(flags, epbOutbound)
+	}
+	body = appendOption(body, optEpbFlags, flags)
+	body = appendOption(body, optEnd, nil)
+	return this.writeBlock(blockEPB, body)
+}
+
+// Returns the number of bytes written so far
+func (this *Writer) Written() int64 {
+	return this.written
+}
+
+// Writes a block, its total length is repeated at both ends
+func (this *Writer) writeBlock(kind uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	buf := make([]byte, 8, total)
+	order.PutUint32(buf[0:], kind)
+	order.PutUint32(buf[4:], total)
+	buf = append(buf, body...)
+	buf = order.AppendUint32(buf, total)
+	n, err := this.w.Write(buf)
+	this.written += int64(n)
+	return err
+}
+
+// Appends an option, its value padded to 32 bits
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = order.AppendUint16(buf, code)
+	buf = order.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	return pad(buf)
+}
+
+// Pads buf to 32 bits
+func pad(buf []byte) []byte {
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
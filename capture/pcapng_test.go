@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// block read back from a pcapng file
+type testBlock struct {
+	kind uint32
+	body []byte
+}
+
+// Splits a pcapng file in blocks, checking that both length fields agree and are aligned to 32 bits
+func readBlocks(t *testing.T, buf []byte) []testBlock {
+	var blocks []testBlock
+	for len(buf) > 0 {
+		if len(buf) < 12 {
+			t.Fatalf("truncated block %x", buf)
+		}
+		kind := binary.LittleEndian.Uint32(buf[0:])
+		total := binary.LittleEndian.Uint32(buf[4:])
+		if total%4 != 0 || total < 12 || int(total) > len(buf) {
+			t.Fatalf("block %x of length %d, %d bytes left", kind, total, len(buf))
+		}
+		if trailer := binary.LittleEndian.Uint32(buf[total-4:]); trailer != total {
+			t.Fatalf("block %x of length %d, trailing length %d", kind, total, trailer)
+		}
+		blocks = append(blocks, testBlock{kind, buf[8 : total-4]})
+		buf = buf[total:]
+	}
+	return blocks
+}
+
+// Decodes the options of a block, the values are padded to 32 bits and the list ends with opt_endofopt
+func readOptions(t *testing.T, buf []byte) map[uint16][]byte {
+	options := make(map[uint16][]byte)
+	for {
+		if len(buf) < 4 {
+			t.Fatalf("options without end %x", buf)
+		}
+		code, length := binary.LittleEndian.Uint16(buf[0:]), int(binary.LittleEndian.Uint16(buf[2:]))
+		if code == optEnd {
+			if length != 0 || len(buf) != 4 {
+				t.Fatalf("bytes after the end of the options %x", buf)
+			}
+			return options
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(buf) {
+			t.Fatalf("option %d of %d bytes overflows %x", code, length, buf)
+		}
+		checkPadding(t, buf[4+length:4+padded])
+		options[code] = buf[4 : 4+length]
+		buf = buf[4+padded:]
+	}
+}
+
+func checkPadding(t *testing.T, padding []byte) {
+	if !bytes.Equal(padding, make([]byte, len(padding))) {
+		t.Errorf("padding %x is not zero", padding)
+	}
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "vde_plug_docker test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"vde0", "vde10"}
+	for i, name := range names {
+		description := ""
+		if i == 1 {
+			description = "container"
+		}
+		if id, err := w.AddInterface(name, description); err != nil || id != uint32(i) {
+			t.Fatalf("interface %d: id %d, %v", i, id, err)
+		}
+	}
+
+	// every padding length, and a frame longer than the snap length
+	at := time.Unix(1700000000, 123456789)
+	frames := [][]byte{make([]byte, 60), make([]byte, 61), make([]byte, 62), make([]byte, 63), make([]byte, SnapLen+1)}
+	for i, frame := range frames {
+		for j := range frame {
+			frame[j] = byte(i + j)
+		}
+		dir := In
+		if i%2 == 1 {
+			dir = Out
+		}
+		if err := w.WritePacket(uint32(i%2), at.Add(time.Duration(i)), dir, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Written() != int64(buf.Len()) {
+		t.Errorf("written %d, file of %d bytes", w.Written(), buf.Len())
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 1+len(names)+len(frames) {
+		t.Fatalf("%d blocks", len(blocks))
+	}
+
+	shb := blocks[0]
+	if shb.kind != blockSHB || binary.LittleEndian.Uint32(shb.body[0:]) != byteOrderMagic ||
+		binary.LittleEndian.Uint16(shb.body[4:]) != 1 || binary.LittleEndian.Uint16(shb.body[6:]) != 0 ||
+		binary.LittleEndian.Uint64(shb.body[8:]) != 0xFFFFFFFFFFFFFFFF {
+		t.Errorf("section header %x", shb.body)
+	}
+	if appl := readOptions(t, shb.body[16:])[optShbUserAppl]; string(appl) != "vde_plug_docker test" {
+		t.Errorf("shb_userappl %q", appl)
+	}
+
+	for i, idb := range blocks[1 : 1+len(names)] {
+		if idb.kind != blockIDB || binary.LittleEndian.Uint16(idb.body[0:]) != linkEthernet || binary.LittleEndian.Uint32(idb.body[4:]) != SnapLen {
+			t.Errorf("interface %d: %x", i, idb.body)
+			continue
+		}
+		options := readOptions(t, idb.body[8:])
+		if string(options[optIfName]) != names[i] || !bytes.Equal(options[optIfTsresol], []byte{tsresolNano}) {
+			t.Errorf("interface %d: options %q", i, options)
+		}
+		if _, ok := options[optIfDescr]; ok != (i == 1) {
+			t.Errorf("interface %d: if_description %q", i, options[optIfDescr])
+		}
+	}
+
+	for i, epb := range blocks[1+len(names):] {
+		frame := frames[i]
+		captured := len(frame)
+		if captured > SnapLen {
+			captured = SnapLen
+		}
+		body := epb.body
+		if epb.kind != blockEPB || binary.LittleEndian.Uint32(body[0:]) != uint32(i%2) {
+			t.Errorf("packet %d: block %x on interface %d", i, epb.kind, binary.LittleEndian.Uint32(body[0:]))
+			continue
+		}
+		ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+		if ts != uint64(at.Add(time.Duration(i)).UnixNano()) {
+			t.Errorf("packet %d: timestamp %d", i, ts)
+		}
+		if binary.LittleEndian.Uint32(body[12:]) != uint32(captured) || binary.LittleEndian.Uint32(body[16:]) != uint32(len(frame)) {
+			t.Errorf("packet %d: captured %d of %d bytes", i, binary.LittleEndian.Uint32(body[12:]), binary.LittleEndian.Uint32(body[16:]))
+		}
+
+		padded := (captured + 3) &^ 3
+		if !bytes.Equal(body[20:20+captured], frame[:captured]) {
+			t.Errorf("packet %d: data differs", i)
+		}
+		checkPadding(t, body[20+captured:20+padded])
+
+		flags := readOptions(t, body[20+padded:])[optEpbFlags]
+		want := uint32(epbInbound)
+		if i%2 == 1 {
+			want = epbOutbound
+		}
+		if len(flags) != 4 || binary.LittleEndian.Uint32(flags) != want {
+			t.Errorf("packet %d: epb_flags %x", i, flags)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"phocs/vde_plug_docker/admin"
+	"phocs/vde_plug_docker/datastore"
+	"phocs/vde_plug_docker/vdenet"
+)
+
+// length of the IDs shown in the lists, as docker does
+const shortID = 12
+
+// Networks and endpoints as seen by the commands, either from the running daemon or from the datastore
+type source interface {
+	Networks() ([]*vdenet.NetworkStatus, error)
+	Network(id string) (*vdenet.NetworkStatus, error)
+}
+
+// Driver loaded from the datastore, used when the admin socket is not given
+type offline struct {
+	driver *vdenet.Driver
+}
+
+func (this offline) Networks() ([]*vdenet.NetworkStatus, error) {
+	return this.driver.NetworksStatus(), nil
+}
+
+func (this offline) Network(id string) (*vdenet.NetworkStatus, error) {
+	return this.driver.NetworkStatus(id)
+}
+
+// Returns the running daemon if the admin socket is given, otherwise the datastore,
+// live is false when the state of the plugs is unknown
+func openSource() (src source, live bool, closer func(), err error) {
+	if *adminSock != "" {
+		return admin.NewClient(*adminSock), true, func() {}, nil
+	}
+	backend, err := newBackend()
+	if err != nil {
+		return nil, false, nil, err
+	}
+	driver, err := vdenet.OpenDriver(backend)
+	if err != nil {
+		backend.Close()
+		return nil, false, nil, err
+	}
+	return offline{driver}, false, func() { driver.Close() }, nil
+}
+
+// Lists the networks
+func ls() error {
+	src, _, closer, err := openSource()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	networks, err := src.Networks()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tSOCK\tIF\tIPV4 POOL\tIPV6 POOL\tENDPOINTS")
+	for _, nw := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", short(nw.ID), nw.Sock, nw.IfPrefix, nw.IPv4Pool, nw.IPv6Pool, len(nw.Endpoints))
+	}
+	return w.Flush()
+}
+
+// Writes a network and its endpoints as JSON
+func inspect(id string) error {
+	src, _, closer, err := openSource()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	nw, err := src.Network(id)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(nw)
+}
+
+// Lists the endpoints of a network with the state of their plugs
+func endpoints(id string) error {
+	src, live, closer, err := openSource()
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	nw, err := src.Network(id)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT ID\tIFNAME\tIPV4 ADDRESS\tMAC ADDRESS\tSTATE\tIN PACKETS\tOUT PACKETS\tRECONNECTS")
+	for _, ep := range nw.Endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", short(ep.ID), ep.IfName, ep.IPv4Address, ep.MacAddress,
+			endpointState(ep, live), ep.Counters.InPackets, ep.Counters.OutPackets, ep.Counters.Reconnects)
+	}
+	return w.Flush()
+}
+
+// Plugs an endpoint again to its network, only the daemon holds the plugs
+func replug(id string) error {
+	client, err := daemon("replug")
+	if err != nil {
+		return err
+	}
+	return client.Replug(id)
+}
+
+// Returns the client of the running daemon, for the commands that need it
+func daemon(command string) (*admin.Client, error) {
+	if *adminSock == "" {
+		return nil, errors.New(command + " needs the running daemon, give its --admin-sock")
+	}
+	return admin.NewClient(*adminSock), nil
+}
+
+// Returns true if a daemon answers on the plugin sockets, that it serves whatever its flags, or on the admin socket
+func daemonRunning() bool {
+	for _, sock := range []string{unixSock, ipamSock} {
+		// the socket file of a stopped daemon refuses the connection
+		if conn, err := net.DialTimeout("unix", sock, time.Second); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	if *adminSock != "" {
+		if _, err := admin.NewClient(*adminSock).Networks(); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Captures the frames of an endpoint, or of all the endpoints of a network, streamed by the daemon or written by it in background
+func captureTarget(id string, network bool) error {
+	client, err := daemon("capture")
+	if err != nil {
+		return err
+	}
+	req := &admin.CaptureRequest{File: *captureFile, Filter: *captureFlt, MaxBytes: *captureMax, Duration: *captureDur}
+	start, stream := client.CaptureEndpoint, client.StreamEndpoint
+	if network {
+		start, stream = client.CaptureNetwork, client.StreamNetwork
+	}
+
+	// the daemon writes the file, it needs an absolute path
+	if *captureBg {
+		if req.File == "-" {
+			return errors.New("--detach needs a --write file")
+		}
+		if req.File, err = filepath.Abs(req.File); err != nil {
+			return err
+		}
+		status, err := start(id, req)
+		if err != nil {
+			return err
+		}
+		fmt.Println(status.ID)
+		return nil
+	}
+
+	out := os.Stdout
+	if req.File != "-" {
+		if out, err = os.Create(req.File); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return stream(id, req, out)
+}
+
+// Lists the running captures
+func captures() error {
+	client, err := daemon("captures")
+	if err != nil {
+		return err
+	}
+	list, err := client.Captures()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CAPTURE ID\tTARGET\tOUTPUT\tFILTER\tPACKETS\tBYTES\tDROPS")
+	for _, status := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", status.ID, status.Target, status.Output, status.Filter, status.Packets, status.Bytes, status.Drops)
+	}
+	return w.Flush()
+}
+
+// Stops a capture
+func stopCapture(id string) error {
+	client, err := daemon("stop-capture")
+	if err != nil {
+		return err
+	}
+	return client.StopCapture(id)
+}
+
+// Changes the impairments of an endpoint, or of a network, and prints the new ones
+func netem(id string, opt map[string]string, network bool) error {
+	client, err := daemon("netem")
+	if err != nil {
+		return err
+	}
+	set := client.EndpointNetem
+	if network {
+		set = client.NetworkNetem
+	}
+	netem, err := set(id, opt)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(netem)
+}
+
+// Cleans up after the containers gone without leaving their networks. Only the daemon does it, a gc on the
+// datastore would remove the devices of the running daemon behind its back and be overwritten by it; a stopped
+// daemon cleans up when it starts again
+func gc() error {
+	client, err := daemon("gc")
+	if err != nil {
+		return err
+	}
+
+	report, err := client.GC()
+	if err != nil {
+		return err
+	}
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// Writes the datastore, upgraded to the current schema, to path or to the standard output if path is "-"
+func dump(path string) error {
+	backend, err := newBackend()
+	if err != nil {
+		return err
+	}
+	store := datastore.New(backend)
+	defer store.Close()
+
+	buf, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	return os.WriteFile(path, buf, datastore.OpenMode)
+}
+
+// Replaces the datastore with the dump at path, or read from the standard input if path is "-"
+func restore(path string) error {
+	// the daemon would overwrite the restored datastore
+	if daemonRunning() {
+		return errors.New("the daemon is running, stop it before restoring the datastore")
+	}
+
+	var buf []byte
+	var err error
+	if path == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	backend, err := newBackend()
+	if err != nil {
+		return err
+	}
+	store := datastore.New(backend)
+	defer store.Close()
+	return store.Restore(buf)
+}
+
+// Returns what the plug of an endpoint is doing
+func endpointState(ep *vdenet.EndpointStatus, live bool) string {
+	switch {
+	case ep.SandboxKey == "":
+		return "created"
+	case ep.Detached:
+		return "detached"
+	case !live:
+		// the plugs are known only to the daemon
+		return "joined"
+	case ep.Plugged:
+		return "plugged"
+	}
+	return "disconnected"
+}
+
+// Truncates an ID as docker does in its lists
+func short(id string) string {
+	if len(id) > shortID {
+		return id[:shortID]
+	}
+	return id
+}
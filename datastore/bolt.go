@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// name of the bucket holding the keys of the driver
+const BoltBucket = "vde_plug_docker"
+
+// Backend storing every network and endpoint under its own key of an embedded BoltDB database
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// Opens, or creates, the BoltDB database at path
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, OpenMode, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Reads every key of the bucket and rebuilds the driver document
+func (this *BoltBackend) Read() ([]byte, error) {
+	keys := make(map[string][]byte)
+	err := this.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BoltBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			keys[string(key)] = append([]byte(nil), value...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joinDocument(keys)
+}
+
+// Writes the keys that changed and deletes the ones that are gone, in a single transaction
+func (this *BoltBackend) Write(doc []byte) error {
+	keys, err := splitDocument(doc)
+	if err != nil {
+		return err
+	}
+	return this.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(BoltBucket))
+		if err != nil {
+			return err
+		}
+
+		// collect the stale keys first, the bucket can't be modified while iterating it
+		var stale [][]byte
+		bucket.ForEach(func(key, value []byte) error {
+			if _, ok := keys[string(key)]; !ok {
+				stale = append(stale, append([]byte(nil), key...))
+			} else if bytes.Equal(keys[string(key)], value) {
+				delete(keys, string(key))
+			}
+			return nil
+		})
+		for _, key := range stale {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		for key, value := range keys {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The database is opened by a single daemon, every write already replaces the whole bucket
+func (this *BoltBackend) Replace(doc []byte) error {
+	return this.Write(doc)
+}
+
+// Deletes the bucket of the driver
+func (this *BoltBackend) Clean() error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(BoltBucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// Closes the database
+func (this *BoltBackend) Close() error {
+	return this.db.Close()
+}
@@ -2,84 +2,246 @@ package datastore
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"errors"
 	"sync"
+	"time"
+
+	"phocs/vde_plug_docker/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// holds the path for the datastore and a mutex
-type DataStore struct {
-	sync.Mutex
-	Path string
+// Storage engine of the datastore, it persists the driver as a JSON document
+type Backend interface {
+	// Returns the stored JSON document, nil if the datastore is empty
+	Read() ([]byte, error)
+
+	// Replaces the stored JSON document with doc, backends shared by many daemons only write the
+	// entries changed since the document last read or written and fail with ErrConflict when
+	// another daemon changed them first
+	Write(doc []byte) error
+
+	// Replaces the stored JSON document with doc, the entries written by the other daemons included
+	Replace(doc []byte) error
+
+	// Empties the datastore
+	Clean() error
+
+	// Releases the resources held by the backend
+	Close() error
+}
+
+// Backend shared by many daemons, the entries the other daemons may change are read again before changing them
+type SharedBackend interface {
+	Backend
+
+	// Reads again the entries of a map field of the document and returns its JSON object,
+	// the next writes of these entries are checked against the ones read
+	ReadField(field string) ([]byte, error)
 }
 
-const OpenMode = 0644
+// returned by the writes of a shared backend when another daemon changed the same entries first
+var ErrConflict = errors.New("datastore: entries changed by another daemon")
 
-// initial value for the datastore struct
-var store = DataStore{
-	Path: "./datastore.json",
+// metrics of the datastore writes
+var (
+	WriteDuration = metrics.NewHistogramVec("vde_datastore_write_duration_seconds", "Latency of the datastore writes.", "operation")
+	WriteErrors   = metrics.NewCounterVec("vde_datastore_write_errors_total", "Datastore writes that failed.", "operation")
+)
+
+// holds the backend of the datastore and a mutex
+type DataStore struct {
+	sync.Mutex
+	backend Backend
 }
 
-// Sets a new path for the datastore file
-func SetPath(path string) {
-	store.Path = path
+// Returns a datastore persisting its data through the given backend
+func New(backend Backend) *DataStore {
+	return &DataStore{backend: backend}
 }
 
-// Empties datastore file
-func Clean() {
+// Empties datastore
+func (this *DataStore) Clean() {
 	// lock datastore mutex
-	store.Lock()
+	this.Lock()
 
 	// unlock datasotre mutex when function ends
-	defer store.Unlock()
+	defer this.Unlock()
 
-	// empties out datastore file writing nil
-	if err := ioutil.WriteFile(store.Path, nil, OpenMode); err != nil {
+	if err := this.backend.Clean(); err != nil {
 		log.Warnf("Datastore.Clean: [ %s ]", err)
 	}
 }
 
-// Loads the networks in datastore file in the provided driver
+// Loads the networks in datastore in the provided driver, older documents are migrated to SchemaVersion
 // elem: Driver onto which the networks must be stored
-func Load(elem interface{}) error {
-	var err error
-
+func (this *DataStore) Load(elem interface{}) error {
 	// lock datastore mutex
-	store.Lock()
+	this.Lock()
 
 	// unlock datastore mutex when function ends
-	defer store.Unlock()
-
-	// read datastore file
-	if buf, err := ioutil.ReadFile(store.Path); err == nil {
+	defer this.Unlock()
 
-		// since datastore file has JSON format, unmarshal it and stores it the Driver
-		return json.Unmarshal(buf, &elem)
-	} else {
+	// read and upgrade the datastore document
+	doc, _, err := this.read()
+	if err != nil {
 		log.Warnf("Datastore.Load: [ %s ]", err)
+		return err
 	}
-	return err
+
+	// since datastore has JSON format, unmarshal it and stores it the Driver
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &elem)
 }
 
 // Stores the network information from the Driver in the datastore
-func Store(elem interface{}) error {
+func (this *DataStore) Store(elem interface{}) error {
 	var err error
+	var buf []byte
 
-	// datastore has JSON format, so the driver struct get marshaled
-	if buf, err := json.Marshal(&elem); err == nil {
+	// datastore has JSON format, so the driver struct get marshaled along with the schema version
+	if buf, err = encode(elem); err == nil {
 
 		// lock the datastore
-		store.Lock()
+		this.Lock()
 
-		// write into datastore file
-		err = ioutil.WriteFile(store.Path, buf, OpenMode)
+		// write into datastore
+		start := time.Now()
+		err = this.backend.Write(buf)
+		WriteDuration.Observe("store", time.Since(start))
 
 		// unlock datastore
-		store.Unlock()
+		this.Unlock()
 	}
 	if err != nil {
+		WriteErrors.Inc("store")
 		log.Warnf("Datastore.Store: [ %s ]", err)
 	}
 	return err
 }
+
+// Upgrades the stored document to SchemaVersion in place, returns the version it had before
+func (this *DataStore) Migrate() (int, error) {
+	// lock datastore mutex
+	this.Lock()
+
+	// unlock datastore mutex when function ends
+	defer this.Unlock()
+
+	doc, version, err := this.read()
+	if err != nil || version == SchemaVersion {
+		return version, err
+	}
+
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return version, err
+	}
+	return version, this.backend.Write(buf)
+}
+
+// Returns the stored document upgraded to SchemaVersion, indented for humans
+func (this *DataStore) Dump() ([]byte, error) {
+	// lock datastore mutex
+	this.Lock()
+
+	// unlock datastore mutex when function ends
+	defer this.Unlock()
+
+	doc, _, err := this.read()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Replaces the stored document with buf, a document produced by Dump, possibly by an older plugin
+func (this *DataStore) Restore(buf []byte) error {
+	// lock datastore mutex
+	this.Lock()
+
+	// unlock datastore mutex when function ends
+	defer this.Unlock()
+
+	doc, err := decodeDocument(buf)
+	if err != nil {
+		return err
+	}
+
+	if _, err := migrate(doc); err != nil {
+		return err
+	}
+	if buf, err = json.Marshal(doc); err != nil {
+		return err
+	}
+
+	// the entries missing from buf are deleted, even the ones written by another daemon
+	return this.backend.Replace(buf)
+}
+
+// Reads again a map field of the driver (e.g. Pools) into elem when the backend is shared by many daemons,
+// so that the entries changed by the other daemons are merged before changing them.
+// Returns false, leaving elem untouched, if the backend is not shared: the daemon is its only writer
+func (this *DataStore) Reload(field string, elem interface{}) (bool, error) {
+	// lock datastore mutex
+	this.Lock()
+
+	// unlock datastore mutex when function ends
+	defer this.Unlock()
+
+	shared, ok := this.backend.(SharedBackend)
+	if !ok {
+		return false, nil
+	}
+	buf, err := shared.ReadField(field)
+	if err != nil {
+		return true, err
+	}
+	return true, json.Unmarshal(buf, elem)
+}
+
+// Reads the document from the backend and runs the migrations, returns the version read
+func (this *DataStore) read() (map[string]interface{}, int, error) {
+	buf, err := this.backend.Read()
+	if err == nil && buf == nil {
+		err = errors.New("empty datastore")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	doc, err := decodeDocument(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := migrate(doc)
+	return doc, version, err
+}
+
+// Marshals elem adding the schema version to the document
+func encode(elem interface{}) ([]byte, error) {
+	buf, err := json.Marshal(&elem)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+	doc[VersionKey], _ = json.Marshal(SchemaVersion)
+	return json.Marshal(doc)
+}
+
+// Closes the backend of the datastore
+func (this *DataStore) Close() error {
+	// lock datastore mutex
+	this.Lock()
+
+	// unlock datastore mutex when function ends
+	defer this.Unlock()
+
+	return this.backend.Close()
+}
@@ -0,0 +1,323 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// default prefix of the keys of the driver in the etcd keyspace
+const EtcdPrefixDefault = "/vde_plug_docker/"
+
+// etcd refuses transactions with more operations than --max-txn-ops, 128 by default
+const EtcdMaxTxnOps = 128
+
+// Backend storing every network and endpoint under its own key of an etcd v3 cluster, it speaks
+// the JSON gateway of the v3 API, so any server exposing /v3/kv can be used (e.g. an httptest server)
+//
+// Many daemons can share the same prefix: a write only touches the keys whose value changed since
+// the document last read or written by this backend, in a single transaction guarded by the revisions
+// the keys had back then. If another daemon changed one of them in the meantime the write fails with
+// ErrConflict, and the caller reads the keys again and merges its changes
+type EtcdBackend struct {
+	// base URL of the etcd server (e.g. http://127.0.0.1:2379)
+	Endpoint string
+
+	// prefix of every key written by the backend
+	Prefix string
+
+	client *http.Client
+
+	// keys of the last document read or written with their revisions, writes are diffed against it
+	synced map[string]etcdKeyValue
+}
+
+// key-value pair as encoded by the etcd JSON gateway, int64 fields are encoded as strings
+type etcdKeyValue struct {
+	Key         []byte `json:"key,omitempty"`
+	Value       []byte `json:"value,omitempty"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdRequestOp struct {
+	RequestPut         *etcdKeyValue     `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+// compares the modification revision of a key, 0 for a key that does not exist
+type etcdCompare struct {
+	Result      string `json:"result"`
+	Target      string `json:"target"`
+	Key         []byte `json:"key"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare,omitempty"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	Succeeded bool `json:"succeeded"`
+}
+
+// error reported by the gateway
+type etcdError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Returns a backend storing the datastore on the etcd server at endpoint, under prefix
+func NewEtcdBackend(endpoint, prefix string) *EtcdBackend {
+	if prefix == "" {
+		prefix = EtcdPrefixDefault
+	}
+	return &EtcdBackend{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Prefix:   prefix,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Reads every key under the prefix and rebuilds the driver document
+func (this *EtcdBackend) Read() ([]byte, error) {
+	current, err := this.rangeKeys(this.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	this.synced = current
+	return joinDocument(values(current))
+}
+
+// Reads again the keys of the entries of a map field of the document, the next writes of these keys are
+// guarded by the revisions read, and returns the JSON object of the field
+func (this *EtcdBackend) ReadField(field string) ([]byte, error) {
+	prefix := field + KeySeparator
+	current, err := this.rangeKeys(this.Prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	if this.synced == nil {
+		this.synced = make(map[string]etcdKeyValue)
+	}
+	for key := range this.synced {
+		if strings.HasPrefix(key, prefix) {
+			delete(this.synced, key)
+		}
+	}
+	for key, kv := range current {
+		this.synced[key] = kv
+	}
+
+	doc, err := joinDocument(values(current))
+	if err != nil || doc == nil {
+		return []byte("{}"), err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	return fields[field], nil
+}
+
+// Writes the keys that changed since the last document read or written and deletes the ones that
+// are gone from it, the keys of the other daemons sharing the prefix are left alone
+func (this *EtcdBackend) Write(doc []byte) error {
+	keys, err := splitDocument(doc)
+	if err != nil {
+		return err
+	}
+	if this.synced == nil {
+		this.synced = make(map[string]etcdKeyValue)
+	}
+
+	for {
+		changed := changedKeys(this.synced, keys)
+		if len(changed) == 0 {
+			return nil
+		}
+
+		// a write applied in part would leave a document no daemon ever wrote
+		if len(changed) > EtcdMaxTxnOps {
+			return errors.New("etcd: " + strconv.Itoa(len(changed)) + " changed keys do not fit in a transaction of " + strconv.Itoa(EtcdMaxTxnOps) + " operations")
+		}
+		done, err := this.commit(keys, changed)
+		if done || err != nil {
+			return err
+		}
+
+		// another daemon may have already written the same values, only a different value is a conflict
+		if adopted, err := this.adoptSame(keys, changed); err != nil || !adopted {
+			if err == nil {
+				err = ErrConflict
+			}
+			return err
+		}
+		log.Debugf("EtcdBackend.Write: [ keys already written by another daemon, retrying ]")
+	}
+}
+
+// Replaces every key under the prefix with the keys of doc, the keys written by the other daemons included
+func (this *EtcdBackend) Replace(doc []byte) error {
+	current, err := this.rangeKeys(this.Prefix)
+	if err != nil {
+		return err
+	}
+	this.synced = current
+	return this.Write(doc)
+}
+
+// Puts and deletes the changed keys in a transaction guarded by their synced revisions,
+// returns false if another daemon changed one of them
+func (this *EtcdBackend) commit(keys map[string][]byte, changed []string) (bool, error) {
+	txn := etcdTxnRequest{Success: []etcdRequestOp{}}
+	for _, key := range changed {
+		op := etcdRequestOp{RequestPut: &etcdKeyValue{Key: []byte(this.Prefix + key), Value: keys[key]}}
+		if _, keep := keys[key]; !keep {
+			op = etcdRequestOp{RequestDeleteRange: &etcdRangeRequest{Key: []byte(this.Prefix + key)}}
+		}
+		// a key never seen has revision 0, it must not exist
+		txn.Compare = append(txn.Compare, etcdCompare{Result: "EQUAL", Target: "MOD", Key: []byte(this.Prefix + key), ModRevision: this.synced[key].ModRevision})
+		txn.Success = append(txn.Success, op)
+	}
+
+	var response etcdTxnResponse
+	if err := this.call("/v3/kv/txn", txn, &response); err != nil || !response.Succeeded {
+		return false, err
+	}
+
+	// the keys put by the transaction have its revision
+	for _, key := range changed {
+		if value, keep := keys[key]; keep {
+			this.synced[key] = etcdKeyValue{Value: value, ModRevision: response.Header.Revision}
+		} else {
+			delete(this.synced, key)
+		}
+	}
+	return true, nil
+}
+
+// Syncs the changed keys that another daemon set to the same value, returns false if one of them
+// was changed to a different value or if none was found, the write then lost a real race
+func (this *EtcdBackend) adoptSame(keys map[string][]byte, changed []string) (bool, error) {
+	current, err := this.rangeKeys(this.Prefix)
+	if err != nil {
+		return false, err
+	}
+	adopted := false
+	for _, key := range changed {
+		kv, exists := current[key]
+		if kv.ModRevision == this.synced[key].ModRevision {
+			continue
+		}
+		value, keep := keys[key]
+		if keep != exists || !bytes.Equal(kv.Value, value) {
+			return false, nil
+		}
+		if exists {
+			this.synced[key] = kv
+		} else {
+			delete(this.synced, key)
+		}
+		adopted = true
+	}
+	return adopted, nil
+}
+
+// Deletes every key under the prefix
+func (this *EtcdBackend) Clean() error {
+	this.synced = nil
+	return this.call("/v3/kv/deleterange", etcdRangeRequest{Key: []byte(this.Prefix), RangeEnd: []byte(prefixEnd(this.Prefix))}, nil)
+}
+
+// Nothing to release, connections are handled by the http client
+func (this *EtcdBackend) Close() error {
+	this.client.CloseIdleConnections()
+	return nil
+}
+
+// Returns the keys starting with prefix, with the prefix of the backend removed
+func (this *EtcdBackend) rangeKeys(prefix string) (map[string]etcdKeyValue, error) {
+	var response etcdRangeResponse
+	request := etcdRangeRequest{Key: []byte(prefix), RangeEnd: []byte(prefixEnd(prefix))}
+	if err := this.call("/v3/kv/range", request, &response); err != nil {
+		return nil, err
+	}
+	kvs := make(map[string]etcdKeyValue)
+	for _, kv := range response.Kvs {
+		kvs[strings.TrimPrefix(string(kv.Key), this.Prefix)] = kv
+	}
+	return kvs, nil
+}
+
+// Returns the values of the keys
+func values(kvs map[string]etcdKeyValue) map[string][]byte {
+	keys := make(map[string][]byte)
+	for key, kv := range kvs {
+		keys[key] = kv.Value
+	}
+	return keys
+}
+
+// Returns the sorted keys added, changed or removed going from the synced keys to the new ones
+func changedKeys(synced map[string]etcdKeyValue, keys map[string][]byte) []string {
+	var changed []string
+	for key, value := range keys {
+		if kv, ok := synced[key]; !ok || !bytes.Equal(kv.Value, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range synced {
+		if _, ok := keys[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Posts request to the given path of the gateway and decodes the reply in response
+func (this *EtcdBackend) call(path string, request interface{}, response interface{}) error {
+	// []byte fields are encoded in base64, as the gateway expects
+	buf, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	reply, err := this.client.Post(this.Endpoint+path, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer reply.Body.Close()
+
+	if reply.StatusCode != http.StatusOK {
+		var gwerr etcdError
+		json.NewDecoder(reply.Body).Decode(&gwerr)
+		if gwerr.Message == "" {
+			gwerr.Message = gwerr.Error
+		}
+		return errors.New("etcd " + path + ": " + reply.Status + " " + gwerr.Message)
+	}
+	if response != nil {
+		return json.NewDecoder(reply.Body).Decode(response)
+	}
+	return nil
+}
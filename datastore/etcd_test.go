@@ -0,0 +1,431 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// in-process stand-in of the etcd v3 JSON gateway, it decodes the wire format on its own
+// (base64 keys, int64 revisions as strings) so that encoding mistakes of the backend show up
+type fakeEtcd struct {
+	sync.Mutex
+	revision int64
+	kvs      map[string]fakeKeyValue
+
+	// operations of every transaction received
+	txns []int
+
+	// called before a transaction is applied, with the lock held
+	beforeTxn func()
+}
+
+type fakeKeyValue struct {
+	value    []byte
+	revision int64
+}
+
+type fakeRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type fakeTxn struct {
+	Compare []struct {
+		Result      string `json:"result"`
+		Target      string `json:"target"`
+		Key         []byte `json:"key"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"compare"`
+	Success []struct {
+		RequestPut *struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"request_put"`
+		RequestDeleteRange *fakeRange `json:"request_delete_range"`
+	} `json:"success"`
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *httptest.Server) {
+	etcd := &fakeEtcd{kvs: make(map[string]fakeKeyValue)}
+	server := httptest.NewServer(etcd)
+	t.Cleanup(server.Close)
+	return etcd, server
+}
+
+func (this *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.Lock()
+	defer this.Unlock()
+
+	var reply interface{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var request fakeRange
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		kvs := []map[string]interface{}{}
+		for key, kv := range this.kvs {
+			if inRange(key, request) {
+				kvs = append(kvs, map[string]interface{}{"key": []byte(key), "value": kv.value, "mod_revision": strconv.FormatInt(kv.revision, 10)})
+			}
+		}
+		reply = map[string]interface{}{"kvs": kvs}
+
+	case "/v3/kv/deleterange":
+		var request fakeRange
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		this.deleteRange(request)
+		reply = map[string]interface{}{}
+
+	case "/v3/kv/txn":
+		var request fakeTxn
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(request.Compare) > EtcdMaxTxnOps || len(request.Success) > EtcdMaxTxnOps {
+			http.Error(w, `{"error":"etcdserver: too many operations in txn request"}`, http.StatusBadRequest)
+			return
+		}
+		this.txns = append(this.txns, len(request.Success))
+		if this.beforeTxn != nil {
+			this.beforeTxn()
+		}
+
+		// a missing key has revision 0
+		for _, compare := range request.Compare {
+			revision, _ := strconv.ParseInt(compare.ModRevision, 10, 64)
+			if compare.Result != "EQUAL" || compare.Target != "MOD" {
+				http.Error(w, "unsupported compare", http.StatusBadRequest)
+				return
+			}
+			if this.kvs[string(compare.Key)].revision != revision {
+				json.NewEncoder(w).Encode(map[string]interface{}{"header": this.header()})
+				return
+			}
+		}
+		this.revision++
+		for _, op := range request.Success {
+			if op.RequestPut != nil {
+				this.kvs[string(op.RequestPut.Key)] = fakeKeyValue{value: op.RequestPut.Value, revision: this.revision}
+			}
+			if op.RequestDeleteRange != nil {
+				this.deleteRange(*op.RequestDeleteRange)
+			}
+		}
+		reply = map[string]interface{}{"header": this.header(), "succeeded": true}
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (this *fakeEtcd) header() map[string]interface{} {
+	return map[string]interface{}{"revision": strconv.FormatInt(this.revision, 10)}
+}
+
+// writes key as another daemon would
+func (this *fakeEtcd) put(key string, value string) {
+	this.revision++
+	this.kvs[key] = fakeKeyValue{value: []byte(value), revision: this.revision}
+}
+
+func (this *fakeEtcd) keys() []string {
+	this.Lock()
+	defer this.Unlock()
+	var keys []string
+	for key := range this.kvs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (this *fakeEtcd) deleteRange(request fakeRange) {
+	for key := range this.kvs {
+		if inRange(key, request) {
+			delete(this.kvs, key)
+		}
+	}
+}
+
+func inRange(key string, request fakeRange) bool {
+	if len(request.RangeEnd) == 0 {
+		return key == string(request.Key)
+	}
+	return key >= string(request.Key) && key < string(request.RangeEnd)
+}
+
+// decodes a document for comparisons that ignore the order of the fields
+func decodeJSON(t *testing.T, buf []byte) interface{} {
+	var doc interface{}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		t.Fatalf("invalid document %q: %s", buf, err)
+	}
+	return doc
+}
+
+func TestEtcdRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"fields", `{"Version":3,"Scope":"local"}`},
+		{"network without endpoints", `{"Networks":{"n1":{"Sock":"vde:///tmp/sw","Endpoints":{}}}}`},
+		{"endpoints", `{"Networks":{"n1":{"Sock":"vxvde://","Endpoints":{"e1":{"IfName":"vde0"},"e2":{"IfName":"vde1"}}},"n2":{"Endpoints":{"e3":{}}}}}`},
+		{"escaped ids", `{"Pools":{"vde/10.0.0.0/24":{"Subnet":"10.0.0.0/24"}},"Allocations":{"a/b":"10.0.0.2"}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, server := newFakeEtcd(t)
+			if err := NewEtcdBackend(server.URL, "").Write([]byte(test.doc)); err != nil {
+				t.Fatal(err)
+			}
+			buf, err := NewEtcdBackend(server.URL, "").Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decodeJSON(t, buf), decodeJSON(t, []byte(test.doc)); !reflect.DeepEqual(got, want) {
+				t.Errorf("read %s, want %s", buf, test.doc)
+			}
+		})
+	}
+}
+
+func TestEtcdDeletes(t *testing.T) {
+	etcd, server := newFakeEtcd(t)
+	backend := NewEtcdBackend(server.URL, "/vde/")
+
+	steps := []struct {
+		doc  string
+		keys []string
+	}{
+		{
+			`{"Networks":{"n1":{"Endpoints":{"e1":{},"e2":{}}},"n2":{"Endpoints":{}}}}`,
+			[]string{"/vde/Networks/n1", "/vde/Networks/n1/Endpoints/e1", "/vde/Networks/n1/Endpoints/e2", "/vde/Networks/n2"},
+		},
+		{
+			`{"Networks":{"n1":{"Endpoints":{"e2":{}}}}}`,
+			[]string{"/vde/Networks/n1", "/vde/Networks/n1/Endpoints/e2"},
+		},
+		{
+			`{"Networks":{}}`,
+			nil,
+		},
+	}
+	for i, step := range steps {
+		if err := backend.Write([]byte(step.doc)); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+		if got := sortedKeys(etcd.keys()); !reflect.DeepEqual(got, step.keys) {
+			t.Errorf("step %d: keys %v, want %v", i, got, step.keys)
+		}
+	}
+
+	if err := backend.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := etcd.keys(); len(keys) != 0 {
+		t.Errorf("keys left after Clean: %v", keys)
+	}
+}
+
+// two daemons sharing the prefix must not delete the networks and endpoints of each other
+func TestEtcdSharedPrefix(t *testing.T) {
+	etcd, server := newFakeEtcd(t)
+	host1 := NewEtcdBackend(server.URL, "")
+	host2 := NewEtcdBackend(server.URL, "")
+	host1.Read()
+	host2.Read()
+
+	// both daemons join n1, each one with its endpoint, and create a network of their own
+	if err := host1.Write([]byte(`{"Networks":{"n1":{"Endpoints":{"e1":{}}},"a":{"Endpoints":{}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := host2.Write([]byte(`{"Networks":{"n1":{"Endpoints":{"e2":{}}},"b":{"Endpoints":{}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/vde_plug_docker/Networks/a", "/vde_plug_docker/Networks/b", "/vde_plug_docker/Networks/n1",
+		"/vde_plug_docker/Networks/n1/Endpoints/e1", "/vde_plug_docker/Networks/n1/Endpoints/e2"}
+	if got := sortedKeys(etcd.keys()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+
+	// host1 drops its endpoint and its network, host2 keeps everything it wrote
+	if err := host1.Write([]byte(`{"Networks":{"n1":{"Endpoints":{}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"/vde_plug_docker/Networks/b", "/vde_plug_docker/Networks/n1", "/vde_plug_docker/Networks/n1/Endpoints/e2"}
+	if got := sortedKeys(etcd.keys()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+
+	// a daemon that read the keys of the other one deletes them when they are gone from its document
+	host2.Read()
+	if err := host2.Write([]byte(`{"Networks":{"b":{"Endpoints":{}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"/vde_plug_docker/Networks/b"}
+	if got := sortedKeys(etcd.keys()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+}
+
+func TestEtcdWriteRace(t *testing.T) {
+	tests := []struct {
+		name string
+		// value written by another daemon between the read and the write, none if empty
+		other string
+		fails bool
+		want  string
+	}{
+		{"no race", "", false, `{"Endpoints":{}}`},
+		{"same value", `{"Endpoints":{}}`, false, `{"Endpoints":{}}`},
+		{"conflict", `{"Other":1}`, true, `{"Other":1}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			etcd, server := newFakeEtcd(t)
+			backend := NewEtcdBackend(server.URL, "")
+			if _, err := backend.Read(); err != nil {
+				t.Fatal(err)
+			}
+
+			etcd.beforeTxn = func() {
+				if test.other != "" && etcd.kvs["/vde_plug_docker/Networks/n1"].value == nil {
+					etcd.put("/vde_plug_docker/Networks/n1", test.other)
+				}
+			}
+			err := backend.Write([]byte(`{"Networks":{"n1":{"Endpoints":{}}}}`))
+			if test.fails != (err != nil) {
+				t.Fatalf("error %v, want failure %v", err, test.fails)
+			}
+			if test.fails && err != ErrConflict {
+				t.Errorf("error %v, want %v", err, ErrConflict)
+			}
+			if got := string(etcd.kvs["/vde_plug_docker/Networks/n1"].value); got != test.want {
+				t.Errorf("value %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// two daemons allocating from the same pool: the second write is refused until the allocation
+// of the first one is read again and merged, then both allocations are kept
+func TestEtcdConflictMerge(t *testing.T) {
+	etcd, server := newFakeEtcd(t)
+	host1 := NewEtcdBackend(server.URL, "")
+	host2 := NewEtcdBackend(server.URL, "")
+
+	if err := host1.Write([]byte(`{"Pools":{"p":{"Allocated":{}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := host2.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host1.Write([]byte(`{"Pools":{"p":{"Allocated":{"10.0.0.2":"a"}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := host2.Write([]byte(`{"Pools":{"p":{"Allocated":{"10.0.0.3":"b"}}}}`)); err != ErrConflict {
+		t.Fatalf("error %v, want %v", err, ErrConflict)
+	}
+
+	buf, err := host2.ReadField("Pools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decodeJSON(t, buf), decodeJSON(t, []byte(`{"p":{"Allocated":{"10.0.0.2":"a"}}}`)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("read %s", buf)
+	}
+	if err := host2.Write([]byte(`{"Pools":{"p":{"Allocated":{"10.0.0.2":"a","10.0.0.3":"b"}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(etcd.kvs["/vde_plug_docker/Pools/p"].value); got != `{"Allocated":{"10.0.0.2":"a","10.0.0.3":"b"}}` {
+		t.Errorf("value %s", got)
+	}
+
+	// host1 is now the one behind
+	if err := host1.Write([]byte(`{"Pools":{"p":{"Allocated":{}}}}`)); err != ErrConflict {
+		t.Errorf("error %v, want %v", err, ErrConflict)
+	}
+}
+
+// a write that does not fit in a transaction is refused, nothing is written
+func TestEtcdMaxTxnOps(t *testing.T) {
+	document := func(keys int) string {
+		// the network takes a key, the endpoints one each
+		endpoints := make([]string, keys-1)
+		for i := range endpoints {
+			endpoints[i] = fmt.Sprintf(`"e%d":{"IfName":"vde%d"}`, i, i)
+		}
+		return `{"Networks":{"n1":{"Endpoints":{` + strings.Join(endpoints, ",") + `}}}}`
+	}
+
+	etcd, server := newFakeEtcd(t)
+	backend := NewEtcdBackend(server.URL, "")
+	if err := backend.Write([]byte(document(EtcdMaxTxnOps + 1))); err == nil {
+		t.Fatal("wrote more keys than a transaction holds")
+	}
+	if keys := etcd.keys(); len(keys) != 0 || len(etcd.txns) != 0 {
+		t.Fatalf("%d keys written by %d transactions", len(keys), len(etcd.txns))
+	}
+
+	doc := document(EtcdMaxTxnOps)
+	if err := backend.Write([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := NewEtcdBackend(server.URL, "").Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodeJSON(t, buf), decodeJSON(t, []byte(doc))) {
+		t.Errorf("read back a different document")
+	}
+
+	// nothing changed, nothing written
+	etcd.txns = nil
+	if err := backend.Write([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	if len(etcd.txns) != 0 {
+		t.Errorf("%d transactions for an unchanged document", len(etcd.txns))
+	}
+}
+
+// a restore replaces the keys of every daemon sharing the prefix
+func TestEtcdReplace(t *testing.T) {
+	etcd, server := newFakeEtcd(t)
+	if err := NewEtcdBackend(server.URL, "").Write([]byte(`{"Networks":{"a":{"Endpoints":{"e1":{}}}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	doc := fmt.Sprintf(`{"Version":%d,"Networks":{"b":{"Endpoints":{}}}}`, SchemaVersion)
+	if err := New(NewEtcdBackend(server.URL, "")).Restore([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/vde_plug_docker/Networks/b", "/vde_plug_docker/Version"}
+	if got := sortedKeys(etcd.keys()); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys %v, want %v", got, want)
+	}
+}
+
+func sortedKeys(keys []string) []string {
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const OpenMode = 0644
+
+// suffixes of the temporary file used for atomic writes and of the copy of the last good datastore
+const (
+	TmpSuffix    = ".tmp"
+	BackupSuffix = ".bak"
+)
+
+// Backend storing the whole driver as a single JSON file
+type FileBackend struct {
+	Path string
+}
+
+// Returns a backend storing the datastore in the file at path
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{Path: path}
+}
+
+// Reads the datastore file, if it is corrupt the last good copy is read
+func (this *FileBackend) Read() ([]byte, error) {
+	var err error
+	var buf []byte
+
+	// read datastore file, then the backup if the datastore file is missing or truncated
+	for _, path := range []string{this.Path, this.Path + BackupSuffix} {
+		if buf, err = readFile(path); err == nil {
+			return buf, nil
+		}
+		log.Warnf("Datastore.Read: [ %s ]", err)
+	}
+	return nil, err
+}
+
+// Atomically replaces the datastore file
+func (this *FileBackend) Write(doc []byte) error {
+	return writeFile(this.Path, doc)
+}
+
+// The file is written by a single daemon, replacing it is writing it
+func (this *FileBackend) Replace(doc []byte) error {
+	return this.Write(doc)
+}
+
+// Empties datastore file
+func (this *FileBackend) Clean() error {
+	// the old data must not come back from the backup
+	if err := os.Remove(this.Path + BackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// empties out datastore file writing nil
+	return writeFile(this.Path, nil)
+}
+
+// Nothing to release
+func (this *FileBackend) Close() error {
+	return nil
+}
+
+// Reads the file at path and checks that it holds valid JSON
+func readFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf) {
+		return nil, errors.New(path + ": invalid JSON data")
+	}
+	return buf, nil
+}
+
+// Atomically replaces the file at path with buf: the data is written and synced to a temporary file,
+// the current file is kept as backup and then the temporary file is renamed over it
+func writeFile(path string, buf []byte) error {
+	tmp := path + TmpSuffix
+
+	// write the temporary file and flush it to the disk
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, OpenMode)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// the current file becomes the backup, only if it is valid
+	if _, err := readFile(path); err == nil {
+		os.Remove(path + BackupSuffix)
+		if err := os.Link(path, path+BackupSuffix); err != nil {
+			log.Warnf("Datastore.Backup: [ %s ]", err)
+		}
+	}
+
+	// rename is atomic, the datastore file is either the old or the new one
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// sync the directory to make the rename durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
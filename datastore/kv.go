@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// key-value backends store each entry of the driver maps under its own key:
+//
+//	Networks/<networkID>                        network without its endpoints
+//	Networks/<networkID>/Endpoints/<endpointID> endpoint of the network
+//	Pools/<poolID>                              entry of any other map of the driver
+//	<field>                                     any other field of the driver
+//
+// IDs are path escaped, so that IDs holding '/' (e.g. pool IDs) are kept in a single segment
+const (
+	KeySeparator = "/"
+	EndpointsKey = "Endpoints"
+)
+
+// Splits the JSON document of the driver in per-network and per-endpoint keys
+func splitDocument(doc []byte) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if doc == nil {
+		return keys, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+
+	for field, value := range fields {
+		// fields that are not maps are stored as they are
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(value, &entries) != nil {
+			keys[field] = value
+			continue
+		}
+
+		for id, entry := range entries {
+			key := field + KeySeparator + url.PathEscape(id)
+
+			// the endpoints of a network get a key each, the network keeps an empty map
+			var attrs map[string]json.RawMessage
+			if json.Unmarshal(entry, &attrs) == nil && attrs[EndpointsKey] != nil {
+				var endpoints map[string]json.RawMessage
+				if json.Unmarshal(attrs[EndpointsKey], &endpoints) == nil {
+					for epid, endpoint := range endpoints {
+						keys[key+KeySeparator+EndpointsKey+KeySeparator+url.PathEscape(epid)] = endpoint
+					}
+					attrs[EndpointsKey] = json.RawMessage("{}")
+					entry, _ = json.Marshal(attrs)
+				}
+			}
+			keys[key] = entry
+		}
+	}
+	return keys, nil
+}
+
+// Rebuilds the JSON document of the driver from the keys produced by splitDocument
+func joinDocument(keys map[string][]byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]interface{})
+	maps := make(map[string]map[string]json.RawMessage)
+	endpoints := make(map[string]map[string]json.RawMessage)
+
+	// entries are decoded first, endpoints are added once all the networks are known
+	for key, value := range keys {
+		parts := strings.Split(key, KeySeparator)
+		switch len(parts) {
+		case 1:
+			fields[parts[0]] = json.RawMessage(value)
+		case 2:
+			id, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			if maps[parts[0]] == nil {
+				maps[parts[0]] = make(map[string]json.RawMessage)
+			}
+			maps[parts[0]][id] = value
+		case 4:
+			epid, err := url.PathUnescape(parts[3])
+			if err != nil {
+				return nil, err
+			}
+			parent := parts[0] + KeySeparator + parts[1]
+			if endpoints[parent] == nil {
+				endpoints[parent] = make(map[string]json.RawMessage)
+			}
+			endpoints[parent][epid] = value
+		}
+	}
+
+	for parent, eps := range endpoints {
+		parts := strings.Split(parent, KeySeparator)
+		id, _ := url.PathUnescape(parts[1])
+
+		// endpoints whose network is gone are dropped
+		var attrs map[string]json.RawMessage
+		if json.Unmarshal(maps[parts[0]][id], &attrs) != nil || attrs == nil {
+			continue
+		}
+		buf, err := json.Marshal(eps)
+		if err != nil {
+			return nil, err
+		}
+		attrs[EndpointsKey] = buf
+		if maps[parts[0]][id], err = json.Marshal(attrs); err != nil {
+			return nil, err
+		}
+	}
+
+	for field, entries := range maps {
+		fields[field] = entries
+	}
+	return json.Marshal(fields)
+}
+
+// Returns the first key greater than every key starting with prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version of the documents written by the datastore, documents without version are version 0
+const SchemaVersion = 3
+
+// name of the field of the document holding its version
+const VersionKey = "Version"
+
+// upgrades a decoded document to the following version
+type migration func(doc map[string]interface{}) error
+
+// migrations[n] upgrades a document from version n to version n+1
+var migrations = []migration{
+	migrateV0,
+	migrateV1,
+	migrateV2,
+}
+
+// Runs the migrations needed to bring doc to SchemaVersion, returns the version doc had before
+func migrate(doc map[string]interface{}) (int, error) {
+	version := 0
+	if number, ok := doc[VersionKey].(json.Number); ok {
+		v, err := number.Int64()
+		if err != nil {
+			return 0, err
+		}
+		version = int(v)
+	}
+
+	// error if the document was written by a newer plugin
+	if version > SchemaVersion {
+		return version, fmt.Errorf("datastore version %d is newer than %d", version, SchemaVersion)
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		log.Infof("Datastore.Migrate: [ version %d to %d ]", v, v+1)
+		if err := migrations[v](doc); err != nil {
+			return version, fmt.Errorf("datastore migration %d to %d: %s", v, v+1, err)
+		}
+		doc[VersionKey] = v + 1
+	}
+	return version, nil
+}
+
+// Decodes a JSON document keeping numbers as they are, so that large values survive the migrations
+func decodeDocument(buf []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	return doc, nil
+}
+
+// Version 0 documents may hold null maps, which make the driver panic when they are written
+func migrateV0(doc map[string]interface{}) error {
+	for _, field := range []string{"Networks", "Pools", "Allocations"} {
+		if _, ok := doc[field].(map[string]interface{}); !ok {
+			doc[field] = make(map[string]interface{})
+		}
+	}
+	for _, nw := range doc["Networks"].(map[string]interface{}) {
+		if nw, ok := nw.(map[string]interface{}); ok {
+			if _, ok := nw["Endpoints"].(map[string]interface{}); !ok {
+				nw["Endpoints"] = make(map[string]interface{})
+			}
+		}
+	}
+	return nil
+}
+
+// Version 1 endpoints hold the Plugger handle of the C plug threads, plugs are now runtime only
+// and the endpoints joined to a sandbox are the ones with a SandboxKey
+func migrateV1(doc map[string]interface{}) error {
+	for _, nw := range doc["Networks"].(map[string]interface{}) {
+		nw, ok := nw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, ep := range nw["Endpoints"].(map[string]interface{}) {
+			ep, ok := ep.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// endpoints that left the sandbox kept their SandboxKey
+			if plugger, ok := ep["Plugger"].(json.Number); ok && plugger.String() == "0" {
+				ep["SandboxKey"] = ""
+			}
+			delete(ep, "Plugger")
+		}
+	}
+	return nil
+}
+
+// Version 2 managed networks were served by a vde_switch process, managed networks now
+// record the kind of their switch
+func migrateV2(doc map[string]interface{}) error {
+	for _, nw := range doc["Networks"].(map[string]interface{}) {
+		nw, ok := nw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if managed, _ := nw["Managed"].(bool); managed {
+			if kind, _ := nw["Switch"].(string); kind == "" {
+				nw["Switch"] = "vde_switch"
+			}
+		}
+	}
+	return nil
+}
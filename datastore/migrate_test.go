@@ -0,0 +1,183 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// IDs of the networks and endpoints of the fixtures
+const (
+	fixtureNetwork   = "Networks/4f2d1c0a9b8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a39281706f5e4"
+	fixtureSwitched  = "Networks/5e3e2d1b0a9f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a39281706f5"
+	fixtureManaged   = "Networks/6f4f3e2c1b0a9f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a39281706"
+	fixturePlugged   = fixtureNetwork + "/Endpoints/a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	fixtureUnplugged = fixtureNetwork + "/Endpoints/b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a1"
+)
+
+// every document of testdata/v<version>.json is upgraded to SchemaVersion, the leaves of the
+// fixture are kept unless listed in removed or changed, the paths in added are new
+func TestMigrateFixtures(t *testing.T) {
+	tests := []struct {
+		version int
+		removed []string
+		changed map[string]string
+		added   map[string]string
+	}{
+		{
+			version: 0,
+			removed: []string{fixturePlugged + "/Plugger", fixtureUnplugged + "/Plugger"},
+			changed: map[string]string{
+				fixtureUnplugged + "/SandboxKey": `""`,
+				fixtureSwitched + "/Endpoints":   `{}`,
+				"Pools":                          `{}`,
+			},
+			added: map[string]string{"Allocations": `{}`},
+		},
+		{
+			version: 1,
+			removed: []string{fixturePlugged + "/Plugger", fixtureUnplugged + "/Plugger"},
+			changed: map[string]string{fixtureUnplugged + "/SandboxKey": `""`},
+		},
+		{
+			version: 2,
+			added:   map[string]string{fixtureManaged + "/Switch": `"vde_switch"`},
+		},
+		{
+			version: SchemaVersion,
+		},
+	}
+	if len(tests) != SchemaVersion+1 {
+		t.Fatalf("%d fixtures for schema version %d, add testdata/v%d.json", len(tests), SchemaVersion, SchemaVersion)
+	}
+
+	for _, test := range tests {
+		t.Run("v"+strconv.Itoa(test.version), func(t *testing.T) {
+			buf, err := ioutil.ReadFile(filepath.Join("testdata", "v"+strconv.Itoa(test.version)+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixture, err := decodeDocument(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the migrations run on the read path of the datastore, the one of Load
+			path := filepath.Join(t.TempDir(), "vde.json")
+			if err := ioutil.WriteFile(path, buf, OpenMode); err != nil {
+				t.Fatal(err)
+			}
+			dump, err := New(NewFileBackend(path)).Dump()
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := decodeDocument(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, _ := doc[VersionKey].(json.Number).Int64(); version != SchemaVersion {
+				t.Errorf("loaded at version %d, want %d", version, SchemaVersion)
+			}
+
+			before, after := leaves(fixture), leaves(doc)
+			delete(before, VersionKey)
+			delete(after, VersionKey)
+			for _, path := range test.removed {
+				if _, ok := after[path]; ok {
+					t.Errorf("%s not removed", path)
+				}
+				delete(before, path)
+			}
+			for path, value := range test.changed {
+				checkLeaf(t, after, path, value)
+				delete(before, path)
+				delete(after, path)
+			}
+			for path, value := range test.added {
+				checkLeaf(t, after, path, value)
+				delete(after, path)
+			}
+			for path, value := range before {
+				if got, ok := after[path]; !ok {
+					t.Errorf("%s lost", path)
+				} else if !reflect.DeepEqual(got, value) {
+					t.Errorf("%s is %v, want %v", path, got, value)
+				}
+				delete(after, path)
+			}
+			for path, value := range after {
+				t.Errorf("%s = %v added", path, value)
+			}
+		})
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	doc := map[string]interface{}{VersionKey: json.Number(strconv.Itoa(SchemaVersion + 1))}
+	if _, err := migrate(doc); err == nil {
+		t.Error("migrated a document of a newer schema")
+	}
+}
+
+func TestMigrateInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vde.json")
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "v0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf, OpenMode); err != nil {
+		t.Fatal(err)
+	}
+
+	store := New(NewFileBackend(path))
+	for _, want := range []int{0, SchemaVersion} {
+		version, err := store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != want {
+			t.Errorf("Migrate returned version %d, want %d", version, want)
+		}
+	}
+}
+
+// Flattens doc to its leaves, keyed by their slash separated path, empty maps are leaves
+func leaves(doc map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if len(value) == 0 {
+				flat[path] = value
+			}
+			for key, child := range value {
+				walk(path+KeySeparator+key, child)
+			}
+		case []interface{}:
+			for i, child := range value {
+				walk(path+KeySeparator+strconv.Itoa(i), child)
+			}
+		default:
+			flat[path] = value
+		}
+	}
+	for key, value := range doc {
+		walk(key, value)
+	}
+	return flat
+}
+
+func checkLeaf(t *testing.T, flat map[string]interface{}, path string, want string) {
+	t.Helper()
+	got, err := json.Marshal(flat[path])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s is %s, want %s", path, got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Address leased to a peer, or offered to it until Expiry
+type Lease struct {
+	MAC      string    `json:"MAC"`
+	IP       string    `json:"IP"`
+	Hostname string    `json:"Hostname,omitempty"`
+	Expiry   time.Time `json:"Expiry"`
+}
+
+// Leases of a server, persisted in the datastore along with the network. The addresses reserved,
+// such as the ones docker assigned to the endpoints, are never leased
+type Leases struct {
+	mutex sync.Mutex
+
+	// key-value pairs where keys are the MAC addresses of the peers
+	leases map[string]*Lease
+
+	// addresses not leased, the values of declined are the times they can be leased again
+	reserved map[uint32]bool
+	declined map[uint32]time.Time
+}
+
+// Returns empty leases
+func NewLeases() *Leases {
+	return &Leases{
+		leases:   make(map[string]*Lease),
+		reserved: make(map[uint32]bool),
+		declined: make(map[uint32]time.Time),
+	}
+}
+
+// Leases are stored as a list ordered by address
+func (this *Leases) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.List())
+}
+
+func (this *Leases) UnmarshalJSON(buf []byte) error {
+	var list []Lease
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.leases == nil {
+		this.leases, this.reserved, this.declined = make(map[string]*Lease), make(map[uint32]bool), make(map[uint32]time.Time)
+	}
+	for i := range list {
+		this.leases[list[i].MAC] = &list[i]
+	}
+	return nil
+}
+
+// Returns the leases ordered by address
+func (this *Leases) List() []Lease {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	list := make([]Lease, 0, len(this.leases))
+	for _, lease := range this.leases {
+		list = append(list, *lease)
+	}
+	sort.Slice(list, func(i, j int) bool { return toUint32(net.ParseIP(list[i].IP)) < toUint32(net.ParseIP(list[j].IP)) })
+	return list
+}
+
+// Reserves an address, so that it is never leased. Returns the lease of the address dropped, if any
+func (this *Leases) Reserve(ip net.IP) *Lease {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.reserved[toUint32(ip)] = true
+	for mac, lease := range this.leases {
+		if net.ParseIP(lease.IP).Equal(ip) {
+			delete(this.leases, mac)
+			return lease
+		}
+	}
+	return nil
+}
+
+// Makes an address reserved available for lease
+func (this *Leases) Unreserve(ip net.IP) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.reserved, toUint32(ip))
+}
+
+// Returns the address to offer to mac: the one it holds, the one it requested if available
+// or the first available one of [first, last]. The address is held for mac until hold passes
+func (this *Leases) offer(mac net.HardwareAddr, requested, first, last net.IP, hold time.Duration) net.IP {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := time.Now()
+
+	var ip uint32
+	if lease := this.leases[mac.String()]; lease != nil && this.available(toUint32(net.ParseIP(lease.IP)), mac, first, last, now) {
+		ip = toUint32(net.ParseIP(lease.IP))
+	} else if requested != nil && this.available(toUint32(requested), mac, first, last, now) {
+		ip = toUint32(requested)
+	} else if ip = this.free(mac, first, last, now); ip == 0 {
+		return nil
+	}
+
+	// an offer does not shorten a lease
+	expiry := now.Add(hold)
+	if lease := this.leases[mac.String()]; lease != nil && toUint32(net.ParseIP(lease.IP)) == ip && lease.Expiry.After(expiry) {
+		expiry = lease.Expiry
+	}
+	this.leases[mac.String()] = &Lease{MAC: mac.String(), IP: fromUint32(ip).String(), Expiry: expiry}
+	return fromUint32(ip)
+}
+
+// Leases ip to mac for duration, returns false if ip is not available to mac
+func (this *Leases) ack(mac net.HardwareAddr, ip net.IP, hostname string, first, last net.IP, duration time.Duration) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if ip == nil || !this.available(toUint32(ip), mac, first, last, time.Now()) {
+		return false
+	}
+	this.leases[mac.String()] = &Lease{MAC: mac.String(), IP: ip.String(), Hostname: hostname, Expiry: time.Now().Add(duration)}
+	return true
+}
+
+// Ends the lease of ip to mac
+func (this *Leases) release(mac net.HardwareAddr, ip net.IP) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if lease := this.leases[mac.String()]; lease != nil && (ip == nil || net.ParseIP(lease.IP).Equal(ip)) {
+		delete(this.leases, mac.String())
+		return true
+	}
+	return false
+}
+
+// Ends the lease of ip to mac, the address is in use by another host and is not leased until hold passes
+func (this *Leases) decline(mac net.HardwareAddr, ip net.IP, hold time.Duration) bool {
+	released := this.release(mac, ip)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if ip != nil {
+		this.declined[toUint32(ip)] = time.Now().Add(hold)
+	}
+	return released
+}
+
+// Returns true if ip is in [first, last] and can be leased to mac
+func (this *Leases) available(ip uint32, mac net.HardwareAddr, first, last net.IP, now time.Time) bool {
+	if ip < toUint32(first) || ip > toUint32(last) || this.reserved[ip] || now.Before(this.declined[ip]) {
+		return false
+	}
+	for key, lease := range this.leases {
+		if key != mac.String() && toUint32(net.ParseIP(lease.IP)) == ip && now.Before(lease.Expiry) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the first address of [first, last] never leased, or else the one whose lease expired first, 0 if none is available
+func (this *Leases) free(mac net.HardwareAddr, first, last net.IP, now time.Time) uint32 {
+	leased := make(map[uint32]time.Time)
+	for _, lease := range this.leases {
+		leased[toUint32(net.ParseIP(lease.IP))] = lease.Expiry
+	}
+	var oldest uint32
+	for ip := toUint32(first); ip != 0 && ip <= toUint32(last); ip++ {
+		if !this.available(ip, mac, first, last, now) {
+			continue
+		}
+		expiry, ok := leased[ip]
+		if !ok {
+			return ip
+		}
+		if oldest == 0 || expiry.Before(leased[oldest]) {
+			oldest = ip
+		}
+	}
+	return oldest
+}
+
+// Returns the IPv4 address as a number, 0 if it is not IPv4
+func toUint32(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	return 0
+}
+
+func fromUint32(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,150 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	first  = net.IPv4(10, 20, 0, 10)
+	second = net.IPv4(10, 20, 0, 11)
+	last   = net.IPv4(10, 20, 0, 12)
+	macA   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+	macC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c}
+)
+
+func checkIP(t *testing.T, what string, got, want net.IP) {
+	t.Helper()
+	if (got == nil) != (want == nil) || !got.Equal(want) {
+		t.Errorf("%s: [ %s ], want [ %s ]", what, got, want)
+	}
+}
+
+func TestLeasesOffer(t *testing.T) {
+	leases := NewLeases()
+	leases.Reserve(first)
+
+	// the reserved address is skipped, the offer holds the address for the peer
+	checkIP(t, "offer to A", leases.offer(macA, nil, first, last, time.Minute), second)
+	checkIP(t, "offer to A again", leases.offer(macA, nil, first, last, time.Minute), second)
+	checkIP(t, "offer to B", leases.offer(macB, nil, first, last, time.Minute), last)
+
+	// the requested address is offered only when it is available
+	checkIP(t, "offer of the reserved address", leases.offer(macC, first, first, last, time.Minute), nil)
+	leases.Unreserve(first)
+	checkIP(t, "offer of the address held by A", leases.offer(macC, second, first, last, time.Minute), first)
+	checkIP(t, "offer out of the range", leases.offer(macA, net.IPv4(10, 20, 0, 20), first, last, time.Minute), second)
+
+	// a lease is not shortened by an offer
+	if !leases.ack(macA, second, "a", first, last, time.Hour) {
+		t.Fatal("ack of the offered address refused")
+	}
+	leases.offer(macA, nil, first, last, time.Minute)
+	if list := leases.List(); list[1].MAC != macA.String() || time.Until(list[1].Expiry) < 59*time.Minute {
+		t.Errorf("lease of A after an offer: %+v", list[1])
+	}
+
+	// a reserved address drops its lease
+	if lease := leases.Reserve(second); lease == nil || lease.MAC != macA.String() {
+		t.Errorf("reserve dropped %+v", lease)
+	}
+	if list := leases.List(); len(list) != 2 || list[0].MAC != macC.String() || list[1].MAC != macB.String() {
+		t.Errorf("leases %+v", list)
+	}
+}
+
+func TestLeasesAck(t *testing.T) {
+	leases := NewLeases()
+	leases.Reserve(first)
+
+	tests := []struct {
+		name  string
+		mac   net.HardwareAddr
+		ip    net.IP
+		acked bool
+	}{
+		{"reserved", macA, first, false},
+		{"out of the range", macA, net.IPv4(10, 20, 0, 13), false},
+		{"no address", macA, nil, false},
+		{"available", macA, second, true},
+		{"renewed", macA, second, true},
+		{"leased to another peer", macB, second, false},
+		{"other address", macB, last, true},
+	}
+	for _, test := range tests {
+		if acked := leases.ack(test.mac, test.ip, "", first, last, time.Hour); acked != test.acked {
+			t.Errorf("%s: ack of [ %s ] %v", test.name, test.ip, acked)
+		}
+	}
+}
+
+func TestLeasesDecline(t *testing.T) {
+	leases := NewLeases()
+	checkIP(t, "offer to A", leases.offer(macA, nil, first, last, time.Minute), first)
+	leases.ack(macA, first, "", first, last, time.Hour)
+
+	// the declined address is neither leased nor offered until the hold passes
+	if !leases.decline(macA, first, time.Hour) {
+		t.Error("the lease of A is not released")
+	}
+	if len(leases.List()) != 0 {
+		t.Errorf("leases %+v", leases.List())
+	}
+	checkIP(t, "offer to A after decline", leases.offer(macA, nil, first, last, time.Minute), second)
+	checkIP(t, "offer of the declined address", leases.offer(macB, first, first, last, time.Minute), last)
+	if leases.ack(macC, first, "", first, last, time.Hour) {
+		t.Error("declined address leased")
+	}
+	if leases.decline(macC, nil, time.Hour) {
+		t.Error("decline of C released a lease")
+	}
+
+	leases.mutex.Lock()
+	leases.declined[toUint32(first)] = time.Now().Add(-time.Second)
+	leases.mutex.Unlock()
+	checkIP(t, "offer after the hold", leases.offer(macC, first, first, last, time.Minute), first)
+}
+
+func TestLeasesExpired(t *testing.T) {
+	leases := NewLeases()
+	leases.ack(macA, first, "", first, last, -2*time.Minute)
+	leases.ack(macB, second, "", first, last, -time.Minute)
+	leases.ack(macC, last, "", first, last, time.Hour)
+
+	// the expired leases are reused, the one that expired first before
+	another := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0d}
+	checkIP(t, "offer after expiry", leases.offer(another, nil, first, last, time.Minute), first)
+	checkIP(t, "offer of an expired address", leases.offer(macA, second, first, last, time.Minute), second)
+	checkIP(t, "offer of a leased address", leases.offer(macB, last, first, last, time.Minute), nil)
+	if !leases.ack(macA, second, "", first, last, time.Hour) {
+		t.Error("ack of an expired address refused")
+	}
+
+	// the offers are held only for their timeout
+	leases = NewLeases()
+	leases.offer(macA, nil, first, first, -time.Second)
+	checkIP(t, "offer after the offer timeout", leases.offer(macB, nil, first, first, time.Minute), first)
+}
+
+func TestLeasesJSON(t *testing.T) {
+	leases := NewLeases()
+	leases.ack(macB, last, "b", first, last, time.Hour)
+	leases.ack(macA, first, "a", first, last, time.Hour)
+	buf, err := json.Marshal(leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewLeases()
+	if err := json.Unmarshal(buf, loaded); err != nil {
+		t.Fatal(err)
+	}
+	list := loaded.List()
+	if len(list) != 2 || list[0].MAC != macA.String() || list[0].Hostname != "a" || list[1].IP != last.String() {
+		t.Errorf("leases %+v", list)
+	}
+	checkIP(t, "offer of a loaded lease", loaded.offer(macA, nil, first, last, time.Minute), first)
+}
@@ -0,0 +1,200 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// BOOTP operations
+const (
+	opRequest = 1
+	opReply   = 2
+)
+
+// DHCP message types, option 53
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgDecline  = 4
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+	msgInform   = 8
+)
+
+// DHCP options used by the server
+const (
+	optPad         = 0
+	optSubnetMask  = 1
+	optRouter      = 3
+	optDNS         = 6
+	optHostname    = 12
+	optDomain      = 15
+	optMTU         = 26
+	optBroadcast   = 28
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optRenewalTime = 58
+	optRebindTime  = 59
+	optEnd         = 255
+)
+
+// layout of the BOOTP messages carrying DHCP
+const (
+	bootpHdrLen     = 236
+	bootpMinLen     = 300
+	magicCookieLen  = 4
+	hardwareAddrLen = 6
+
+	// set by the clients that can't receive unicast replies before they are configured
+	broadcastFlag = 0x8000
+)
+
+// magic cookie in front of the DHCP options
+var magicCookie = []byte{99, 130, 83, 99}
+
+// DHCP message, the options are kept in the order they are added
+type message struct {
+	op     byte
+	xid    uint32
+	secs   uint16
+	flags  uint16
+	ciaddr net.IP
+	yiaddr net.IP
+	siaddr net.IP
+	giaddr net.IP
+	chaddr net.HardwareAddr
+
+	options map[byte][]byte
+	order   []byte
+}
+
+// Parses a DHCP message carried by UDP
+func parseMessage(buf []byte) (*message, error) {
+	if len(buf) < bootpHdrLen+magicCookieLen {
+		return nil, errors.New("short message")
+	}
+	if buf[1] != 1 || buf[2] != hardwareAddrLen {
+		return nil, errors.New("not ethernet")
+	}
+	if string(buf[bootpHdrLen:bootpHdrLen+magicCookieLen]) != string(magicCookie) {
+		return nil, errors.New("no magic cookie")
+	}
+	this := &message{
+		op:      buf[0],
+		xid:     binary.BigEndian.Uint32(buf[4:]),
+		secs:    binary.BigEndian.Uint16(buf[8:]),
+		flags:   binary.BigEndian.Uint16(buf[10:]),
+		ciaddr:  net.IP(append([]byte(nil), buf[12:16]...)),
+		yiaddr:  net.IP(append([]byte(nil), buf[16:20]...)),
+		siaddr:  net.IP(append([]byte(nil), buf[20:24]...)),
+		giaddr:  net.IP(append([]byte(nil), buf[24:28]...)),
+		chaddr:  net.HardwareAddr(append([]byte(nil), buf[28:28+hardwareAddrLen]...)),
+		options: make(map[byte][]byte),
+	}
+	for opts := buf[bootpHdrLen+magicCookieLen:]; len(opts) > 0; {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, errors.New("truncated option")
+		}
+		// options split in several parts are concatenated, as in RFC 3396
+		end := 2 + int(opts[1])
+		this.options[code] = append(this.options[code], opts[2:end]...)
+		opts = opts[end:]
+	}
+	return this, nil
+}
+
+// Returns the type of the message, 0 if it is missing
+func (this *message) messageType() byte {
+	if value := this.options[optMessageType]; len(value) == 1 {
+		return value[0]
+	}
+	return 0
+}
+
+// Returns the IPv4 address held by an option, nil if it is missing
+func (this *message) ip(code byte) net.IP {
+	if value := this.options[code]; len(value) == net.IPv4len {
+		return net.IP(value)
+	}
+	return nil
+}
+
+// Sets an option of the message
+func (this *message) set(code byte, value []byte) {
+	if _, ok := this.options[code]; !ok {
+		this.order = append(this.order, code)
+	}
+	this.options[code] = value
+}
+
+// Returns the message in the wire format, padded to the minimum size of BOOTP
+func (this *message) marshal() []byte {
+	buf := make([]byte, bootpHdrLen, bootpMinLen)
+	buf[0] = this.op
+	buf[1] = 1
+	buf[2] = hardwareAddrLen
+	binary.BigEndian.PutUint32(buf[4:], this.xid)
+	binary.BigEndian.PutUint16(buf[8:], this.secs)
+	binary.BigEndian.PutUint16(buf[10:], this.flags)
+	for i, ip := range []net.IP{this.ciaddr, this.yiaddr, this.siaddr, this.giaddr} {
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(buf[12+4*i:], ip4)
+		}
+	}
+	copy(buf[28:], this.chaddr)
+	buf = append(buf, magicCookie...)
+
+	for _, code := range this.order {
+		// long options are split in several parts
+		for value := this.options[code]; ; {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			buf = append(buf, code, byte(n))
+			buf = append(buf, value[:n]...)
+			if value = value[n:]; len(value) == 0 {
+				break
+			}
+		}
+	}
+	buf = append(buf, optEnd)
+	for len(buf) < bootpMinLen {
+		buf = append(buf, optPad)
+	}
+	return buf
+}
+
+// Returns the addresses as the value of an option
+func ipsOption(ips ...net.IP) []byte {
+	var value []byte
+	for _, ip := range ips {
+		value = append(value, ip.To4()...)
+	}
+	return value
+}
+
+func uint32Option(n uint32) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, n)
+	return value
+}
+
+func uint16Option(n uint16) []byte {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, n)
+	return value
+}
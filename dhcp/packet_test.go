@@ -0,0 +1,83 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// message of a peer, as sent by a DHCP client
+func clientMessage(kind byte, mac net.HardwareAddr, xid uint32) *message {
+	this := &message{
+		op:      opRequest,
+		xid:     xid,
+		ciaddr:  net.IPv4zero,
+		yiaddr:  net.IPv4zero,
+		siaddr:  net.IPv4zero,
+		giaddr:  net.IPv4zero,
+		chaddr:  mac,
+		options: make(map[byte][]byte),
+	}
+	this.set(optMessageType, []byte{kind})
+	return this
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	discover := clientMessage(msgDiscover, macA, 0x12345678)
+	discover.flags = broadcastFlag
+	discover.set(optRequestedIP, ipsOption(second))
+	discover.set(optHostname, []byte("guest"))
+
+	request := clientMessage(msgRequest, macB, 0xcafe)
+	request.secs = 3
+	request.ciaddr = last
+	request.set(optServerID, ipsOption(first))
+	// longer than an option, it is split in parts
+	request.set(optDomain, bytes.Repeat([]byte("d"), 300))
+
+	for _, sent := range []*message{discover, request} {
+		buf := sent.marshal()
+		if len(buf) < bootpMinLen {
+			t.Errorf("message %d of %d bytes", sent.messageType(), len(buf))
+		}
+		received, err := parseMessage(buf)
+		if err != nil {
+			t.Fatalf("message %d: %s", sent.messageType(), err)
+		}
+		if received.op != sent.op || received.xid != sent.xid || received.secs != sent.secs || received.flags != sent.flags ||
+			!received.ciaddr.Equal(sent.ciaddr) || !received.yiaddr.Equal(sent.yiaddr) || !bytes.Equal(received.chaddr, sent.chaddr) {
+			t.Errorf("message %d: received %+v, sent %+v", sent.messageType(), received, sent)
+		}
+		if received.messageType() != sent.messageType() || len(received.options) != len(sent.options) {
+			t.Errorf("message %d: options %v", sent.messageType(), received.options)
+		}
+		for code, value := range sent.options {
+			if !bytes.Equal(received.options[code], value) {
+				t.Errorf("message %d: option %d %x, sent %x", sent.messageType(), code, received.options[code], value)
+			}
+		}
+	}
+	checkIP(t, "requested address", discover.ip(optRequestedIP), second)
+	checkIP(t, "missing option", discover.ip(optServerID), nil)
+}
+
+func TestMessageErrors(t *testing.T) {
+	valid := clientMessage(msgDiscover, macA, 1).marshal()
+	corrupt := func(change func(buf []byte) []byte) []byte {
+		return change(append([]byte(nil), valid...))
+	}
+	tests := map[string][]byte{
+		"short":           valid[:bootpHdrLen+magicCookieLen-1],
+		"not ethernet":    corrupt(func(buf []byte) []byte { buf[1] = 6; return buf }),
+		"address length":  corrupt(func(buf []byte) []byte { buf[2] = 8; return buf }),
+		"no magic cookie": corrupt(func(buf []byte) []byte { buf[bootpHdrLen] = 0; return buf }),
+		"truncated option": corrupt(func(buf []byte) []byte {
+			return append(buf[:bootpHdrLen+magicCookieLen], optHostname, 10, 'a')
+		}),
+	}
+	for name, buf := range tests {
+		if _, err := parseMessage(buf); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// DHCPv4 server of the peers outside docker attached to a VDE network, such as qemu guests.
+// It speaks ethernet frames on a plug of the network, answering DHCP and the ARP requests for its own address
+package dhcp
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"phocs/vde_plug_docker/ether"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// time an offered address is held for the peer, and a declined address is not leased
+const (
+	OfferTimeout   = time.Minute
+	DeclineTimeout = 10 * time.Minute
+)
+
+// default duration of the leases
+const LeaseTimeDefault = time.Hour
+
+// UDP ports of DHCP
+const (
+	serverPort = 67
+	clientPort = 68
+)
+
+// Configuration of a server
+type Config struct {
+	// address and MAC address of the server on the network
+	IP  net.IP
+	MAC net.HardwareAddr
+
+	// subnet of the network and range of the leased addresses
+	Mask        net.IPMask
+	First, Last net.IP
+
+	// optional router, DNS servers, domain and MTU sent to the peers
+	Router net.IP
+	DNS    []net.IP
+	Domain string
+	MTU    int
+
+	// duration of the leases
+	LeaseTime time.Duration
+}
+
+// DHCP server
+type Server struct {
+	config Config
+	frames io.ReadWriteCloser
+	leases *Leases
+
+	// called when the leases change, so that they are persisted
+	changed func()
+}
+
+// Starts a server answering on frames, a socket carrying one ethernet frame per read and write.
+// The server stops when frames is closed
+func Start(config Config, frames io.ReadWriteCloser, leases *Leases, changed func()) *Server {
+	if config.LeaseTime == 0 {
+		config.LeaseTime = LeaseTimeDefault
+	}
+	this := &Server{config: config, frames: frames, leases: leases, changed: changed}
+	leases.Reserve(config.IP)
+	go this.serve()
+	log.Infof("DHCP server started: [ %s ] leasing [ %s - %s ]", config.IP, config.First, config.Last)
+	return this
+}
+
+// Stops the server
+func (this *Server) Close() error {
+	return this.frames.Close()
+}
+
+// Answers the frames until the socket is closed
+func (this *Server) serve() {
+	buf := make([]byte, ether.FrameBufLen)
+	for {
+		n, err := this.frames.Read(buf)
+		if err != nil || n == 0 {
+			log.Debugf("DHCP server [ %s ] stopped: [ %v ]", this.config.IP, err)
+			return
+		}
+		header, payload, ok := ether.Parse(buf[:n])
+		if !ok {
+			continue
+		}
+		switch header.Type {
+		case ether.TypeARP:
+			this.arp(payload)
+		case ether.TypeIPv4:
+			this.ipv4(payload)
+		}
+	}
+}
+
+// Answers the ARP requests for the address of the server
+func (this *Server) arp(pkt []byte) {
+	if sha, spa, ok := ether.ParseARPRequest(pkt, this.config.IP); ok {
+		this.send(sha, ether.TypeARP, ether.ARPReplyTo(sha, spa, this.config.MAC, this.config.IP))
+	}
+}
+
+// Answers the DHCP messages sent to the server port
+func (this *Server) ipv4(pkt []byte) {
+	udp, ok := ether.ParseUDP(pkt)
+	if !ok || udp.DstPort != serverPort {
+		return
+	}
+	request, err := parseMessage(udp.Payload)
+	if err != nil || request.op != opRequest {
+		return
+	}
+
+	// relayed requests are not served
+	if !request.giaddr.IsUnspecified() {
+		return
+	}
+	this.handle(request)
+}
+
+// Answers a DHCP request
+func (this *Server) handle(request *message) {
+	mac := request.chaddr
+	log.Debugf("DHCP [ %s ] message %d from [ %s ]", this.config.IP, request.messageType(), mac)
+
+	switch request.messageType() {
+	case msgDiscover:
+		ip := this.leases.offer(mac, request.ip(optRequestedIP), this.config.First, this.config.Last, OfferTimeout)
+		if ip == nil {
+			log.Warnf("DHCP [ %s ]: no address available for [ %s ]", this.config.IP, mac)
+			return
+		}
+		this.reply(request, msgOffer, ip)
+
+	case msgRequest:
+		// the peer chose another server
+		if server := request.ip(optServerID); server != nil && !server.Equal(this.config.IP) {
+			this.leases.release(mac, nil)
+			return
+		}
+		// selecting or rebooting peers send the address in an option, renewing and rebinding ones in ciaddr
+		ip := request.ip(optRequestedIP)
+		if ip == nil {
+			ip = request.ciaddr
+		}
+		if !this.leases.ack(mac, ip, string(request.options[optHostname]), this.config.First, this.config.Last, this.config.LeaseTime) {
+			log.Infof("DHCP [ %s ]: refused [ %s ] to [ %s ]", this.config.IP, ip, mac)
+			this.reply(request, msgNak, nil)
+			return
+		}
+		log.Infof("DHCP [ %s ]: leased [ %s ] to [ %s ]", this.config.IP, ip, mac)
+		this.reply(request, msgAck, ip)
+		this.changed()
+
+	case msgRelease:
+		if this.leases.release(mac, request.ciaddr) {
+			log.Infof("DHCP [ %s ]: released [ %s ] by [ %s ]", this.config.IP, request.ciaddr, mac)
+			this.changed()
+		}
+
+	case msgDecline:
+		ip := request.ip(optRequestedIP)
+		log.Warnf("DHCP [ %s ]: [ %s ] declined by [ %s ], it is in use", this.config.IP, ip, mac)
+		if this.leases.decline(mac, ip, DeclineTimeout) {
+			this.changed()
+		}
+
+	case msgInform:
+		// the peer has an address already, it asks only for the options
+		this.reply(request, msgAck, nil)
+	}
+}
+
+// Sends a reply to the request, leasing ip
+func (this *Server) reply(request *message, kind byte, ip net.IP) {
+	reply := &message{
+		op:      opReply,
+		xid:     request.xid,
+		flags:   request.flags,
+		ciaddr:  request.ciaddr,
+		yiaddr:  ip,
+		chaddr:  request.chaddr,
+		options: make(map[byte][]byte),
+	}
+	reply.set(optMessageType, []byte{kind})
+	reply.set(optServerID, ipsOption(this.config.IP))
+
+	if kind != msgNak {
+		if ip != nil {
+			seconds := uint32(this.config.LeaseTime / time.Second)
+			reply.set(optLeaseTime, uint32Option(seconds))
+			reply.set(optRenewalTime, uint32Option(seconds/2))
+			reply.set(optRebindTime, uint32Option(seconds/8*7))
+		}
+		reply.set(optSubnetMask, []byte(this.config.Mask))
+		reply.set(optBroadcast, ipsOption(this.broadcast()))
+		if this.config.Router != nil {
+			reply.set(optRouter, ipsOption(this.config.Router))
+		}
+		if len(this.config.DNS) > 0 {
+			reply.set(optDNS, ipsOption(this.config.DNS...))
+		}
+		if this.config.Domain != "" {
+			reply.set(optDomain, []byte(this.config.Domain))
+		}
+		if this.config.MTU > 0 {
+			reply.set(optMTU, uint16Option(uint16(this.config.MTU)))
+		}
+	}
+
+	// as in RFC 2131: unicast to a configured peer, broadcast if the peer asks for it or for the naks,
+	// otherwise unicast to the address leased, the peer accepts it before its configuration
+	dstMAC, dstIP := request.chaddr, ip
+	switch {
+	case kind == msgNak || request.flags&broadcastFlag != 0:
+		dstMAC, dstIP = ether.Broadcast, net.IPv4bcast
+	case !request.ciaddr.IsUnspecified():
+		dstIP = request.ciaddr
+	case ip == nil:
+		dstMAC, dstIP = ether.Broadcast, net.IPv4bcast
+	}
+	udp := ether.UDP{SrcIP: this.config.IP, SrcPort: serverPort, DstIP: dstIP, DstPort: clientPort, Payload: reply.marshal()}
+	this.send(dstMAC, ether.TypeIPv4, udp.Marshal())
+}
+
+// Returns the broadcast address of the subnet
+func (this *Server) broadcast() net.IP {
+	ip := this.config.IP.To4()
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^this.config.Mask[i]
+	}
+	return broadcast
+}
+
+// Sends an ethernet frame from the server
+func (this *Server) send(dst net.HardwareAddr, ethType uint16, payload []byte) {
+	if _, err := this.frames.Write(ether.Frame(dst, this.config.MAC, ethType, payload)); err != nil {
+		log.Debugf("DHCP server [ %s ] send: [ %s ]", this.config.IP, err)
+	}
+}
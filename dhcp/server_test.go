@@ -0,0 +1,233 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"phocs/vde_plug_docker/ether"
+)
+
+var (
+	serverIP  = net.IPv4(10, 20, 0, 1)
+	serverMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x67}
+)
+
+// Starts a server leasing [first, last] on one end of a socketpair, the other end is returned as the network.
+// The address docker assigned to an endpoint is reserved, changed receives the changes of the leases
+func startTestServer(t *testing.T) (*Server, *os.File, chan struct{}) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		syscall.SetNonblock(fd, true)
+	}
+	frames, network := os.NewFile(uintptr(fds[0]), "server"), os.NewFile(uintptr(fds[1]), "network")
+
+	leases := NewLeases()
+	leases.Reserve(first)
+	changed := make(chan struct{}, 16)
+	config := Config{
+		IP: serverIP, MAC: serverMAC, Mask: net.CIDRMask(24, 32), First: first, Last: last,
+		Router: serverIP, DNS: []net.IP{serverIP}, Domain: "vde", MTU: 1400, LeaseTime: 10 * time.Minute,
+	}
+	server := Start(config, frames, leases, func() { changed <- struct{}{} })
+	t.Cleanup(func() {
+		server.Close()
+		network.Close()
+	})
+	return server, network, changed
+}
+
+// returns the next frame sent by the server, nil if none is sent in time
+func readFrame(t *testing.T, network *os.File, timeout time.Duration) []byte {
+	buf := make([]byte, ether.FrameBufLen)
+	network.SetReadDeadline(time.Now().Add(timeout))
+	n, err := network.Read(buf)
+	if err != nil {
+		if !os.IsTimeout(err) {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	return buf[:n]
+}
+
+// Broadcasts the message of a peer not configured yet
+func sendMessage(t *testing.T, network *os.File, request *message) {
+	udp := ether.UDP{SrcIP: net.IPv4zero, SrcPort: clientPort, DstIP: net.IPv4bcast, DstPort: serverPort, Payload: request.marshal()}
+	if _, err := network.Write(ether.Frame(ether.Broadcast, request.chaddr, ether.TypeIPv4, udp.Marshal())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the reply of the server, checking that it is sent to dstMAC and dstIP
+func readReply(t *testing.T, network *os.File, dstMAC net.HardwareAddr, dstIP net.IP) *message {
+	t.Helper()
+	frame := readFrame(t, network, time.Second)
+	if frame == nil {
+		t.Fatal("no reply")
+	}
+	header, payload, ok := ether.Parse(frame)
+	if !ok || !bytes.Equal(header.Dst, dstMAC) || !bytes.Equal(header.Src, serverMAC) || header.Type != ether.TypeIPv4 {
+		t.Fatalf("reply frame %x", frame)
+	}
+	udp, ok := ether.ParseUDP(payload)
+	if !ok || !udp.SrcIP.Equal(serverIP) || udp.SrcPort != serverPort || !udp.DstIP.Equal(dstIP) || udp.DstPort != clientPort {
+		t.Fatalf("reply datagram %+v", udp)
+	}
+	reply, err := parseMessage(udp.Payload)
+	if err != nil || reply.op != opReply {
+		t.Fatalf("reply %x: %v", udp.Payload, err)
+	}
+	checkIP(t, "server identifier", reply.ip(optServerID), serverIP)
+	return reply
+}
+
+func TestServerLease(t *testing.T) {
+	server, network, changed := startTestServer(t)
+
+	// the address reserved for docker is not offered, the offer is sent to the address offered
+	discover := clientMessage(msgDiscover, macA, 1)
+	discover.set(optRequestedIP, ipsOption(first))
+	sendMessage(t, network, discover)
+	offer := readReply(t, network, macA, second)
+	if offer.messageType() != msgOffer || offer.xid != 1 || !bytes.Equal(offer.chaddr, macA) {
+		t.Fatalf("offer %+v", offer)
+	}
+	checkIP(t, "offered address", offer.yiaddr, second)
+	checkIP(t, "subnet mask", net.IP(offer.options[optSubnetMask]), net.IP(net.CIDRMask(24, 32)))
+	checkIP(t, "broadcast", offer.ip(optBroadcast), net.IPv4(10, 20, 0, 255))
+	checkIP(t, "router", offer.ip(optRouter), serverIP)
+	checkIP(t, "DNS", offer.ip(optDNS), serverIP)
+	if string(offer.options[optDomain]) != "vde" || binary.BigEndian.Uint16(offer.options[optMTU]) != 1400 ||
+		binary.BigEndian.Uint32(offer.options[optLeaseTime]) != 600 || binary.BigEndian.Uint32(offer.options[optRenewalTime]) != 300 {
+		t.Errorf("offer options %v", offer.options)
+	}
+
+	// the address offered to A is not offered to B, B asks for a broadcast reply
+	discover = clientMessage(msgDiscover, macB, 2)
+	discover.flags = broadcastFlag
+	sendMessage(t, network, discover)
+	offer = readReply(t, network, ether.Broadcast, net.IPv4bcast)
+	checkIP(t, "address offered to B", offer.yiaddr, last)
+
+	// A takes the address offered
+	request := clientMessage(msgRequest, macA, 3)
+	request.set(optRequestedIP, ipsOption(second))
+	request.set(optServerID, ipsOption(serverIP))
+	request.set(optHostname, []byte("guest"))
+	sendMessage(t, network, request)
+	ack := readReply(t, network, macA, second)
+	if ack.messageType() != msgAck || ack.xid != 3 {
+		t.Fatalf("ack %+v", ack)
+	}
+	checkIP(t, "address leased", ack.yiaddr, second)
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("lease not persisted")
+	}
+	if list := server.leases.List(); len(list) != 2 || list[0].MAC != macA.String() || list[0].Hostname != "guest" {
+		t.Errorf("leases %+v", list)
+	}
+
+	// the address of A or the reserved one are refused to C with a broadcast nak
+	for _, ip := range []net.IP{second, first} {
+		request = clientMessage(msgRequest, macC, 4)
+		request.set(optRequestedIP, ipsOption(ip))
+		sendMessage(t, network, request)
+		if nak := readReply(t, network, ether.Broadcast, net.IPv4bcast); nak.messageType() != msgNak || !nak.yiaddr.IsUnspecified() {
+			t.Errorf("reply to the request of [ %s ]: %+v", ip, nak)
+		}
+	}
+
+	// A renews its lease from its address
+	request = clientMessage(msgRequest, macA, 5)
+	request.ciaddr = second
+	sendMessage(t, network, request)
+	if ack := readReply(t, network, macA, second); ack.messageType() != msgAck {
+		t.Errorf("renewal %+v", ack)
+	}
+	<-changed
+
+	// B chose another server, its offer is dropped
+	request = clientMessage(msgRequest, macB, 6)
+	request.set(optRequestedIP, ipsOption(last))
+	request.set(optServerID, ipsOption(net.IPv4(10, 20, 0, 2)))
+	sendMessage(t, network, request)
+	if frame := readFrame(t, network, 100*time.Millisecond); frame != nil {
+		t.Errorf("replied %x", frame)
+	}
+	if list := server.leases.List(); len(list) != 1 {
+		t.Errorf("leases %+v", list)
+	}
+}
+
+func TestServerDecline(t *testing.T) {
+	server, network, changed := startTestServer(t)
+
+	request := clientMessage(msgRequest, macA, 1)
+	request.set(optRequestedIP, ipsOption(second))
+	sendMessage(t, network, request)
+	readReply(t, network, macA, second)
+	<-changed
+
+	// the address is in use by another host, it is not offered again
+	decline := clientMessage(msgDecline, macA, 2)
+	decline.set(optRequestedIP, ipsOption(second))
+	sendMessage(t, network, decline)
+	if frame := readFrame(t, network, 100*time.Millisecond); frame != nil {
+		t.Errorf("replied to decline %x", frame)
+	}
+	<-changed
+	if list := server.leases.List(); len(list) != 0 {
+		t.Errorf("leases %+v", list)
+	}
+	discover := clientMessage(msgDiscover, macA, 3)
+	discover.set(optRequestedIP, ipsOption(second))
+	sendMessage(t, network, discover)
+	checkIP(t, "address offered after decline", readReply(t, network, macA, last).yiaddr, last)
+
+	// the other addresses are reserved, declined or offered to A
+	discover = clientMessage(msgDiscover, macB, 4)
+	discover.set(optRequestedIP, ipsOption(second))
+	sendMessage(t, network, discover)
+	if frame := readFrame(t, network, 100*time.Millisecond); frame != nil {
+		t.Errorf("offered %x", frame)
+	}
+}
+
+func TestServerIgnored(t *testing.T) {
+	_, network, _ := startTestServer(t)
+
+	relayed := clientMessage(msgDiscover, macA, 1)
+	relayed.giaddr = net.IPv4(10, 30, 0, 1)
+	reply := clientMessage(msgDiscover, macA, 2)
+	reply.op = opReply
+	for name, request := range map[string]*message{"relayed": relayed, "reply": reply} {
+		sendMessage(t, network, request)
+		if frame := readFrame(t, network, 100*time.Millisecond); frame != nil {
+			t.Errorf("%s: replied %x", name, frame)
+		}
+	}
+
+	// the server answers ARP for its own address only
+	for _, ip := range []net.IP{serverIP, second} {
+		request := ether.ARPReplyTo(nil, ip, macA, net.IPv4(10, 20, 0, 50))
+		binary.BigEndian.PutUint16(request[6:], ether.ARPRequest)
+		if _, err := network.Write(ether.Frame(ether.Broadcast, macA, ether.TypeARP, request)); err != nil {
+			t.Fatal(err)
+		}
+		frame := readFrame(t, network, 100*time.Millisecond)
+		want := ether.Frame(macA, serverMAC, ether.TypeARP, ether.ARPReplyTo(macA, net.IPv4(10, 20, 0, 50), serverMAC, serverIP))
+		if ip.Equal(serverIP) && !bytes.Equal(frame, want) || !ip.Equal(serverIP) && frame != nil {
+			t.Errorf("reply to the ARP request of [ %s ]: %x", ip, frame)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// record types and class answered
+const (
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+)
+
+// response codes
+const (
+	rcodeSuccess  = 0
+	rcodeFormat   = 1
+	rcodeNotFound = 3
+	rcodeNotImpl  = 4
+	rcodeRefused  = 5
+)
+
+// size of the DNS header and largest response sent over UDP without EDNS
+const (
+	headerLen = 12
+	maxUDPLen = 512
+)
+
+// DNS query, with its only question
+type query struct {
+	id    uint16
+	flags uint16
+	name  string
+	qtype uint16
+	class uint16
+
+	// question as received, echoed in the response
+	question []byte
+}
+
+// Parses a DNS query with one question
+func parseQuery(buf []byte) (*query, error) {
+	if len(buf) < headerLen {
+		return nil, errors.New("short message")
+	}
+	this := &query{id: binary.BigEndian.Uint16(buf), flags: binary.BigEndian.Uint16(buf[2:])}
+	if this.flags&0x8000 != 0 {
+		return nil, errors.New("not a query")
+	}
+	if binary.BigEndian.Uint16(buf[4:]) != 1 {
+		return this, errors.New("not one question")
+	}
+
+	// the name of the question is never compressed
+	var labels []string
+	i := headerLen
+	for {
+		if i >= len(buf) {
+			return this, errors.New("truncated name")
+		}
+		n := int(buf[i])
+		if n == 0 {
+			i++
+			break
+		}
+		if n&0xc0 != 0 || i+1+n > len(buf) {
+			return this, errors.New("bad name")
+		}
+		labels = append(labels, string(buf[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+4 > len(buf) {
+		return this, errors.New("truncated question")
+	}
+	this.name = strings.ToLower(strings.Join(labels, "."))
+	this.qtype = binary.BigEndian.Uint16(buf[i:])
+	this.class = binary.BigEndian.Uint16(buf[i+2:])
+	this.question = buf[headerLen : i+4]
+	return this, nil
+}
+
+// Returns the response to the query with the given code and the addresses of the answers,
+// the answers that don't fit in a UDP response are left out and the response is truncated
+func (this *query) response(rcode int, ttl uint32, addrs [][]byte) []byte {
+	buf := make([]byte, headerLen, maxUDPLen)
+	binary.BigEndian.PutUint16(buf, this.id)
+
+	// response, authoritative, the opcode and recursion desired of the query
+	flags := uint16(0x8000|0x0400) | this.flags&0x7900 | uint16(rcode)
+	if this.question == nil {
+		binary.BigEndian.PutUint16(buf[2:], flags)
+		return buf
+	}
+	binary.BigEndian.PutUint16(buf[4:], 1)
+	buf = append(buf, this.question...)
+
+	var answers uint16
+	for _, addr := range addrs {
+		if len(buf)+12+len(addr) > maxUDPLen {
+			flags |= 0x0200
+			break
+		}
+		// the name points to the question
+		buf = append(buf, 0xc0, headerLen)
+		buf = binary.BigEndian.AppendUint16(buf, this.qtype)
+		buf = binary.BigEndian.AppendUint16(buf, classIN)
+		buf = binary.BigEndian.AppendUint32(buf, ttl)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(addr)))
+		buf = append(buf, addr...)
+		answers++
+	}
+	binary.BigEndian.PutUint16(buf[2:], flags)
+	binary.BigEndian.PutUint16(buf[6:], answers)
+	return buf
+}
@@ -0,0 +1,362 @@
+// DNS responder of the containers of a VDE network across hosts. Every plugin attached to the network
+// runs a responder with the same address, it answers the containers of its host with the records
+// of every host, exchanged with announcements broadcast on the network
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"phocs/vde_plug_docker/ether"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ethertype of the announcements, reserved by IEEE 802 for local experiments, and magic in front of them
+const EthTypeAnnounce = 0x88b5
+
+var announceMagic = []byte("VDNS")
+
+// default interval of the announcements, the records announced expire after ExpiryIntervals
+const (
+	IntervalDefault = 10 * time.Second
+	ExpiryIntervals = 3
+)
+
+// UDP port of DNS and default MTU of the announcements
+const (
+	dnsPort    = 53
+	mtuDefault = 1500
+)
+
+// Name of a container and its addresses
+type Record struct {
+	Name string `json:"Name"`
+	IPv4 string `json:"IPv4,omitempty"`
+	IPv6 string `json:"IPv6,omitempty"`
+}
+
+// Records of a host, sent periodically and when they change
+type announcement struct {
+	// ID of the responder announcing
+	Host string `json:"Host"`
+
+	// seconds the records are valid
+	TTL int `json:"TTL"`
+
+	Records   []Record `json:"Records,omitempty"`
+	Withdrawn []Record `json:"Withdrawn,omitempty"`
+}
+
+// Configuration of a responder
+type Config struct {
+	// address of the responder, the same on every host, and MAC address of this responder
+	IP  net.IP
+	MAC net.HardwareAddr
+
+	// domain of the names, the names are answered with and without it
+	Domain string
+
+	// ID of this responder in the announcements, unique on the network
+	Host string
+
+	// interval of the announcements and MTU of the network
+	Interval time.Duration
+	MTU      int
+}
+
+// record announced by another host
+type remoteKey struct {
+	host   string
+	record Record
+}
+
+// DNS responder
+type Responder struct {
+	config Config
+	frames io.ReadWriteCloser
+
+	mutex sync.Mutex
+
+	// records of the containers of this host and MAC addresses of the hosts answered
+	local   []Record
+	clients map[string]bool
+
+	// records of the other hosts, the values are their expiry
+	remote map[remoteKey]time.Time
+
+	done chan struct{}
+	once sync.Once
+}
+
+// Starts a responder on frames, a socket carrying one ethernet frame per read and write.
+// The responder stops when it is closed
+func Start(config Config, frames io.ReadWriteCloser) *Responder {
+	if config.Interval == 0 {
+		config.Interval = IntervalDefault
+	}
+	if config.MTU == 0 {
+		config.MTU = mtuDefault
+	}
+	config.Domain = strings.ToLower(strings.Trim(config.Domain, "."))
+	this := &Responder{
+		config:  config,
+		frames:  frames,
+		clients: make(map[string]bool),
+		remote:  make(map[remoteKey]time.Time),
+		done:    make(chan struct{}),
+	}
+	go this.serve()
+	go this.announce()
+	log.Infof("DNS responder started: [ %s ] [ %s ]", config.IP, config.Host)
+	return this
+}
+
+// Stops the responder
+func (this *Responder) Close() error {
+	this.once.Do(func() { close(this.done) })
+	return this.frames.Close()
+}
+
+// Replaces the records of the containers of this host and the MAC addresses of the hosts answered,
+// the records are announced at once
+func (this *Responder) SetLocal(records []Record, clients []net.HardwareAddr) {
+	this.mutex.Lock()
+	current := make(map[Record]bool)
+	for _, record := range records {
+		current[record] = true
+	}
+	var withdrawn []Record
+	for _, record := range this.local {
+		if !current[record] {
+			withdrawn = append(withdrawn, record)
+		}
+	}
+	changed := len(withdrawn) != 0 || len(records) != len(this.local)
+	this.local = records
+	this.clients = make(map[string]bool)
+	for _, mac := range clients {
+		this.clients[mac.String()] = true
+	}
+	this.mutex.Unlock()
+
+	if changed {
+		this.send(records, withdrawn)
+	}
+}
+
+// Returns the records of every host, ordered by name
+func (this *Responder) Records() []Record {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	seen := make(map[Record]bool)
+	records := append([]Record(nil), this.local...)
+	for _, record := range records {
+		seen[record] = true
+	}
+	now := time.Now()
+	for key, expiry := range this.remote {
+		if now.Before(expiry) && !seen[key.record] {
+			seen[key.record] = true
+			records = append(records, key.record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name || records[i].Name == records[j].Name && records[i].IPv4 < records[j].IPv4
+	})
+	return records
+}
+
+// Announces the local records every interval and forgets the expired records of the other hosts
+func (this *Responder) announce() {
+	ticker := time.NewTicker(this.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+		this.mutex.Lock()
+		records := this.local
+		now := time.Now()
+		for key, expiry := range this.remote {
+			if now.After(expiry) {
+				delete(this.remote, key)
+			}
+		}
+		this.mutex.Unlock()
+		this.send(records, nil)
+	}
+}
+
+// Broadcasts the records and the records withdrawn, in as many frames as needed
+func (this *Responder) send(records, withdrawn []Record) {
+	ttl := int(ExpiryIntervals * this.config.Interval / time.Second)
+	max := this.config.MTU - len(announceMagic)
+	for len(records) > 0 || len(withdrawn) > 0 {
+		msg := announcement{Host: this.config.Host, TTL: ttl}
+		payload, _ := json.Marshal(msg)
+
+		// records are added while the announcement fits the MTU
+		for len(records) > 0 {
+			msg.Records = append(msg.Records, records[0])
+			buf, _ := json.Marshal(msg)
+			if len(buf) > max && len(msg.Records) > 1 {
+				msg.Records = msg.Records[:len(msg.Records)-1]
+				break
+			}
+			payload, records = buf, records[1:]
+		}
+		for len(withdrawn) > 0 && len(records) == 0 {
+			msg.Withdrawn = append(msg.Withdrawn, withdrawn[0])
+			buf, _ := json.Marshal(msg)
+			if len(buf) > max && len(msg.Records)+len(msg.Withdrawn) > 1 {
+				msg.Withdrawn = msg.Withdrawn[:len(msg.Withdrawn)-1]
+				break
+			}
+			payload, withdrawn = buf, withdrawn[1:]
+		}
+		this.sendFrame(ether.Broadcast, EthTypeAnnounce, append(append([]byte(nil), announceMagic...), payload...))
+	}
+}
+
+// Answers the frames until the socket is closed
+func (this *Responder) serve() {
+	buf := make([]byte, ether.FrameBufLen)
+	for {
+		n, err := this.frames.Read(buf)
+		if err != nil || n == 0 {
+			log.Debugf("DNS responder [ %s ] stopped: [ %v ]", this.config.Host, err)
+			return
+		}
+		header, payload, ok := ether.Parse(buf[:n])
+		if !ok {
+			continue
+		}
+		switch header.Type {
+		case ether.TypeARP:
+			this.arp(payload)
+		case ether.TypeIPv4:
+			this.ipv4(header, payload)
+		case EthTypeAnnounce:
+			this.receive(payload)
+		}
+	}
+}
+
+// Records the announcement of another host
+func (this *Responder) receive(payload []byte) {
+	if !bytes.HasPrefix(payload, announceMagic) {
+		return
+	}
+	var msg announcement
+	if err := json.Unmarshal(payload[len(announceMagic):], &msg); err != nil || msg.Host == "" || msg.Host == this.config.Host {
+		return
+	}
+	expiry := time.Now().Add(time.Duration(msg.TTL) * time.Second)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, record := range msg.Withdrawn {
+		delete(this.remote, remoteKey{host: msg.Host, record: record})
+	}
+	for _, record := range msg.Records {
+		this.remote[remoteKey{host: msg.Host, record: record}] = expiry
+	}
+}
+
+// Returns true if the responder answers the host with MAC address mac
+func (this *Responder) isClient(mac net.HardwareAddr) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.clients[mac.String()]
+}
+
+// Answers the ARP requests for the address of the responder sent by the hosts answered,
+// the responders of the other hosts answer theirs
+func (this *Responder) arp(pkt []byte) {
+	sha, spa, ok := ether.ParseARPRequest(pkt, this.config.IP)
+	if !ok || !this.isClient(sha) {
+		return
+	}
+	this.sendFrame(sha, ether.TypeARP, ether.ARPReplyTo(sha, spa, this.config.MAC, this.config.IP))
+}
+
+// Answers the DNS queries sent to the responder over UDP. On a network where every host sees
+// every frame (e.g. vxvde) the queries to the responders of the other hosts are ignored
+func (this *Responder) ipv4(header ether.Header, pkt []byte) {
+	if !bytes.Equal(header.Dst, this.config.MAC) || !this.isClient(header.Src) {
+		return
+	}
+	udp, ok := ether.ParseUDP(pkt)
+	if !ok || udp.DstPort != dnsPort || !udp.DstIP.Equal(this.config.IP) {
+		return
+	}
+
+	q, err := parseQuery(udp.Payload)
+	if q == nil {
+		return
+	}
+	var response []byte
+	switch {
+	case err != nil:
+		response = q.response(rcodeFormat, 0, nil)
+	case q.flags&0x7800 != 0:
+		// only the standard queries are answered
+		response = q.response(rcodeNotImpl, 0, nil)
+	default:
+		response = this.answer(q)
+	}
+	reply := ether.UDP{SrcIP: this.config.IP, SrcPort: dnsPort, DstIP: udp.SrcIP, DstPort: udp.SrcPort, Payload: response}
+	this.sendFrame(header.Src, ether.TypeIPv4, reply.Marshal())
+}
+
+// Returns the response to a query. The names of the domain, or without domain, that are not known
+// don't exist, the others are refused so that the resolver asks its next server
+func (this *Responder) answer(q *query) []byte {
+	name, inDomain := q.name, !strings.Contains(q.name, ".")
+	if this.config.Domain != "" && strings.HasSuffix(name, "."+this.config.Domain) {
+		name, inDomain = strings.TrimSuffix(name, "."+this.config.Domain), true
+	}
+	if !inDomain || strings.Contains(name, ".") {
+		return q.response(rcodeRefused, 0, nil)
+	}
+
+	found := false
+	var addrs [][]byte
+	for _, record := range this.Records() {
+		if strings.ToLower(record.Name) != name {
+			continue
+		}
+		found = true
+		if q.class != classIN {
+			continue
+		}
+		if ip := net.ParseIP(record.IPv4).To4(); ip != nil && q.qtype == typeA {
+			addrs = append(addrs, ip)
+		}
+		if ip := net.ParseIP(record.IPv6); ip != nil && ip.To4() == nil && q.qtype == typeAAAA {
+			addrs = append(addrs, ip.To16())
+		}
+	}
+	if !found {
+		return q.response(rcodeNotFound, 0, nil)
+	}
+
+	// the records change as the containers come and go
+	return q.response(rcodeSuccess, uint32(this.config.Interval/time.Second), addrs)
+}
+
+// Sends an ethernet frame from the responder
+func (this *Responder) sendFrame(dst net.HardwareAddr, ethType uint16, payload []byte) {
+	if _, err := this.frames.Write(ether.Frame(dst, this.config.MAC, ethType, payload)); err != nil {
+		log.Debugf("DNS responder [ %s ] send: [ %s ]", this.config.Host, err)
+	}
+}
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"phocs/vde_plug_docker/ether"
+)
+
+var (
+	responderIP  = net.IPv4(10, 10, 0, 2)
+	responderMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x53}
+	otherMAC     = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x54}
+	clientIP     = net.IPv4(10, 10, 0, 10)
+	clientMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	strangerMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+)
+
+// Starts a responder on one end of a socketpair, the other end is returned as the network
+func startTestResponder(t *testing.T) (*Responder, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		syscall.SetNonblock(fd, true)
+	}
+	frames, network := os.NewFile(uintptr(fds[0]), "responder"), os.NewFile(uintptr(fds[1]), "network")
+
+	responder := Start(Config{IP: responderIP, MAC: responderMAC, Domain: "vde", Host: "host1", Interval: time.Hour}, frames)
+	t.Cleanup(func() {
+		responder.Close()
+		network.Close()
+	})
+	responder.SetLocal([]Record{{Name: "web", IPv4: "10.10.0.3"}}, []net.HardwareAddr{clientMAC})
+
+	// the announcement of the local records
+	if frame := readFrame(t, network, time.Second); frame == nil {
+		t.Fatal("records not announced")
+	}
+	return responder, network
+}
+
+// returns the next frame sent by the responder, nil if none is sent in time
+func readFrame(t *testing.T, network *os.File, timeout time.Duration) []byte {
+	buf := make([]byte, ether.FrameBufLen)
+	network.SetReadDeadline(time.Now().Add(timeout))
+	n, err := network.Read(buf)
+	if err != nil {
+		if !os.IsTimeout(err) {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	return buf[:n]
+}
+
+// query of the A records of name
+func aQuery(id uint16, name string) []byte {
+	buf := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(buf[0:], id)
+	binary.BigEndian.PutUint16(buf[2:], 0x0100)
+	binary.BigEndian.PutUint16(buf[4:], 1)
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		buf = append(append(buf, byte(len(label))), label...)
+	}
+	return append(buf, 0, 0, typeA, 0, classIN)
+}
+
+func TestResponderQueries(t *testing.T) {
+	_, network := startTestResponder(t)
+
+	tests := []struct {
+		name     string
+		src, dst net.HardwareAddr
+		answered bool
+	}{
+		{"client", clientMAC, responderMAC, true},
+		{"responder of another host", clientMAC, otherMAC, false},
+		{"broadcast", clientMAC, ether.Broadcast, false},
+		{"client of another host", strangerMAC, responderMAC, false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := uint16(100 + i)
+			query := ether.UDP{SrcIP: clientIP, SrcPort: 40000, DstIP: responderIP, DstPort: dnsPort, Payload: aQuery(id, "web.vde")}
+			if _, err := network.Write(ether.Frame(test.dst, test.src, ether.TypeIPv4, query.Marshal())); err != nil {
+				t.Fatal(err)
+			}
+
+			timeout := time.Second
+			if !test.answered {
+				timeout = 100 * time.Millisecond
+			}
+			frame := readFrame(t, network, timeout)
+			if !test.answered {
+				if frame != nil {
+					t.Fatalf("answered %x", frame)
+				}
+				return
+			}
+			header, payload, ok := ether.Parse(frame)
+			if !ok || !bytes.Equal(header.Dst, test.src) || !bytes.Equal(header.Src, responderMAC) || header.Type != ether.TypeIPv4 {
+				t.Fatalf("response frame %x", frame)
+			}
+			udp, ok := ether.ParseUDP(payload)
+			if !ok || !udp.SrcIP.Equal(responderIP) || udp.SrcPort != dnsPort || !udp.DstIP.Equal(clientIP) || udp.DstPort != 40000 {
+				t.Fatalf("response datagram %+v", udp)
+			}
+			response := udp.Payload
+			if binary.BigEndian.Uint16(response) != id || binary.BigEndian.Uint16(response[2:])&0x8000 == 0 ||
+				binary.BigEndian.Uint16(response[2:])&0x0f != rcodeSuccess || binary.BigEndian.Uint16(response[6:]) != 1 {
+				t.Fatalf("response %x", response)
+			}
+			if !bytes.HasSuffix(response, net.IPv4(10, 10, 0, 3).To4()) {
+				t.Errorf("response %x does not hold the address of web", response)
+			}
+		})
+	}
+}
+
+func TestResponderARP(t *testing.T) {
+	_, network := startTestResponder(t)
+
+	tests := []struct {
+		name     string
+		src      net.HardwareAddr
+		answered bool
+	}{
+		{"client", clientMAC, true},
+		{"client of another host", strangerMAC, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := ether.ARPReplyTo(nil, responderIP, test.src, clientIP)
+			binary.BigEndian.PutUint16(request[6:], ether.ARPRequest)
+			if _, err := network.Write(ether.Frame(ether.Broadcast, test.src, ether.TypeARP, request)); err != nil {
+				t.Fatal(err)
+			}
+
+			timeout := time.Second
+			if !test.answered {
+				timeout = 100 * time.Millisecond
+			}
+			frame := readFrame(t, network, timeout)
+			if !test.answered {
+				if frame != nil {
+					t.Fatalf("answered %x", frame)
+				}
+				return
+			}
+			want := ether.Frame(test.src, responderMAC, ether.TypeARP, ether.ARPReplyTo(test.src, clientIP, responderMAC, responderIP))
+			if !bytes.Equal(frame, want) {
+				t.Errorf("reply %x, want %x", frame, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package endpoint
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// Traffic counters of the plug of an endpoint, "In" is the direction from the VDE network
+// to the container and "Out" the one from the container to the VDE network
+type Counters struct {
+	InPackets  uint64 `json:"InPackets"`
+	InBytes    uint64 `json:"InBytes"`
+	InErrors   uint64 `json:"InErrors"`
+	InDrops    uint64 `json:"InDrops"`
+	OutPackets uint64 `json:"OutPackets"`
+	OutBytes   uint64 `json:"OutBytes"`
+	OutErrors  uint64 `json:"OutErrors"`
+	OutDrops   uint64 `json:"OutDrops"`
+
+	// times the plug connected again to the VDE network after losing it
+	Reconnects uint64 `json:"Reconnects"`
+}
+
+// Counts a frame written to the TAP device, or why it was not
+func (this *Counters) countIn(n int, err error) {
+	switch {
+	case err == nil:
+		atomic.AddUint64(&this.InPackets, 1)
+		atomic.AddUint64(&this.InBytes, uint64(n))
+	case errors.Is(err, syscall.EAGAIN):
+		// the TAP queue is full
+		atomic.AddUint64(&this.InDrops, 1)
+	default:
+		atomic.AddUint64(&this.InErrors, 1)
+	}
+}
+
+// Counts a frame sent to the VDE network, or why it was not
+func (this *Counters) countOut(n int, err error) {
+	switch {
+	case err == nil:
+		atomic.AddUint64(&this.OutPackets, 1)
+		atomic.AddUint64(&this.OutBytes, uint64(n))
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.ENOBUFS):
+		// the VDE connection can't keep up
+		atomic.AddUint64(&this.OutDrops, 1)
+	default:
+		atomic.AddUint64(&this.OutErrors, 1)
+	}
+}
+
+// Returns a consistent copy of the counters, safe to read while the plug is running
+func (this *Counters) Snapshot() Counters {
+	return Counters{
+		InPackets:  atomic.LoadUint64(&this.InPackets),
+		InBytes:    atomic.LoadUint64(&this.InBytes),
+		InErrors:   atomic.LoadUint64(&this.InErrors),
+		InDrops:    atomic.LoadUint64(&this.InDrops),
+		OutPackets: atomic.LoadUint64(&this.OutPackets),
+		OutBytes:   atomic.LoadUint64(&this.OutBytes),
+		OutErrors:  atomic.LoadUint64(&this.OutErrors),
+		OutDrops:   atomic.LoadUint64(&this.OutDrops),
+		Reconnects: atomic.LoadUint64(&this.Reconnects),
+	}
+}
+
+// Returns the counters as key-value pairs, as reported by EndpointInfo
+func (this Counters) Map() map[string]string {
+	return map[string]string{
+		"in_packets":  strconv.FormatUint(this.InPackets, 10),
+		"in_bytes":    strconv.FormatUint(this.InBytes, 10),
+		"in_errors":   strconv.FormatUint(this.InErrors, 10),
+		"in_drops":    strconv.FormatUint(this.InDrops, 10),
+		"out_packets": strconv.FormatUint(this.OutPackets, 10),
+		"out_bytes":   strconv.FormatUint(this.OutBytes, 10),
+		"out_errors":  strconv.FormatUint(this.OutErrors, 10),
+		"out_drops":   strconv.FormatUint(this.OutDrops, 10),
+		"reconnects":  strconv.FormatUint(this.Reconnects, 10),
+	}
+}
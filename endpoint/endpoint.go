@@ -1,29 +1,42 @@
 package endpoint
 
-//#cgo LDFLAGS: -lvdeplug -lpthread
-//#include <vdeplug.h>
-import "C"
-
 import (
 	"crypto/rand"
 	"errors"
 	"net"
+	"os"
+	"runtime"
+
+	"phocs/vde_plug_docker/portmap"
+	"phocs/vde_plug_docker/vdeplug"
 
 	"github.com/docker/go-plugins-helpers/network"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 // EndpointStat struct, it is used inside the NetworkStat struct
 type EndpointStat struct {
 
-	// used to hold the vde plug PID that connects the endpoint to the vde network
-	Plugger uintptr `json:"Plugger"`
+	// vde plug that connects the endpoint to the vde network, nil when the endpoint is not plugged
+	plug *Plug `json:"-"` // ignore
+
+	// traffic counters, events and packet captures of the vde plug, kept across replugs
+	counters *Counters `json:"-"` // ignore
+	events   *Events   `json:"-"` // ignore
+	taps     *Taps     `json:"-"` // ignore
+
+	// proxies of the published ports
+	proxies []portmap.Proxy `json:"-"` // ignore
 
 	// used as the name of the TAP device associated to the endpoint, maximum length of 15 chars
 	IfName     string `json:"IfName"`
 	SandboxKey string `json:"SandboxKey"`
 
+	// true if the endpoint has been detached from the VDE network by the admin, it is not plugged again until replugged
+	Detached bool `json:"Detached"`
+
 	// IPv4 address of the endpoint
 	IPv4Address string `json:"IPv4Address"`
 
@@ -32,6 +45,21 @@ type EndpointStat struct {
 
 	// MAC address for the TAP decive of the endpoint
 	MacAddress string `json:"MacAddress"`
+
+	// rate limits of the vde plug, the ones of the network overridden by the endpoint options
+	Limits Limits `json:"Limits"`
+
+	// impairments of the frames sent by the container, the ones of the network overridden by the endpoint options
+	Netem Netem `json:"Netem"`
+
+	// 802.1Q VLAN of the network, the frames are tagged on the VDE network if it is not 0
+	Vlan uint16 `json:"Vlan,omitempty"`
+
+	// MTU of the network, set on the TAP device and enforced by the vde plug, 0 for the default one
+	MTU int `json:"MTU,omitempty"`
+
+	// ports of the container published on the host
+	Ports []portmap.Mapping `json:"Ports,omitempty"`
 }
 
 // Returns Endpoint Stats for new endpoint
@@ -39,7 +67,6 @@ func NewEndpointStat(r *network.CreateEndpointRequest, IfPrefix string) *Endpoin
 
 	// new endpointstat instance
 	new := EndpointStat{
-		Plugger:     0,
 		IfName:      IfPrefix + r.EndpointID[:11],
 		SandboxKey:  "",
 		IPv4Address: r.Interface.Address,
@@ -80,6 +107,14 @@ func (this *EndpointStat) LinkAdd() error {
 		return err
 	}
 
+	// the MTU is not applied to a new TAP device, set it afterwards, libnetwork keeps it in the sandbox
+	if this.MTU > 0 {
+		if err := netlink.LinkSetMTU(tapdev, this.MTU); err != nil {
+			netlink.LinkDel(tapdev)
+			return err
+		}
+	}
+
 	// sets IPv4 Address to the created TAP device
 	if ipv4, err := netlink.ParseAddr(this.IPv4Address); err == nil {
 		netlink.AddrAdd(tapdev, ipv4)
@@ -103,22 +138,193 @@ func (this *EndpointStat) LinkDel() error {
 	return err
 }
 
+// Brings up the TAP device of the endpoint, the ones moved in a sandbox are brought up by libnetwork
+func (this *EndpointStat) LinkUp() error {
+	link, err := netlink.LinkByName(this.IfName)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// Returns true if the TAP device of the endpoint is in the host network namespace
+func (this *EndpointStat) LinkOnHost() bool {
+	_, err := netlink.LinkByName(this.IfName)
+	return err == nil
+}
+
 // Creates a VDE plug between endpoint and vde network
 func (this *EndpointStat) LinkPlugTo(sock string) error {
 	log.Debugf("LinkPlugTo [ %s ] [ %s ]", this.IfName, sock)
 
-	// plugs the newly created TAP device of the endpoint to the given VDE socket, and stores vde plug PID in the endpoint struct
-	this.Plugger = uintptr(C.vdeplug_join(C.CString(this.IfName), C.CString(sock)))
-	if this.Plugger == 0 {
-		return errors.New("LinkPlugTo error: " + this.IfName + " to " + sock)
+	// opens the newly created TAP device of the endpoint
+	tap, err := vdeplug.OpenTap(this.IfName)
+	if err != nil {
+		return errors.New("LinkPlugTo error: " + this.IfName + " to " + sock + ": " + err.Error())
+	}
+	return this.plugTo(tap, sock, false)
+}
+
+// Plugs again the TAP device of an endpoint that has already been moved inside its sandbox,
+// used to restore the connectivity of running containers when the plugin restarts
+func (this *EndpointStat) LinkReplugTo(sock string) error {
+	log.Debugf("LinkReplugTo [ %s ] [ %s ] [ %s ]", this.IfName, this.SandboxKey, sock)
+
+	// libnetwork renames the TAP device when it moves it in the sandbox, look it up by MAC address
+	name, err := this.sandboxLinkName()
+	if err != nil {
+		return err
 	}
+
+	// the TAP device is opened inside the sandbox and the VDE connection in the host namespace
+	tap, err := openTapAt(name, this.SandboxKey)
+	if err != nil {
+		return errors.New("LinkReplugTo error: " + name + " in " + this.SandboxKey + " to " + sock + ": " + err.Error())
+	}
+	// the container is running, if the VDE network is unreachable the plug keeps trying
+	return this.plugTo(tap, sock, true)
+}
+
+// Connects to the VDE network and starts forwarding the frames of the TAP device,
+// if retry is true and the VDE network is unreachable the plug connects to it in background
+func (this *EndpointStat) plugTo(tap *os.File, sock string, retry bool) error {
+	conn, err := vdeplug.Open(sock)
+	if err != nil && !retry {
+		tap.Close()
+		return errors.New("LinkPlugTo error: " + this.IfName + " to " + sock + ": " + err.Error())
+	}
+	if err != nil {
+		log.Warnf("LinkPlugTo [ %s ] [ %s ]: [ %s ], retrying", this.IfName, sock, err)
+	}
+	if this.counters == nil {
+		this.counters, this.events = &Counters{}, &Events{}
+	}
+	this.plug = NewPlug(tap, sock, conn, this.counters, this.events, this.Taps(), PlugOptions{
+		Limits: this.Limits,
+		Netem:  this.Netem,
+		Vlan:   this.Vlan,
+		MTU:    this.MTU,
+	})
 	return nil
 }
 
-// Kills the vde plug process that connects the endpoint to the VDE network
+// Replaces the impairments of the frames sent by the container, the plug applies them at once
+func (this *EndpointStat) SetNetem(netem Netem) {
+	this.Netem = netem
+	if this.plug != nil {
+		this.plug.SetNetem(netem)
+	}
+}
+
+// Returns true if the endpoint is plugged to the VDE network
+func (this *EndpointStat) Plugged() bool {
+	return this.plug != nil && this.plug.Connected()
+}
+
+// Returns the events of the vde plug of the endpoint, such as reconnections
+func (this *EndpointStat) Events() []Event {
+	if this.events == nil {
+		return nil
+	}
+	return this.events.List()
+}
+
+// Returns the packet captures attached to the vde plug of the endpoint
+func (this *EndpointStat) Taps() *Taps {
+	if this.taps == nil {
+		this.taps = &Taps{}
+	}
+	return this.taps
+}
+
+// Returns the traffic counters of the vde plug of the endpoint
+func (this *EndpointStat) Counters() Counters {
+	if this.counters == nil {
+		return Counters{}
+	}
+	return this.counters.Snapshot()
+}
+
+// Opens the TAP device with the given name inside the network namespace at path netnspath
+func openTapAt(name, netnspath string) (*os.File, error) {
+	type result struct {
+		tap *os.File
+		err error
+	}
+	ch := make(chan result)
+
+	// namespaces are per thread, the goroutine runs on a dedicated thread that is
+	// thrown away if it can't go back to the host namespace
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() { ch <- res }()
+
+		host, err := netns.Get()
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer host.Close()
+		target, err := netns.GetFromPath(netnspath)
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer target.Close()
+
+		if res.err = netns.Set(target); res.err != nil {
+			return
+		}
+		res.tap, res.err = vdeplug.OpenTap(name)
+		if netns.Set(host) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	res := <-ch
+	return res.tap, res.err
+}
+
+// Returns the current name of the endpoint's TAP device inside the sandbox network namespace
+func (this *EndpointStat) sandboxLinkName() (string, error) {
+	mac, err := net.ParseMAC(this.MacAddress)
+	if err != nil {
+		return "", err
+	}
+
+	// get the network namespace of the container
+	ns, err := netns.GetFromPath(this.SandboxKey)
+	if err != nil {
+		return "", err
+	}
+	defer ns.Close()
+
+	// netlink handle operating inside the container namespace
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		if _, ok := link.(*netlink.Tuntap); ok && link.Attrs().HardwareAddr.String() == mac.String() {
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", errors.New("sandboxLinkName error: " + this.IfName + " not found in " + this.SandboxKey)
+}
+
+// Stops the vde plug that connects the endpoint to the VDE network
 func (this *EndpointStat) LinkPlugStop() {
-	C.vdeplug_leave(C.uintptr_t(this.Plugger))
-	this.Plugger = 0
+	if this.plug != nil {
+		this.plug.Stop()
+		this.plug = nil
+	}
 }
 
 /*
@@ -0,0 +1,49 @@
+package endpoint
+
+import (
+	"sync"
+	"time"
+)
+
+// kinds of plug events
+const (
+	EventDisconnected = "disconnected"
+	EventReconnected  = "reconnected"
+)
+
+// number of events kept for each endpoint
+const EventsMax = 32
+
+// Event of the vde plug of an endpoint
+type Event struct {
+	Time  time.Time `json:"Time"`
+	Event string    `json:"Event"`
+	Error string    `json:"Error,omitempty"`
+}
+
+// Most recent events of the vde plug of an endpoint
+type Events struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+// Records an event, the oldest one is discarded when the history is full
+func (this *Events) add(event string, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	e := Event{Time: time.Now(), Event: event}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if len(this.events) == EventsMax {
+		this.events = this.events[1:]
+	}
+	this.events = append(this.events, e)
+}
+
+// Returns a copy of the recorded events, oldest first
+func (this *Events) List() []Event {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]Event(nil), this.events...)
+}
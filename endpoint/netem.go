@@ -0,0 +1,258 @@
+package endpoint
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Impairments of the frames sent by the container, as the netem queueing discipline would apply them
+// to its interface. Percentages go from 0 to 100
+type Netem struct {
+	// delay of the frames, varied by jitter with the given distribution (uniform, normal or pareto)
+	Delay        time.Duration `json:"Delay,omitempty"`
+	Jitter       time.Duration `json:"Jitter,omitempty"`
+	Distribution string        `json:"Distribution,omitempty"`
+
+	// frames dropped, sent twice and sent with a flipped bit
+	Loss      float64 `json:"Loss,omitempty"`
+	Duplicate float64 `json:"Duplicate,omitempty"`
+	Corrupt   float64 `json:"Corrupt,omitempty"`
+
+	// frames sent at once, ahead of the delayed ones
+	Reorder float64 `json:"Reorder,omitempty"`
+}
+
+// distributions of the jitter
+const (
+	DistributionUniform = "uniform"
+	DistributionNormal  = "normal"
+	DistributionPareto  = "pareto"
+)
+
+// frames waiting for their delay, further frames are dropped as netem does
+const NetemLimit = 1000
+
+// Returns true if the frames are impaired
+func (this Netem) Enabled() bool {
+	return this.Delay > 0 || this.Jitter > 0 || this.Loss > 0 || this.Duplicate > 0 || this.Corrupt > 0 || this.Reorder > 0
+}
+
+// Returns the impairments set by the options delay, jitter, distribution, loss, duplicate, corrupt and reorder
+// on top of netem, the options of a network are overridden by the ones of its endpoints. A value of 0 clears an impairment
+func ParseNetem(opt map[string]interface{}, netem Netem) (Netem, error) {
+	var err error
+	for _, value := range []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"delay", &netem.Delay},
+		{"jitter", &netem.Jitter},
+	} {
+		s, _ := opt[value.key].(string)
+		if s == "" {
+			continue
+		}
+		if s == "0" {
+			*value.dst = 0
+		} else if *value.dst, err = time.ParseDuration(s); err != nil || *value.dst < 0 {
+			return netem, fmt.Errorf("bad %s %q", value.key, s)
+		}
+	}
+
+	if s, _ := opt["distribution"].(string); s != "" {
+		switch s {
+		case DistributionUniform, DistributionNormal, DistributionPareto:
+			netem.Distribution = s
+		default:
+			return netem, fmt.Errorf("bad distribution %q", s)
+		}
+	}
+
+	for _, value := range []struct {
+		key string
+		dst *float64
+	}{
+		{"loss", &netem.Loss},
+		{"duplicate", &netem.Duplicate},
+		{"corrupt", &netem.Corrupt},
+		{"reorder", &netem.Reorder},
+	} {
+		s, _ := opt[value.key].(string)
+		if s == "" {
+			continue
+		}
+		if *value.dst, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err != nil || *value.dst < 0 || *value.dst > 100 {
+			return netem, fmt.Errorf("bad %s %q", value.key, s)
+		}
+	}
+
+	// only the delayed frames can be overtaken
+	if netem.Reorder > 0 && netem.Delay == 0 {
+		return netem, fmt.Errorf("reorder needs a delay")
+	}
+	return netem, nil
+}
+
+// Returns the delay of a frame
+func (this Netem) delay(random *rand.Rand) time.Duration {
+	if this.Jitter == 0 {
+		return this.Delay
+	}
+	var x float64
+	switch this.Distribution {
+	case DistributionNormal:
+		x = random.NormFloat64()
+	case DistributionPareto:
+		// pareto with shape 3 and mean 1, shifted and scaled to mean 0 and standard deviation 1
+		x = ((2.0/3.0)/math.Cbrt(1-random.Float64()) - 1) * math.Sqrt(3)
+	default:
+		x = 2*random.Float64() - 1
+	}
+	if d := this.Delay + time.Duration(x*float64(this.Jitter)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Impairs the frames sent by the container and sends them through the plug when their delay expires
+type emulator struct {
+	plug   *Plug
+	config atomic.Value // Netem
+
+	// used only by tap2plug
+	random *rand.Rand
+
+	// frames waiting for their delay, wake is signaled when a frame is queued
+	mutex sync.Mutex
+	queue delayQueue
+	seq   uint64
+	wake  chan struct{}
+}
+
+func newEmulator(plug *Plug, netem Netem) *emulator {
+	this := &emulator{plug: plug, random: rand.New(rand.NewSource(time.Now().UnixNano())), wake: make(chan struct{}, 1)}
+	this.config.Store(netem)
+	return this
+}
+
+// Returns the current impairments
+func (this *emulator) get() Netem {
+	return this.config.Load().(Netem)
+}
+
+// Replaces the impairments, the frames already delayed keep their delay
+func (this *emulator) set(netem Netem) {
+	this.config.Store(netem)
+}
+
+// Impairs a frame sent by the container and queues it, frame is copied
+func (this *emulator) forward(netem Netem, frame []byte) {
+	if this.chance(netem.Loss) {
+		atomic.AddUint64(&this.plug.counters.OutDrops, 1)
+		return
+	}
+	copies := 1
+	if this.chance(netem.Duplicate) {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		// the copy keeps the headroom of the VLAN tag, see Plug.send
+		buf := make([]byte, VlanHdrLen+len(frame))
+		copy(buf[VlanHdrLen:], frame)
+
+		// the ethernet header is kept, so that the frame still reaches its destination
+		if this.chance(netem.Corrupt) && len(frame) > ethHdrLen {
+			buf[VlanHdrLen+ethHdrLen+this.random.Intn(len(frame)-ethHdrLen)] ^= 1 << this.random.Intn(8)
+		}
+		at := time.Now()
+		if !this.chance(netem.Reorder) {
+			at = at.Add(netem.delay(this.random))
+		}
+		this.push(at, buf)
+	}
+}
+
+// Returns true with the given percent probability
+func (this *emulator) chance(percent float64) bool {
+	return percent > 0 && this.random.Float64()*100 < percent
+}
+
+func (this *emulator) push(at time.Time, frame []byte) {
+	this.mutex.Lock()
+	if len(this.queue) >= NetemLimit {
+		this.mutex.Unlock()
+		atomic.AddUint64(&this.plug.counters.OutDrops, 1)
+		return
+	}
+	this.seq++
+	heap.Push(&this.queue, &delayed{at: at, seq: this.seq, frame: frame})
+	this.mutex.Unlock()
+
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the queued frames when their delay expires, until the plug is stopped
+func (this *emulator) run() {
+	defer this.plug.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		this.mutex.Lock()
+		var wait time.Duration = time.Hour
+		var frame []byte
+		if len(this.queue) > 0 {
+			if wait = time.Until(this.queue[0].at); wait <= 0 {
+				frame = heap.Pop(&this.queue).(*delayed).frame
+			}
+		}
+		this.mutex.Unlock()
+
+		if frame != nil {
+			this.plug.send(frame)
+			continue
+		}
+		timer.Reset(wait)
+		select {
+		case <-this.plug.done:
+			return
+		case <-this.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// frame waiting for its delay, frames due at the same time keep their order
+type delayed struct {
+	at    time.Time
+	seq   uint64
+	frame []byte
+}
+
+// min-heap of the delayed frames by time
+type delayQueue []*delayed
+
+func (this delayQueue) Len() int { return len(this) }
+func (this delayQueue) Less(i, j int) bool {
+	return this[i].at.Before(this[j].at) || this[i].at.Equal(this[j].at) && this[i].seq < this[j].seq
+}
+func (this delayQueue) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *delayQueue) Push(x interface{}) { *this = append(*this, x.(*delayed)) }
+func (this *delayQueue) Pop() interface{} {
+	old := *this
+	x := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return x
+}
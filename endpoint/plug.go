@@ -0,0 +1,292 @@
+package endpoint
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"phocs/vde_plug_docker/capture"
+	"phocs/vde_plug_docker/vdeplug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VDE plug of an endpoint, forwards the frames between the TAP device and the VDE connection.
+// When the VDE side goes away the plug keeps the TAP device and connects again to the VNL
+type Plug struct {
+	tap  *os.File
+	sock string
+
+	// current VDE connection, nil while the plug is reconnecting
+	mutex sync.RWMutex
+	conn  vdeplug.Conn
+
+	// traffic counters, plug events and packet captures, owned by the endpoint so that they survive the plug
+	counters *Counters
+	events   *Events
+	taps     *Taps
+
+	// rate limits of the frames sent to the container and of the frames sent by it, nil if unlimited
+	in, out *bucket
+
+	// impairments of the frames sent by the container
+	netem *emulator
+
+	// 802.1Q VLAN of the frames on the VDE network, 0 if they are not tagged
+	vlan uint16
+
+	// size of the longest frames forwarded, the MTU and the ethernet header
+	maxFrame int
+
+	// closed when the plug is stopped or the TAP device goes away
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// size of the ethernet header, shorter frames are dropped
+const ethHdrLen = 14
+
+// bounds of the exponential backoff between reconnection attempts
+const (
+	ReconnectMinDelay = 100 * time.Millisecond
+	ReconnectMaxDelay = 30 * time.Second
+)
+
+// Shaping of the frames forwarded by a plug
+type PlugOptions struct {
+	Limits Limits
+	Netem  Netem
+
+	// if not 0 the frames are tagged on the VDE network and the frames of other VLANs are ignored
+	Vlan uint16
+
+	// largest payload of the frames, the longer ones are dropped, 0 if bound only by the buffers
+	MTU int
+}
+
+// Starts forwarding the frames between tap and conn, opened on the VNL sock, shaped by opts,
+// counting them in counters and handing them to the captures in taps. If conn is nil the plug starts connecting to sock in background
+func NewPlug(tap *os.File, sock string, conn vdeplug.Conn, counters *Counters, events *Events, taps *Taps, opts PlugOptions) *Plug {
+	plug := &Plug{
+		tap:      tap,
+		sock:     sock,
+		conn:     conn,
+		counters: counters,
+		events:   events,
+		taps:     taps,
+		in:       newBucket(opts.Limits.RateIn, opts.Limits.BurstIn),
+		out:      newBucket(opts.Limits.RateOut, opts.Limits.BurstOut),
+		vlan:     opts.Vlan,
+		maxFrame: vdeplug.EthBufSize,
+		done:     make(chan struct{}),
+	}
+	if opts.MTU > 0 {
+		plug.maxFrame = ethHdrLen + opts.MTU
+	}
+	plug.netem = newEmulator(plug, opts.Netem)
+	plug.wg.Add(3)
+	go plug.supervise(conn)
+	go plug.tap2plug()
+	go plug.netem.run()
+	return plug
+}
+
+// Runs plug2tap on the current connection, when it hangs up connects again with exponential backoff
+func (this *Plug) supervise(conn vdeplug.Conn) {
+	defer this.wg.Done()
+	for {
+		if conn != nil {
+			err := this.plug2tap(conn)
+
+			// the plug has been stopped
+			if !this.Alive() {
+				return
+			}
+
+			// terminate may have taken and closed it in the meantime
+			if this.dropConn(conn) {
+				conn.Close()
+			}
+			this.events.add(EventDisconnected, err)
+			log.Warnf("Plug [ %s ]: disconnected from [ %s ]: [ %v ]", this.tap.Name(), this.sock, err)
+		}
+
+		if conn = this.reconnect(); conn == nil || !this.setConn(conn) {
+			return
+		}
+		atomic.AddUint64(&this.counters.Reconnects, 1)
+		this.events.add(EventReconnected, nil)
+		log.Infof("Plug [ %s ]: reconnected to [ %s ]", this.tap.Name(), this.sock)
+	}
+}
+
+// Opens the VNL until it succeeds, returns nil if the plug is stopped in the meantime
+func (this *Plug) reconnect() vdeplug.Conn {
+	delay := ReconnectMinDelay
+	for {
+		select {
+		case <-this.done:
+			return nil
+		case <-time.After(delay):
+		}
+		conn, err := vdeplug.Open(this.sock)
+		if err == nil {
+			return conn
+		}
+		log.Debugf("Plug [ %s ]: reconnect to [ %s ] in %s: [ %s ]", this.tap.Name(), this.sock, delay, err)
+		if delay *= 2; delay > ReconnectMaxDelay {
+			delay = ReconnectMaxDelay
+		}
+	}
+}
+
+// Copies the frames received from the VDE network to the TAP device, returns when the connection fails
+func (this *Plug) plug2tap(conn vdeplug.Conn) error {
+	buf := make([]byte, vdeplug.EthBufSize)
+	for {
+		n, err := conn.Recv(buf)
+		if n == 0 || err != nil {
+			return err
+		}
+		if n < ethHdrLen {
+			atomic.AddUint64(&this.counters.InDrops, 1)
+			continue
+		}
+
+		// the frames of the other VLANs sharing the VDE network are not for the container
+		frame := untag(buf[:n], this.vlan)
+		if frame == nil {
+			continue
+		}
+		if len(frame) > this.maxFrame {
+			atomic.AddUint64(&this.counters.InDrops, 1)
+			continue
+		}
+
+		// the plug has been stopped while the frame waited
+		if !this.in.wait(len(frame), this.done) {
+			return nil
+		}
+		this.taps.capture(capture.In, frame)
+		this.counters.countIn(this.tap.Write(frame))
+	}
+}
+
+// Copies the frames sent by the container to the VDE network, or to the emulator if they are impaired
+func (this *Plug) tap2plug() {
+	defer this.wg.Done()
+	defer this.terminate()
+	// the frames are read after room for the VLAN tag
+	buf := make([]byte, VlanHdrLen+vdeplug.EthBufSize)
+	for {
+		n, err := this.tap.Read(buf[VlanHdrLen:])
+		if n == 0 || err != nil {
+			this.log("tap2plug", err)
+			return
+		}
+		if n < ethHdrLen || n > this.maxFrame {
+			atomic.AddUint64(&this.counters.OutDrops, 1)
+			continue
+		}
+
+		// the TAP device queues the frames sent meanwhile
+		if !this.out.wait(n, this.done) {
+			return
+		}
+		if netem := this.netem.get(); netem.Enabled() {
+			this.netem.forward(netem, buf[VlanHdrLen:VlanHdrLen+n])
+			continue
+		}
+		this.send(buf[:VlanHdrLen+n])
+	}
+}
+
+// Sends a frame of the container to the VDE network, it is dropped while reconnecting.
+// buf holds the frame after VlanHdrLen bytes of headroom, used to tag it
+func (this *Plug) send(buf []byte) {
+	conn := this.getConn()
+	if conn == nil {
+		atomic.AddUint64(&this.counters.OutDrops, 1)
+		return
+	}
+	this.taps.capture(capture.Out, buf[VlanHdrLen:])
+	this.counters.countOut(conn.Send(tag(buf, this.vlan)))
+}
+
+// Replaces the impairments of the frames sent by the container
+func (this *Plug) SetNetem(netem Netem) {
+	this.netem.set(netem)
+}
+
+func (this *Plug) getConn() vdeplug.Conn {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.conn
+}
+
+// Makes conn the current connection, returns false and closes conn if the plug has been stopped
+func (this *Plug) setConn(conn vdeplug.Conn) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.Alive() {
+		conn.Close()
+		return false
+	}
+	this.conn = conn
+	return true
+}
+
+// Removes conn from the plug, returns false if it is no longer the current connection.
+// The connection is closed by whoever removes it, supervise or terminate
+func (this *Plug) dropConn(conn vdeplug.Conn) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.conn != conn {
+		return false
+	}
+	this.conn = nil
+	return true
+}
+
+// Closes both sides of the plug, the forwarding goroutines exit as soon as their reads fail
+func (this *Plug) terminate() {
+	this.once.Do(func() {
+		close(this.done)
+		if conn := this.getConn(); conn != nil && this.dropConn(conn) {
+			conn.Close()
+		}
+		this.tap.Close()
+	})
+}
+
+// Logs why a forwarding goroutine stopped, unless the plug has been stopped on purpose
+func (this *Plug) log(direction string, err error) {
+	select {
+	case <-this.done:
+	default:
+		log.Warnf("Plug %s [ %s ]: [ %v ]", direction, this.tap.Name(), err)
+	}
+}
+
+// Stops the plug and waits for the forwarding goroutines to exit
+func (this *Plug) Stop() {
+	this.terminate()
+	this.wg.Wait()
+}
+
+// Returns true while the plug is forwarding frames, or trying to reconnect
+func (this *Plug) Alive() bool {
+	select {
+	case <-this.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Returns true while the plug has a working VDE connection
+func (this *Plug) Connected() bool {
+	return this.Alive() && this.getConn() != nil
+}
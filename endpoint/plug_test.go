@@ -0,0 +1,570 @@
+package endpoint
+
+import (
+	"bytes"
+	"container/heap"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"phocs/vde_plug_docker/vdeplug"
+)
+
+// connection to a fake VDE network, the test delivers the frames and hangs it up
+type fakeConn struct {
+	frames chan []byte
+	sent   chan []byte
+	hangup chan struct{}
+	closed chan struct{}
+	closes int32
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		frames: make(chan []byte, 16),
+		sent:   make(chan []byte, 16),
+		hangup: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (this *fakeConn) Recv(buf []byte) (int, error) {
+	select {
+	case frame := <-this.frames:
+		return copy(buf, frame), nil
+	case <-this.hangup:
+		return 0, nil
+	case <-this.closed:
+		return 0, vdeplug.ErrClosed
+	}
+}
+
+func (this *fakeConn) Send(buf []byte) (int, error) {
+	this.sent <- append([]byte(nil), buf...)
+	return len(buf), nil
+}
+
+func (this *fakeConn) Close() error {
+	atomic.AddInt32(&this.closes, 1)
+	this.once.Do(func() { close(this.closed) })
+	return nil
+}
+
+// Plugs one end of a socketpair to a fake network reachable at embedded://<test name>, the other end plays
+// the container shaped by opts. The connections opened by the plug are sent on the returned channel
+func newTestPlug(t *testing.T, opts PlugOptions) (*os.File, *Plug, chan *fakeConn) {
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	conns := make(chan *fakeConn, 16)
+	err := vdeplug.RegisterEmbedded(name, func() (vdeplug.Conn, error) {
+		conn := newFakeConn()
+		conns <- conn
+		return conn, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// non blocking sockets go through the poller, so that closing them ends the pending reads
+	for _, fd := range fds {
+		syscall.SetNonblock(fd, true)
+	}
+	container := os.NewFile(uintptr(fds[0]), "container")
+	sock := "embedded://" + name
+	conn, err := vdeplug.Open(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plug := NewPlug(os.NewFile(uintptr(fds[1]), "tap"), sock, conn, &Counters{}, &Events{}, &Taps{}, opts)
+	t.Cleanup(func() {
+		plug.Stop()
+		container.Close()
+		vdeplug.UnregisterEmbedded(name)
+	})
+	return container, plug, conns
+}
+
+// ethernet frame of size bytes from the MAC address 02:00:00:00:00:<src>
+func testFrame(src byte, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, src, 0x88, 0xb5})
+	for i := ethHdrLen; i < size; i++ {
+		frame[i] = byte(i)
+	}
+	return frame
+}
+
+// the frame tagged with vlan
+func tagged(frame []byte, vlan uint16) []byte {
+	return tag(append(make([]byte, VlanHdrLen), frame...), vlan)
+}
+
+func expectSent(conn *fakeConn, timeout time.Duration) []byte {
+	select {
+	case frame := <-conn.sent:
+		return frame
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func expectRead(t *testing.T, container *os.File, timeout time.Duration) []byte {
+	buf := make([]byte, vdeplug.EthBufSize)
+	container.SetReadDeadline(time.Now().Add(timeout))
+	n, err := container.Read(buf)
+	if err != nil {
+		if !os.IsTimeout(err) {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestPlugForward(t *testing.T) {
+	tests := []struct {
+		name string
+		opts PlugOptions
+		// frame sent by the container and frame expected on the VDE network, nil if dropped
+		out, sent []byte
+		// frame received from the VDE network and frame expected by the container, nil if dropped
+		in, received []byte
+		outDrops     uint64
+		inDrops      uint64
+	}{
+		{
+			name: "forwarded",
+			out:  testFrame(1, 60), sent: testFrame(1, 60),
+			in: testFrame(2, 60), received: testFrame(2, 60),
+		},
+		{
+			name: "runts",
+			out:  testFrame(1, 60)[:ethHdrLen-1],
+			in:   testFrame(2, 60)[:ethHdrLen-1],
+			// dropped in both directions
+			outDrops: 1, inDrops: 1,
+		},
+		{
+			name: "mtu",
+			opts: PlugOptions{MTU: 100},
+			out:  testFrame(1, ethHdrLen+101),
+			in:   testFrame(2, ethHdrLen+101),
+			// longer than the MTU in both directions
+			outDrops: 1, inDrops: 1,
+		},
+		{
+			name: "vlan",
+			opts: PlugOptions{Vlan: 5},
+			out:  testFrame(1, 60), sent: tagged(testFrame(1, 60), 5),
+			in: tagged(testFrame(2, 60), 5), received: testFrame(2, 60),
+		},
+		{
+			name: "other vlan",
+			opts: PlugOptions{Vlan: 5},
+			out:  testFrame(1, 60), sent: tagged(testFrame(1, 60), 5),
+			// frames of the other VLANs are ignored without counting them
+			in: tagged(testFrame(2, 60), 6),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container, plug, conns := newTestPlug(t, test.opts)
+			conn := <-conns
+
+			if _, err := container.Write(test.out); err != nil {
+				t.Fatal(err)
+			}
+			timeout := time.Second
+			if test.sent == nil {
+				timeout = 100 * time.Millisecond
+			}
+			if got := expectSent(conn, timeout); !bytes.Equal(got, test.sent) {
+				t.Errorf("sent %x, want %x", got, test.sent)
+			}
+
+			conn.frames <- test.in
+			timeout = time.Second
+			if test.received == nil {
+				timeout = 100 * time.Millisecond
+			}
+			if got := expectRead(t, container, timeout); !bytes.Equal(got, test.received) {
+				t.Errorf("received %x, want %x", got, test.received)
+			}
+
+			// the goroutines count a frame after forwarding it
+			plug.Stop()
+			counters := plug.counters.Snapshot()
+			if counters.OutDrops != test.outDrops || counters.InDrops != test.inDrops {
+				t.Errorf("drops out %d in %d, want %d and %d", counters.OutDrops, counters.InDrops, test.outDrops, test.inDrops)
+			}
+		})
+	}
+}
+
+func TestPlugReconnect(t *testing.T) {
+	container, plug, conns := newTestPlug(t, PlugOptions{})
+	first := <-conns
+
+	// the network hangs up, the plug closes the connection and opens a new one
+	close(first.hangup)
+	var second *fakeConn
+	select {
+	case second = <-conns:
+	case <-time.After(10 * ReconnectMinDelay):
+		t.Fatal("the plug did not reconnect")
+	}
+	for deadline := time.Now().Add(time.Second); !plug.Connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the plug is not connected")
+		}
+	}
+
+	if atomic.LoadInt32(&first.closes) != 1 {
+		t.Errorf("first connection closed %d times", first.closes)
+	}
+	if n := plug.counters.Snapshot().Reconnects; n != 1 {
+		t.Errorf("%d reconnects", n)
+	}
+	var events []string
+	for _, event := range plug.events.List() {
+		events = append(events, event.Event)
+	}
+	if strings.Join(events, ",") != EventDisconnected+","+EventReconnected {
+		t.Errorf("events %v", events)
+	}
+
+	// the frames go through the new connection
+	frame := testFrame(1, 60)
+	if _, err := container.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectSent(second, time.Second); !bytes.Equal(got, frame) {
+		t.Errorf("sent %x, want %x", got, frame)
+	}
+	second.frames <- frame
+	if got := expectRead(t, container, time.Second); !bytes.Equal(got, frame) {
+		t.Errorf("received %x, want %x", got, frame)
+	}
+
+	plug.Stop()
+	if plug.Alive() || plug.Connected() {
+		t.Error("the plug is alive after Stop")
+	}
+	if first.closes != 1 || second.closes != 1 {
+		t.Errorf("connections closed %d and %d times", first.closes, second.closes)
+	}
+}
+
+// the network hanging up while the plug is stopped: the connection is closed once, by one of them
+func TestPlugStopHangup(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, plug, conns := newTestPlug(t, PlugOptions{})
+			conn := <-conns
+
+			go close(conn.hangup)
+			plug.Stop()
+
+			if n := atomic.LoadInt32(&conn.closes); n != 1 {
+				t.Fatalf("connection closed %d times", n)
+			}
+			select {
+			case <-conns:
+				t.Fatal("reconnected after Stop")
+			default:
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	network := Limits{RateIn: 1000, BurstIn: 100}
+	tests := []struct {
+		name string
+		opt  map[string]interface{}
+		want Limits
+	}{
+		{"none", map[string]interface{}{}, network},
+		{"bits", map[string]interface{}{"rate-in": "2000", "rate-out": "64kbit"}, Limits{RateIn: 2000, RateOut: 64000, BurstIn: 100}},
+		{"bytes", map[string]interface{}{"rate-out": "10kbps", "rate-in": "1.5MBps"}, Limits{RateIn: 12000000, RateOut: 80000, BurstIn: 100}},
+		{"gigabits", map[string]interface{}{"rate-out": " 1gbit "}, Limits{RateIn: 1000, RateOut: 1000000000, BurstIn: 100}},
+		{"burst", map[string]interface{}{"burst": "32k"}, Limits{RateIn: 1000, BurstIn: 32768, BurstOut: 32768}},
+		{"burst per direction", map[string]interface{}{"burst": "1mb", "burst-out": "1500b"}, Limits{RateIn: 1000, BurstIn: 1 << 20, BurstOut: 1500}},
+		{"not strings", map[string]interface{}{"rate-in": 5, "burst": true}, network},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits, err := ParseLimits(test.opt, network)
+			if err != nil || limits != test.want {
+				t.Errorf("limits %+v, %v, want %+v", limits, err, test.want)
+			}
+		})
+	}
+
+	for _, opt := range []map[string]interface{}{
+		{"rate-in": "fast"},
+		{"rate-in": "1 mbit"},
+		{"rate-out": "-1mbit"},
+		{"rate-out": "1e6"},
+		{"rate-out": "10k"},
+		{"burst": "1kbit"},
+		{"burst-in": "1.k"},
+	} {
+		if limits, err := ParseLimits(opt, network); err == nil {
+			t.Errorf("%v parsed as %+v", opt, limits)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	if newBucket(0, 1000) != nil || !(*bucket)(nil).wait(1<<20, nil) {
+		t.Error("a zero rate is limited")
+	}
+	// without a burst the rate is allowed for BurstDefaultTime, at least for a frame
+	if b := newBucket(8e8, 0); b.burst != 1e6 || b.tokens != b.burst {
+		t.Errorf("burst %f, tokens %f", b.burst, b.tokens)
+	}
+	if b := newBucket(8000, 0); b.burst != vdeplug.EthBufSize {
+		t.Errorf("burst %f", b.burst)
+	}
+
+	// 1000 bytes per second
+	b := newBucket(8000, 1500)
+	done := make(chan struct{})
+
+	// the frames go while the bucket is not in debt
+	for _, n := range []int{1000, 1000} {
+		if !b.wait(n, done) {
+			t.Fatal("wait stopped")
+		}
+	}
+	if b.tokens > -499 || b.tokens < -500 {
+		t.Errorf("%f tokens after 2000 bytes", b.tokens)
+	}
+
+	// the debt is refilled at the rate, up to the burst
+	b.tokens, b.last = -400, time.Now().Add(-500*time.Millisecond)
+	start := time.Now()
+	b.wait(200, done)
+	if time.Since(start) > 50*time.Millisecond || b.tokens > -99 || b.tokens < -100 {
+		t.Errorf("%f tokens after the refill", b.tokens)
+	}
+	b.last = time.Now().Add(-time.Hour)
+	b.wait(100, done)
+	if b.tokens > 1400 || b.tokens < 1399 {
+		t.Errorf("%f tokens after a full refill", b.tokens)
+	}
+
+	// the next frame waits for the debt to be paid, then takes its size
+	b.tokens, b.last = -50, time.Now()
+	start = time.Now()
+	if !b.wait(300, done) {
+		t.Fatal("wait stopped")
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waited %s for a debt of 50 bytes", elapsed)
+	}
+	if b.tokens != -300 || b.last.Before(start.Add(49*time.Millisecond)) {
+		t.Errorf("%f tokens at %s after the debt", b.tokens, b.last.Sub(start))
+	}
+
+	// the wait stops with the plug
+	b.tokens, b.last = -1000, time.Now()
+	close(done)
+	if b.wait(100, done) {
+		t.Error("wait not stopped")
+	}
+}
+
+func TestPlugRateLimit(t *testing.T) {
+	// 100000 bytes per second out, the first two frames go at once, then each waits 10ms
+	container, _, conns := newTestPlug(t, PlugOptions{Limits: Limits{RateOut: 800000, BurstOut: 1500}})
+	conn := <-conns
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := container.Write(testFrame(byte(i), 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if got := expectSent(conn, time.Second); !bytes.Equal(got, testFrame(byte(i), 1000)) {
+			t.Fatalf("frame %d: sent %x", i, got)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("5000 bytes sent in %s", elapsed)
+	}
+}
+
+func TestParseNetem(t *testing.T) {
+	network := Netem{Delay: 10 * time.Millisecond, Loss: 1}
+	tests := []struct {
+		name string
+		opt  map[string]interface{}
+		want Netem
+	}{
+		{"none", map[string]interface{}{}, network},
+		{"delay", map[string]interface{}{"delay": "1.5s", "jitter": "20ms", "distribution": "pareto"},
+			Netem{Delay: 1500 * time.Millisecond, Jitter: 20 * time.Millisecond, Distribution: DistributionPareto, Loss: 1}},
+		{"percentages", map[string]interface{}{"loss": "0.5%", "duplicate": "2", "corrupt": "100%", "reorder": "25"},
+			Netem{Delay: 10 * time.Millisecond, Loss: 0.5, Duplicate: 2, Corrupt: 100, Reorder: 25}},
+		{"cleared", map[string]interface{}{"delay": "0", "loss": "0"}, Netem{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			netem, err := ParseNetem(test.opt, network)
+			if err != nil || netem != test.want {
+				t.Errorf("netem %+v, %v, want %+v", netem, err, test.want)
+			}
+		})
+	}
+
+	for _, opt := range []map[string]interface{}{
+		{"delay": "100"},
+		{"delay": "-1ms"},
+		{"jitter": "fast"},
+		{"distribution": "gauss"},
+		{"loss": "101%"},
+		{"duplicate": "-1"},
+		{"corrupt": "half"},
+		{"delay": "0", "reorder": "10"},
+	} {
+		if netem, err := ParseNetem(opt, network); err == nil {
+			t.Errorf("%v parsed as %+v", opt, netem)
+		}
+	}
+}
+
+func TestNetemDelay(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	if d := (Netem{Delay: time.Second}).delay(random); d != time.Second {
+		t.Errorf("delay %s without jitter", d)
+	}
+	for _, distribution := range []string{"", DistributionUniform, DistributionNormal, DistributionPareto} {
+		netem := Netem{Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, Distribution: distribution}
+		var sum time.Duration
+		for i := 0; i < 10000; i++ {
+			d := netem.delay(random)
+			if d < 0 || distribution == DistributionUniform && (d < 90*time.Millisecond || d > 110*time.Millisecond) {
+				t.Fatalf("%s: delay %s", distribution, d)
+			}
+			sum += d
+		}
+		if mean := sum / 10000; mean < 99*time.Millisecond || mean > 101*time.Millisecond {
+			t.Errorf("%s: mean delay %s", distribution, mean)
+		}
+	}
+	// the jitter does not make the delays negative
+	netem := Netem{Delay: time.Millisecond, Jitter: time.Second, Distribution: DistributionNormal}
+	for i := 0; i < 1000; i++ {
+		if d := netem.delay(random); d < 0 {
+			t.Fatalf("delay %s", d)
+		}
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	var queue delayQueue
+	now := time.Now()
+	// frames due at the same time keep the order they were queued in
+	pushed := []struct {
+		at    time.Duration
+		frame string
+	}{
+		{30, "d"}, {10, "a"}, {20, "b"}, {50, "f"}, {20, "c"}, {40, "e"}, {0, "reordered"},
+	}
+	for seq, p := range pushed {
+		heap.Push(&queue, &delayed{at: now.Add(p.at * time.Millisecond), seq: uint64(seq), frame: []byte(p.frame)})
+	}
+	var popped []string
+	for queue.Len() > 0 {
+		popped = append(popped, string(heap.Pop(&queue).(*delayed).frame))
+	}
+	if strings.Join(popped, ",") != "reordered,a,b,c,d,e,f" {
+		t.Errorf("popped %v", popped)
+	}
+}
+
+func TestPlugNetem(t *testing.T) {
+	container, plug, conns := newTestPlug(t, PlugOptions{Netem: Netem{Delay: 50 * time.Millisecond}})
+	conn := <-conns
+
+	// the delayed frames go in order, after their delay
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := container.Write(testFrame(byte(i), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := expectSent(conn, 25*time.Millisecond); got != nil {
+		t.Fatalf("sent %x before the delay", got)
+	}
+	for i := 0; i < 3; i++ {
+		if got := expectSent(conn, time.Second); !bytes.Equal(got, testFrame(byte(i), 60)) {
+			t.Fatalf("frame %d: sent %x", i, got)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delayed by %s", elapsed)
+	}
+
+	// a frame reordered overtakes the delayed one
+	if _, err := container.Write(testFrame(1, 60)); err != nil {
+		t.Fatal(err)
+	}
+	waitPlug(t, func() bool {
+		plug.netem.mutex.Lock()
+		defer plug.netem.mutex.Unlock()
+		return len(plug.netem.queue) == 1
+	})
+	plug.SetNetem(Netem{Delay: 50 * time.Millisecond, Reorder: 100})
+	if _, err := container.Write(testFrame(2, 60)); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []byte{2, 1} {
+		if got := expectSent(conn, time.Second); !bytes.Equal(got, testFrame(src, 60)) {
+			t.Errorf("sent %x, want the frame of %d", got, src)
+		}
+	}
+
+	// the lost frames are counted as dropped, the duplicated ones are sent twice
+	plug.SetNetem(Netem{Loss: 100})
+	if _, err := container.Write(testFrame(3, 60)); err != nil {
+		t.Fatal(err)
+	}
+	waitPlug(t, func() bool { return plug.counters.Snapshot().OutDrops == 1 })
+	plug.SetNetem(Netem{Duplicate: 100})
+	if _, err := container.Write(testFrame(4, 60)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := expectSent(conn, time.Second); !bytes.Equal(got, testFrame(4, 60)) {
+			t.Errorf("sent %x, want the frame of 4", got)
+		}
+	}
+	if got := expectSent(conn, 50*time.Millisecond); got != nil {
+		t.Errorf("sent %x", got)
+	}
+	if n := plug.counters.Snapshot().OutDrops; n != 1 {
+		t.Errorf("%d frames dropped", n)
+	}
+}
+
+// waits until the plug has handled the frames written, as ready tells
+func waitPlug(t *testing.T, ready func() bool) {
+	for deadline := time.Now().Add(time.Second); !ready(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the frames were not handled")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"errors"
+	"net"
+
+	"phocs/vde_plug_docker/portmap"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Publishes ports of the container on the host, the proxies reach the container from inside its sandbox
+func (this *EndpointStat) PublishPorts(bindings []portmap.Binding) error {
+	var mappings []portmap.Mapping
+	var ends []int
+	for _, binding := range bindings {
+		m, err := binding.Mapping()
+		if err != nil {
+			return err
+		}
+		mappings = append(mappings, m)
+		ends = append(ends, binding.HostPortEnd)
+	}
+	published, err := this.publish(mappings, ends)
+	this.Ports = append(this.Ports, published...)
+	return err
+}
+
+// Publishes again the ports of the container stored in the datastore, on the same host ports. The stored
+// ports are kept until their proxies run, so that a republish that failed (e.g. a host port is taken)
+// is shown by inspect and can be tried again
+func (this *EndpointStat) RepublishPorts() error {
+	if this.PortsPublished() {
+		return nil
+	}
+	_, err := this.publish(this.Ports, make([]int, len(this.Ports)))
+	return err
+}
+
+// Returns true if every stored port has its proxy running
+func (this *EndpointStat) PortsPublished() bool {
+	return len(this.proxies) == len(this.Ports)
+}
+
+// Stops publishing the ports of the container
+func (this *EndpointStat) UnpublishPorts() {
+	for _, proxy := range this.proxies {
+		proxy.Close()
+	}
+	this.proxies = nil
+	this.Ports = nil
+}
+
+// Starts a proxy for every mapping and returns the mappings published, on failure the proxies started are closed
+func (this *EndpointStat) publish(mappings []portmap.Mapping, ends []int) ([]portmap.Mapping, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+	ip := this.address()
+	if ip == nil {
+		return nil, errors.New("PublishPorts error: " + this.IfName + " has no address")
+	}
+	var proxies []portmap.Proxy
+	for i, m := range mappings {
+		proxy, err := portmap.Start(m, ends[i], this.SandboxKey, ip)
+		if err != nil {
+			for _, proxy := range proxies {
+				proxy.Close()
+			}
+			return nil, errors.New("PublishPorts error: " + m.String() + ": " + err.Error())
+		}
+		proxies = append(proxies, proxy)
+	}
+	var published []portmap.Mapping
+	for _, proxy := range proxies {
+		this.proxies = append(this.proxies, proxy)
+		published = append(published, proxy.Mapping())
+	}
+	log.Debugf("PublishPorts [ %s ] [ %v ]", this.IfName, published)
+	return published, nil
+}
+
+// Returns the address of the container reached by the proxies, IPv4 if it has one
+func (this *EndpointStat) address() net.IP {
+	for _, cidr := range []string{this.IPv4Address, this.IPv6Address} {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			return ip
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
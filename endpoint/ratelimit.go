@@ -0,0 +1,152 @@
+package endpoint
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"phocs/vde_plug_docker/vdeplug"
+)
+
+// Rate limits of the plug of an endpoint, In is the traffic from the VDE network to the container and Out the other way.
+// Rates are in bits per second and bursts in bytes, a zero rate is unlimited
+type Limits struct {
+	RateIn   uint64 `json:"RateIn,omitempty"`
+	RateOut  uint64 `json:"RateOut,omitempty"`
+	BurstIn  uint64 `json:"BurstIn,omitempty"`
+	BurstOut uint64 `json:"BurstOut,omitempty"`
+}
+
+// time the rate is allowed to be exceeded when the burst is not given
+const BurstDefaultTime = 10 * time.Millisecond
+
+// units of the rates, as in tc, a bare number is in bits per second
+var rateUnits = map[string]float64{
+	"":     1,
+	"bit":  1,
+	"kbit": 1e3,
+	"mbit": 1e6,
+	"gbit": 1e9,
+	"bps":  8,
+	"kbps": 8e3,
+	"mbps": 8e6,
+	"gbps": 8e9,
+}
+
+// units of the bursts, as in tc, a bare number is in bytes
+var burstUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+var quantityRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([a-z]*)$`)
+
+// Returns the limits set by the options rate-in, rate-out, burst-in, burst-out and burst (both directions)
+// on top of limits, the options of a network are overridden by the ones of its endpoints
+func ParseLimits(opt map[string]interface{}, limits Limits) (Limits, error) {
+	var err error
+	values := []struct {
+		key   string
+		units map[string]float64
+		dst   []*uint64
+	}{
+		{"rate-in", rateUnits, []*uint64{&limits.RateIn}},
+		{"rate-out", rateUnits, []*uint64{&limits.RateOut}},
+		{"burst", burstUnits, []*uint64{&limits.BurstIn, &limits.BurstOut}},
+		{"burst-in", burstUnits, []*uint64{&limits.BurstIn}},
+		{"burst-out", burstUnits, []*uint64{&limits.BurstOut}},
+	}
+	for _, value := range values {
+		s, _ := opt[value.key].(string)
+		if s == "" {
+			continue
+		}
+		var n uint64
+		if n, err = parseQuantity(s, value.units); err != nil {
+			return limits, fmt.Errorf("bad %s %q", value.key, s)
+		}
+		for _, dst := range value.dst {
+			*dst = n
+		}
+	}
+	return limits, nil
+}
+
+// Parses a number followed by one of units
+func parseQuantity(s string, units map[string]float64) (uint64, error) {
+	match := quantityRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if match == nil {
+		return 0, fmt.Errorf("bad quantity %q", s)
+	}
+	unit, ok := units[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("bad unit %q", match[2])
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n * unit), nil
+}
+
+// Token bucket shaping one direction of a plug, used by a single forwarding goroutine.
+// A frame is let through as soon as the bucket is not in debt, then its size is taken from the bucket
+type bucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns a full bucket for rate bits per second, nil if rate is zero
+func newBucket(rate, burst uint64) *bucket {
+	if rate == 0 {
+		return nil
+	}
+	this := &bucket{rate: float64(rate) / 8, burst: float64(burst), last: time.Now()}
+	if this.burst == 0 {
+		this.burst = this.rate * BurstDefaultTime.Seconds()
+		if this.burst < vdeplug.EthBufSize {
+			this.burst = vdeplug.EthBufSize
+		}
+	}
+	this.tokens = this.burst
+	return this
+}
+
+// Waits until a frame of n bytes can go, returns false if done is closed in the meantime
+func (this *bucket) wait(n int, done <-chan struct{}) bool {
+	if this == nil {
+		return true
+	}
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	// the frame waits for the debt of the previous frames to be paid
+	if this.tokens < 0 {
+		delay := time.Duration(-this.tokens / this.rate * float64(time.Second))
+		timer := time.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		this.tokens = 0
+		this.last = now.Add(delay)
+	}
+	this.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,33 @@
+package endpoint
+
+import (
+	"os"
+	"syscall"
+
+	"phocs/vde_plug_docker/vdeplug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Plugs a service of the plugin, such as the DHCP server of a network, to the VNL sock as if it were a container.
+// Returns the socket carrying the frames of the service, one frame per read and write, and the plug forwarding them
+// shaped by opts. If the VNL is unreachable the plug keeps trying
+func NewServicePlug(name, sock string, opts PlugOptions) (*os.File, *Plug, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// non blocking sockets go through the poller, so that closing them ends the pending reads
+	for _, fd := range fds {
+		syscall.SetNonblock(fd, true)
+	}
+	service := os.NewFile(uintptr(fds[0]), name)
+	tap := os.NewFile(uintptr(fds[1]), "service:"+name)
+
+	conn, err := vdeplug.Open(sock)
+	if err != nil {
+		log.Warnf("NewServicePlug [ %s ] [ %s ]: [ %s ], retrying", name, sock, err)
+	}
+	return service, NewPlug(tap, sock, conn, &Counters{}, &Events{}, &Taps{}, opts), nil
+}
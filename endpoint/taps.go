@@ -0,0 +1,49 @@
+package endpoint
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"phocs/vde_plug_docker/capture"
+)
+
+// Packet captures attached to the plug of an endpoint, the list is replaced on every change
+// so that the forwarding loops read it without locking
+type Taps struct {
+	mutex sync.Mutex
+	list  atomic.Value // []*capture.Tap
+}
+
+// Attaches a capture to the plug
+func (this *Taps) Add(tap *capture.Tap) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	old, _ := this.list.Load().([]*capture.Tap)
+	this.list.Store(append(append([]*capture.Tap(nil), old...), tap))
+}
+
+// Detaches a capture from the plug
+func (this *Taps) Remove(tap *capture.Tap) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	old, _ := this.list.Load().([]*capture.Tap)
+	list := make([]*capture.Tap, 0, len(old))
+	for _, t := range old {
+		if t != tap {
+			list = append(list, t)
+		}
+	}
+	this.list.Store(list)
+}
+
+// Hands a forwarded frame to the attached captures, the stopped ones are detached
+func (this *Taps) capture(dir capture.Direction, frame []byte) {
+	list, _ := this.list.Load().([]*capture.Tap)
+	for _, tap := range list {
+		if tap.Stopped() {
+			this.Remove(tap)
+			continue
+		}
+		tap.Capture(dir, frame)
+	}
+}
@@ -0,0 +1,61 @@
+package endpoint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// size and TPID of the 802.1Q tag, inserted after the MAC addresses
+const (
+	VlanHdrLen = 4
+	VlanTPID   = 0x8100
+)
+
+// valid VLAN identifiers, 0 and 4095 are reserved
+const (
+	VlanMin = 1
+	VlanMax = 4094
+)
+
+// offset of the tag in the ethernet header
+const macsLen = 12
+
+// Returns the VLAN set by the vlan option, 0 if it is missing
+func ParseVlan(opt map[string]interface{}) (uint16, error) {
+	s, _ := opt["vlan"].(string)
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < VlanMin || id > VlanMax {
+		return 0, fmt.Errorf("bad vlan %q, it must be between %d and %d", s, VlanMin, VlanMax)
+	}
+	return uint16(id), nil
+}
+
+// Tags the frame held in buf after VlanHdrLen bytes of headroom, returns the tagged frame at the start of buf.
+// The frame is returned as it is if vlan is 0
+func tag(buf []byte, vlan uint16) []byte {
+	if vlan == 0 {
+		return buf[VlanHdrLen:]
+	}
+	copy(buf, buf[VlanHdrLen:VlanHdrLen+macsLen])
+	binary.BigEndian.PutUint16(buf[macsLen:], VlanTPID)
+	binary.BigEndian.PutUint16(buf[macsLen+2:], vlan)
+	return buf
+}
+
+// Untags a frame of vlan in place, returns nil if the frame is not tagged with vlan.
+// The frame is returned as it is if vlan is 0
+func untag(frame []byte, vlan uint16) []byte {
+	if vlan == 0 {
+		return frame
+	}
+	if len(frame) < ethHdrLen+VlanHdrLen || binary.BigEndian.Uint16(frame[macsLen:]) != VlanTPID ||
+		binary.BigEndian.Uint16(frame[macsLen+2:])&0x0fff != vlan {
+		return nil
+	}
+	copy(frame[VlanHdrLen:], frame[:macsLen])
+	return frame[VlanHdrLen:]
+}
@@ -0,0 +1,145 @@
+// Ethernet, ARP, IPv4 and UDP framing of the services of the plugin that speak raw frames on a plug
+// of a VDE network, such as the DHCP server and the DNS responder
+package ether
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ethernet, IPv4 and UDP constants
+const (
+	HdrLen     = 14
+	TypeIPv4   = 0x0800
+	TypeARP    = 0x0806
+	IPv4HdrLen = 20
+	UDPHdrLen  = 8
+	ProtoUDP   = 17
+	DefaultTTL = 64
+
+	// size of the buffers holding a frame, jumbo frames and a VLAN tag included
+	FrameBufLen = 9216 + HdrLen + 4
+)
+
+// ARP constants, only IPv4 over ethernet is spoken
+const (
+	ARPLen     = 28
+	ARPRequest = 1
+	ARPReply   = 2
+	arpHwEther = 1
+)
+
+var Broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Header of an ethernet frame
+type Header struct {
+	Dst, Src net.HardwareAddr
+	Type     uint16
+}
+
+// Splits a frame in its header and payload, ok is false if the frame is too short
+func Parse(frame []byte) (header Header, payload []byte, ok bool) {
+	if len(frame) < HdrLen {
+		return header, nil, false
+	}
+	header = Header{Dst: net.HardwareAddr(frame[0:6]), Src: net.HardwareAddr(frame[6:12]), Type: binary.BigEndian.Uint16(frame[12:])}
+	return header, frame[HdrLen:], true
+}
+
+// Returns the frame carrying payload from src to dst
+func Frame(dst, src net.HardwareAddr, ethType uint16, payload []byte) []byte {
+	frame := make([]byte, HdrLen+len(payload))
+	copy(frame[0:], dst)
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], ethType)
+	copy(frame[HdrLen:], payload)
+	return frame
+}
+
+// Returns the sender of an ARP request for the address ip, ok is false if pkt is not such a request
+func ParseARPRequest(pkt []byte, ip net.IP) (sha net.HardwareAddr, spa net.IP, ok bool) {
+	if len(pkt) < ARPLen || binary.BigEndian.Uint16(pkt[0:]) != arpHwEther || binary.BigEndian.Uint16(pkt[2:]) != TypeIPv4 ||
+		binary.BigEndian.Uint16(pkt[6:]) != ARPRequest || !net.IP(pkt[24:28]).Equal(ip) {
+		return nil, nil, false
+	}
+	return net.HardwareAddr(pkt[8:14]), net.IP(pkt[14:18]), true
+}
+
+// Returns the ARP reply telling the sender sha, spa of a request that ip is at mac
+func ARPReplyTo(sha net.HardwareAddr, spa net.IP, mac net.HardwareAddr, ip net.IP) []byte {
+	reply := make([]byte, ARPLen)
+	binary.BigEndian.PutUint16(reply[0:], arpHwEther)
+	binary.BigEndian.PutUint16(reply[2:], TypeIPv4)
+	reply[4], reply[5] = 6, net.IPv4len
+	binary.BigEndian.PutUint16(reply[6:], ARPReply)
+	copy(reply[8:], mac)
+	copy(reply[14:], ip.To4())
+	copy(reply[18:], sha)
+	copy(reply[24:], spa.To4())
+	return reply
+}
+
+// UDP datagram carried by an IPv4 packet
+type UDP struct {
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	Payload          []byte
+}
+
+// Returns the UDP datagram of an IPv4 packet, ok is false if pkt is not UDP or is a fragment,
+// the services answer messages that fit in a frame
+func ParseUDP(pkt []byte) (datagram UDP, ok bool) {
+	if len(pkt) < IPv4HdrLen || pkt[0]>>4 != 4 || pkt[9] != ProtoUDP {
+		return datagram, false
+	}
+	if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+		return datagram, false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if ihl < IPv4HdrLen || total > len(pkt) || total < ihl+UDPHdrLen {
+		return datagram, false
+	}
+	udp := pkt[ihl:total]
+	return UDP{
+		SrcIP:   net.IP(append([]byte(nil), pkt[12:16]...)),
+		DstIP:   net.IP(append([]byte(nil), pkt[16:20]...)),
+		SrcPort: binary.BigEndian.Uint16(udp[0:]),
+		DstPort: binary.BigEndian.Uint16(udp[2:]),
+		Payload: udp[UDPHdrLen:],
+	}, true
+}
+
+// Returns the IPv4 packet carrying the datagram. The UDP checksum is optional over IPv4 and is left out
+func (this UDP) Marshal() []byte {
+	pkt := make([]byte, IPv4HdrLen+UDPHdrLen+len(this.Payload))
+	pkt[0] = 4<<4 | IPv4HdrLen/4
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = DefaultTTL
+	pkt[9] = ProtoUDP
+	copy(pkt[12:], this.SrcIP.To4())
+	copy(pkt[16:], this.DstIP.To4())
+	binary.BigEndian.PutUint16(pkt[10:], Checksum(pkt[:IPv4HdrLen]))
+
+	udp := pkt[IPv4HdrLen:]
+	binary.BigEndian.PutUint16(udp[0:], this.SrcPort)
+	binary.BigEndian.PutUint16(udp[2:], this.DstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(UDPHdrLen+len(this.Payload)))
+	copy(udp[UDPHdrLen:], this.Payload)
+	return pkt
+}
+
+// Returns the internet checksum of buf
+func Checksum(buf []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -5,6 +5,19 @@ import (
 	// network interface functions
 	"phocs/vde_plug_docker/vdenet"
 
+	// datastore backends
+	"phocs/vde_plug_docker/datastore"
+
+	// prometheus metrics
+	"phocs/vde_plug_docker/metrics"
+	"phocs/vde_plug_docker/nat"
+
+	// admin REST API
+	"phocs/vde_plug_docker/admin"
+
+	// switches of the managed networks
+	"phocs/vde_plug_docker/vdeswitch"
+
 	// logging library
 	log "github.com/sirupsen/logrus"
 
@@ -12,6 +25,7 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	// docker plugin helper functions
+	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/go-plugins-helpers/network"
 )
 
@@ -19,30 +33,86 @@ import (
 default values in case of missing bash parameters
 
 unixSock: defalut position for UNIX socket to enable IPC with docker engine
+ipamSock: defalut position for UNIX socket of the IPAM driver
 dsFile: datastore filename
+dbFile: datastore filename of the BoltDB backend
 dsDefaultDir: default position for datastore file
 */
 const unixSock = "/run/docker/plugins/vde.sock"
+const ipamSock = "/run/docker/plugins/vde-ipam.sock"
 const dsFile = "/vde_plug_docker.json"
+const dbFile = "/vde_plug_docker.db"
 const dsDefaultDir = "/etc/docker"
 
 var (
-	dsPath string
+	dsPath, dbPath string
 	// flags for this docker plugin
-	debugMode = kingpin.Flag("debug", "Enable debug mode.").Bool()
-	dsClean   = kingpin.Flag("clean", "Delete old the data store.").Bool()
-	dsDir     = kingpin.Flag("dir-path", "Directory path of the data store.").String()
+	debugMode  = kingpin.Flag("debug", "Enable debug mode.").Bool()
+	dsClean    = kingpin.Flag("clean", "Delete old the data store.").Bool()
+	dsDir      = kingpin.Flag("dir-path", "Directory path of the data store.").String()
+	global     = kingpin.Flag("global", "Enable global scope to use the networks for swarm services.").Bool()
+	dsBackend  = kingpin.Flag("datastore", "Backend of the data store.").Default("file").Enum("file", "bolt", "etcd")
+	etcdURL    = kingpin.Flag("etcd-endpoint", "URL of the etcd server used by the etcd data store.").Default("http://127.0.0.1:2379").String()
+	etcdPfx    = kingpin.Flag("etcd-prefix", "Prefix of the keys used by the etcd data store.").Default(datastore.EtcdPrefixDefault).String()
+	migrate    = kingpin.Flag("migrate-only", "Upgrade the data store to the current schema version and exit.").Bool()
+	metricsOn  = kingpin.Flag("metrics-listen", "TCP address serving the Prometheus metrics on /metrics (e.g. :9324).").String()
+	vdeSwitch  = kingpin.Flag("vde-switch", "vde_switch executable started for the networks without sock.").Default(vdeswitch.Command).String()
+	firewall   = kingpin.Flag("firewall", "Firewall installing the masquerade rules of the networks, auto prefers iptables.").Default(nat.FirewallAuto).Enum(nat.FirewallAuto, nat.FirewallIptables, nat.FirewallNftables)
+	dockerSock = kingpin.Flag("docker-sock", "Unix socket of the docker engine API, asked for the container names of the network captures.").Default(vdenet.DockerSock).String()
+	adminSock  = kingpin.Flag("admin-sock", "Unix socket of the admin REST API, served by the daemon and used by the other commands (e.g. /run/vde_plug_docker.sock).").String()
+
+	// commands, without a command the daemon is started
+	serveCmd     = kingpin.Command("serve", "Start the plugin daemon.").Default()
+	lsCmd        = kingpin.Command("ls", "List the VDE networks.")
+	inspectCmd   = kingpin.Command("inspect", "Show a VDE network and its endpoints as JSON.")
+	inspectNet   = inspectCmd.Arg("network", "ID, or unique ID prefix, of the network.").Required().String()
+	endpointsCmd = kingpin.Command("endpoints", "List the endpoints of a VDE network.")
+	endpointsNet = endpointsCmd.Arg("network", "ID, or unique ID prefix, of the network.").Required().String()
+	replugCmd    = kingpin.Command("replug", "Plug an endpoint again to its VDE network, needs the running daemon.")
+	replugEp     = replugCmd.Arg("endpoint", "ID, or unique ID prefix, of the endpoint.").Required().String()
+	captureCmd   = kingpin.Command("capture", "Capture the frames of an endpoint, or of a network, in pcapng format, needs the running daemon.")
+	captureID    = captureCmd.Arg("endpoint", "ID, or unique ID prefix, of the endpoint, or of the network with --network.").Required().String()
+	captureNw    = captureCmd.Flag("network", "Capture all the endpoints of a network, one pcapng interface for each.").Bool()
+	captureFile  = captureCmd.Flag("write", "Output file, - for the standard output.").Short('w').Default("-").String()
+	captureFlt   = captureCmd.Flag("filter", "tcpdump-like filter (e.g. \"tcp and port 80\").").String()
+	captureMax   = captureCmd.Flag("max-bytes", "Stop after writing this many bytes.").Int64()
+	captureDur   = captureCmd.Flag("duration", "Stop after this time (e.g. 30s).").String()
+	captureBg    = captureCmd.Flag("detach", "Let the daemon write the capture to the --write file in background.").Bool()
+	capturesCmd  = kingpin.Command("captures", "List the running captures, needs the running daemon.")
+	stopCmd      = kingpin.Command("stop-capture", "Stop a capture, needs the running daemon.")
+	stopID       = stopCmd.Arg("capture", "ID of the capture.").Required().String()
+	netemCmd     = kingpin.Command("netem", "Change the impairments of the frames sent by an endpoint, or by all the endpoints of a network, needs the running daemon.")
+	netemID      = netemCmd.Arg("endpoint", "ID, or unique ID prefix, of the endpoint, or of the network with --network.").Required().String()
+	netemOpts    = netemCmd.Arg("options", "Options as in docker network create (e.g. delay=100ms jitter=10ms loss=1%), 0 clears an impairment.").StringMap()
+	netemNw      = netemCmd.Flag("network", "Change the impairments of a network and all its endpoints.").Bool()
+	gcCmd        = kingpin.Command("gc", "Clean up after the containers gone without leaving their networks, needs the running daemon.")
+	datastoreCmd = kingpin.Command("datastore", "Dump or restore the data store, the daemon must be stopped to restore.")
+	dumpCmd      = datastoreCmd.Command("dump", "Write the data store as JSON.")
+	dumpFile     = dumpCmd.Arg("file", "Output file.").Default("-").String()
+	restoreCmd   = datastoreCmd.Command("restore", "Replace the data store with a JSON dump.")
+	restoreFile  = restoreCmd.Arg("file", "Input file.").Default("-").String()
 )
 
+// returns the datastore backend selected by the flags
+func newBackend() (datastore.Backend, error) {
+	switch *dsBackend {
+	case "bolt":
+		return datastore.NewBoltBackend(dbPath)
+	case "etcd":
+		return datastore.NewEtcdBackend(*etcdURL, *etcdPfx), nil
+	}
+	return datastore.NewFileBackend(dsPath), nil
+}
+
 func main() {
-	// get flags
-	kingpin.Parse()
+	// get flags and command
+	command := kingpin.Parse()
 
 	//check if datastore path have been provided
 	if *dsDir != "" {
-		dsPath = *dsDir + dsFile
+		dsPath, dbPath = *dsDir+dsFile, *dsDir+dbFile
 	} else {
-		dsPath = dsDefaultDir + dsFile
+		dsPath, dbPath = dsDefaultDir+dsFile, dsDefaultDir+dbFile
 	}
 
 	// check if debug mode flag is true
@@ -50,11 +120,97 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	// get network driver
-	d := vdenet.NewDriver(dsPath, *dsClean)
+	var err error
+	switch command {
+	case serveCmd.FullCommand():
+		serve()
+	case lsCmd.FullCommand():
+		err = ls()
+	case inspectCmd.FullCommand():
+		err = inspect(*inspectNet)
+	case endpointsCmd.FullCommand():
+		err = endpoints(*endpointsNet)
+	case replugCmd.FullCommand():
+		err = replug(*replugEp)
+	case captureCmd.FullCommand():
+		err = captureTarget(*captureID, *captureNw)
+	case capturesCmd.FullCommand():
+		err = captures()
+	case stopCmd.FullCommand():
+		err = stopCapture(*stopID)
+	case netemCmd.FullCommand():
+		err = netem(*netemID, *netemOpts, *netemNw)
+	case gcCmd.FullCommand():
+		err = gc()
+	case dumpCmd.FullCommand():
+		err = dump(*dumpFile)
+	case restoreCmd.FullCommand():
+		err = restore(*restoreFile)
+	}
+	kingpin.FatalIfError(err, "%s", command)
+}
+
+// Starts the plugin daemon
+func serve() {
+	// get datastore backend
+	backend, err := newBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// upgrade the datastore in place without starting the plugin
+	if *migrate {
+		store := datastore.New(backend)
+		defer store.Close()
+		version, err := store.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Datastore migrated from version %d to %d", version, datastore.SchemaVersion)
+		return
+	}
+
+	// get network driver, it starts the switches of the managed networks
+	vdeswitch.Command = *vdeSwitch
+	vdenet.DockerSock = *dockerSock
+	nat.Firewall = *firewall
+	d := vdenet.NewDriver(backend, *dsClean, *global)
+
+	// serve the metrics of the driver, the API calls are measured by the instrumented drivers
+	var nd network.Driver = d
+	var id ipam.Ipam = vdenet.NewIpamDriver(d)
+	if *metricsOn != "" {
+		metrics.Register(d)
+		nd = metrics.InstrumentDriver(d)
+		id = metrics.InstrumentIpam(id)
+		go func() {
+			if err := metrics.ListenAndServe(*metricsOn); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// provide the docker IPAM with the IPAM driver, it shares the datastore with the network driver
+	ih := ipam.NewHandler(id)
+
+	// the IPAM driver listens on its own socket
+	go func() {
+		if err := ih.ServeUnix("vde-ipam", 0); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// serve the admin API, it goes through the driver mutex like the docker requests
+	if *adminSock != "" {
+		go func() {
+			if err := admin.ListenAndServe(*adminSock, d); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	// provide the docker NetworkController with the network driver
-	h := network.NewHandler(&d)
+	h := network.NewHandler(nd)
 
 	// creates Unix socket if doesn't exists and starts listening for requests, socket name is first parameter
 	if err := h.ServeUnix("vde", 0); err != nil {
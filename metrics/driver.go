@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// metrics of the plugin API calls
+var (
+	RequestDuration = NewHistogramVec("vde_driver_request_duration_seconds", "Latency of the network driver API calls.", "method")
+	RequestErrors   = NewCounterVec("vde_driver_request_errors_total", "Network driver API calls that returned an error.", "method")
+)
+
+// Network driver recording latency and errors of every call of the wrapped driver
+type Driver struct {
+	driver network.Driver
+}
+
+// Returns driver wrapped so that its calls are measured
+func InstrumentDriver(driver network.Driver) *Driver {
+	return &Driver{driver: driver}
+}
+
+// Records a call of method started at start
+func observe(method string, start time.Time, err error) {
+	RequestDuration.Observe(method, time.Since(start))
+	if err != nil {
+		RequestErrors.Inc(method)
+	}
+}
+
+func (this *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+	start := time.Now()
+	res, err := this.driver.GetCapabilities()
+	observe("GetCapabilities", start, err)
+	return res, err
+}
+
+func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
+	start := time.Now()
+	err := this.driver.CreateNetwork(r)
+	observe("CreateNetwork", start, err)
+	return err
+}
+
+func (this *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
+	start := time.Now()
+	res, err := this.driver.AllocateNetwork(r)
+	observe("AllocateNetwork", start, err)
+	return res, err
+}
+
+func (this *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
+	start := time.Now()
+	err := this.driver.DeleteNetwork(r)
+	observe("DeleteNetwork", start, err)
+	return err
+}
+
+func (this *Driver) FreeNetwork(r *network.FreeNetworkRequest) error {
+	start := time.Now()
+	err := this.driver.FreeNetwork(r)
+	observe("FreeNetwork", start, err)
+	return err
+}
+
+func (this *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	start := time.Now()
+	res, err := this.driver.CreateEndpoint(r)
+	observe("CreateEndpoint", start, err)
+	return res, err
+}
+
+func (this *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
+	start := time.Now()
+	err := this.driver.DeleteEndpoint(r)
+	observe("DeleteEndpoint", start, err)
+	return err
+}
+
+func (this *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, error) {
+	start := time.Now()
+	res, err := this.driver.EndpointInfo(r)
+	observe("EndpointInfo", start, err)
+	return res, err
+}
+
+func (this *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
+	start := time.Now()
+	res, err := this.driver.Join(r)
+	observe("Join", start, err)
+	return res, err
+}
+
+func (this *Driver) Leave(r *network.LeaveRequest) error {
+	start := time.Now()
+	err := this.driver.Leave(r)
+	observe("Leave", start, err)
+	return err
+}
+
+func (this *Driver) DiscoverNew(r *network.DiscoveryNotification) error {
+	start := time.Now()
+	err := this.driver.DiscoverNew(r)
+	observe("DiscoverNew", start, err)
+	return err
+}
+
+func (this *Driver) DiscoverDelete(r *network.DiscoveryNotification) error {
+	start := time.Now()
+	err := this.driver.DiscoverDelete(r)
+	observe("DiscoverDelete", start, err)
+	return err
+}
+
+func (this *Driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
+	start := time.Now()
+	err := this.driver.ProgramExternalConnectivity(r)
+	observe("ProgramExternalConnectivity", start, err)
+	return err
+}
+
+func (this *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
+	start := time.Now()
+	err := this.driver.RevokeExternalConnectivity(r)
+	observe("RevokeExternalConnectivity", start, err)
+	return err
+}
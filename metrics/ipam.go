@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+)
+
+// metrics of the IPAM API calls
+var (
+	IpamRequestDuration = NewHistogramVec("vde_ipam_request_duration_seconds", "Latency of the IPAM driver API calls.", "method")
+	IpamRequestErrors   = NewCounterVec("vde_ipam_request_errors_total", "IPAM driver API calls that returned an error.", "method")
+)
+
+// IPAM driver recording latency and errors of every call of the wrapped driver
+type Ipam struct {
+	driver ipam.Ipam
+}
+
+// Returns driver wrapped so that its calls are measured
+func InstrumentIpam(driver ipam.Ipam) *Ipam {
+	return &Ipam{driver: driver}
+}
+
+// Records a call of method started at start
+func observeIpam(method string, start time.Time, err error) {
+	IpamRequestDuration.Observe(method, time.Since(start))
+	if err != nil {
+		IpamRequestErrors.Inc(method)
+	}
+}
+
+func (this *Ipam) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	start := time.Now()
+	res, err := this.driver.GetCapabilities()
+	observeIpam("GetCapabilities", start, err)
+	return res, err
+}
+
+func (this *Ipam) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+	start := time.Now()
+	res, err := this.driver.GetDefaultAddressSpaces()
+	observeIpam("GetDefaultAddressSpaces", start, err)
+	return res, err
+}
+
+func (this *Ipam) RequestPool(r *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
+	start := time.Now()
+	res, err := this.driver.RequestPool(r)
+	observeIpam("RequestPool", start, err)
+	return res, err
+}
+
+func (this *Ipam) ReleasePool(r *ipam.ReleasePoolRequest) error {
+	start := time.Now()
+	err := this.driver.ReleasePool(r)
+	observeIpam("ReleasePool", start, err)
+	return err
+}
+
+func (this *Ipam) RequestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	start := time.Now()
+	res, err := this.driver.RequestAddress(r)
+	observeIpam("RequestAddress", start, err)
+	return res, err
+}
+
+func (this *Ipam) ReleaseAddress(r *ipam.ReleaseAddressRequest) error {
+	start := time.Now()
+	err := this.driver.ReleaseAddress(r)
+	observeIpam("ReleaseAddress", start, err)
+	return err
+}
@@ -0,0 +1,204 @@
+// Metrics of the plugin in the Prometheus text exposition format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// default buckets of the latency histograms, in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Writes a group of metrics in the text exposition format
+type Collector interface {
+	Collect(w io.Writer)
+}
+
+// Adapter to use ordinary functions as collectors
+type CollectorFunc func(w io.Writer)
+
+func (this CollectorFunc) Collect(w io.Writer) {
+	this(w)
+}
+
+// collectors registered by the plugin, written in order at every scrape
+var (
+	mutex      sync.Mutex
+	collectors []Collector
+)
+
+// Adds a collector to the ones written by Handler
+func Register(collector Collector) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	collectors = append(collectors, collector)
+}
+
+// Returns the HTTP handler serving the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		w.Write(render())
+	})
+}
+
+// Writes every collector to a buffer, the locks taken by the collectors (e.g. the driver mutex)
+// are released before the metrics are sent to a scraper that may be slow
+func render() []byte {
+	var buf bytes.Buffer
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, collector := range collectors {
+		collector.Collect(&buf)
+	}
+	return buf.Bytes()
+}
+
+// Serves the metrics on /metrics at the given TCP address
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// Label of a sample
+type Label struct {
+	Name, Value string
+}
+
+// Writes the HELP and TYPE lines of a metric
+func WriteHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample of a metric
+func WriteSample(w io.Writer, name string, value float64, labels ...Label) {
+	fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+// Formats labels as {name="value",...}, values are escaped
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label.Value)
+		parts[i] = fmt.Sprintf(`%s="%s"`, label.Name, value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Counter partitioned by the value of a single label
+type CounterVec struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+// Returns a new counter registered for the scrapes
+func NewCounterVec(name, help, label string) *CounterVec {
+	counter := &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+	Register(counter)
+	return counter
+}
+
+// Increments the counter with the given label value
+func (this *CounterVec) Inc(value string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.values[value]++
+}
+
+func (this *CounterVec) Collect(w io.Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	WriteHeader(w, this.name, "counter", this.help)
+	for _, value := range sortedKeys(this.values) {
+		WriteSample(w, this.name, this.values[value], Label{this.label, value})
+	}
+}
+
+// Histogram partitioned by the value of a single label
+type HistogramVec struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+// observations of a single label value
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Returns a new histogram with the default buckets, registered for the scrapes
+func NewHistogramVec(name, help, label string) *HistogramVec {
+	hist := &HistogramVec{name: name, help: help, label: label, buckets: DefaultBuckets, series: make(map[string]*histogram)}
+	Register(hist)
+	return hist
+}
+
+// Records a duration for the given label value
+func (this *HistogramVec) Observe(value string, d time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	series := this.series[value]
+	if series == nil {
+		series = &histogram{counts: make([]uint64, len(this.buckets))}
+		this.series[value] = series
+	}
+	seconds := d.Seconds()
+	for i, bound := range this.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+func (this *HistogramVec) Collect(w io.Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	WriteHeader(w, this.name, "histogram", this.help)
+	keys := make([]string, 0, len(this.series))
+	for key := range this.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := this.series[key]
+		for i, bound := range this.buckets {
+			WriteSample(w, this.name+"_bucket", float64(series.counts[i]), Label{this.label, key}, Label{"le", fmt.Sprint(bound)})
+		}
+		WriteSample(w, this.name+"_bucket", float64(series.count), Label{this.label, key}, Label{"le", "+Inf"})
+		WriteSample(w, this.name+"_sum", series.sum, Label{this.label, key})
+		WriteSample(w, this.name+"_count", float64(series.count), Label{this.label, key})
+	}
+}
+
+// Returns the keys of a map in order, so that scrapes are stable
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
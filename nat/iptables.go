@@ -0,0 +1,82 @@
+package nat
+
+import (
+	"strings"
+)
+
+// rules installed with iptables and ip6tables, in the nat POSTROUTING chain and on top of the FORWARD
+// chain, which docker sets to drop what it doesn't know
+type iptables struct{}
+
+func (iptables) command(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (this iptables) add(id string, rules []rule) error {
+	comment := []string{"-m", "comment", "--comment", CommentPrefix + id}
+	for _, r := range rules {
+		cmd := this.command(r.ipv6)
+		for _, args := range [][]string{
+			append([]string{"-t", "nat", "-A", "POSTROUTING", "-s", r.pool, "-o", r.uplink}, append(comment, "-j", "MASQUERADE")...),
+			append([]string{"-t", "filter", "-I", "FORWARD", "-i", r.gateway, "-o", r.uplink}, append(comment, "-j", "ACCEPT")...),
+			append([]string{"-t", "filter", "-I", "FORWARD", "-i", r.uplink, "-o", r.gateway, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"}, append(comment, "-j", "ACCEPT")...),
+		} {
+			if _, err := run(cmd, args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this iptables) remove(id string) error {
+	return this.delete(func(comment string) bool { return comment == CommentPrefix+id })
+}
+
+func (this iptables) flush() error {
+	return this.delete(func(comment string) bool { return strings.HasPrefix(comment, CommentPrefix) })
+}
+
+// Deletes the rules of the plugin whose comment matches, ip6tables is skipped if it is missing
+func (this iptables) delete(match func(comment string) bool) error {
+	for _, ipv6 := range []bool{false, true} {
+		cmd := this.command(ipv6)
+		for _, chain := range [][2]string{{"nat", "POSTROUTING"}, {"filter", "FORWARD"}} {
+			out, err := run(cmd, "-t", chain[0], "-S", chain[1])
+			if err != nil {
+				if ipv6 {
+					break
+				}
+				return err
+			}
+			for _, line := range strings.Split(out, "\n") {
+				args := strings.Fields(line)
+				if len(args) < 2 || args[0] != "-A" || !match(ruleComment(args)) {
+					continue
+				}
+				// the rule is deleted by its specification, as listed without the quotes of the comment
+				args[0] = "-D"
+				for i := range args {
+					args[i] = strings.Trim(args[i], "\"")
+				}
+				if _, err := run(cmd, append([]string{"-t", chain[0]}, args...)...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the comment of a rule as listed by iptables -S
+func ruleComment(args []string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--comment" {
+			return strings.Trim(args[i+1], "\"")
+		}
+	}
+	return ""
+}
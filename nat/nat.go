@@ -0,0 +1,193 @@
+// Masquerade of the traffic of the VDE networks leaving the host through its default route.
+// The rules are installed with iptables, alongside the ones of docker, or with nftables when iptables is missing,
+// every rule is marked with the ID of its network so that it can be removed
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// firewalls installing the rules, selected by Firewall
+const (
+	FirewallAuto     = "auto"
+	FirewallIptables = "iptables"
+	FirewallNftables = "nftables"
+)
+
+// firewall used, FirewallAuto picks iptables if it is in PATH and nftables otherwise
+var Firewall = FirewallAuto
+
+// prefix of the comments marking the rules of the plugin, followed by the network ID
+const CommentPrefix = "vde_plug_docker:"
+
+// Masquerade of a network, the traffic of its pools leaving through the default route
+type Rules struct {
+	// network ID marking the rules
+	ID string
+
+	// TAP device on the host holding the gateway addresses of the network
+	Gateway string
+
+	// IPv4 and IPv6 pools of the network in CIDR format, the IPv6 one may be empty
+	Pools []string
+}
+
+// rule of a firewall, installed for one family
+type rule struct {
+	ipv6 bool
+
+	// source pool, interface of the network and interface of the default route
+	pool, gateway, uplink string
+}
+
+// firewall installing and removing the rules
+type firewall interface {
+	add(id string, rules []rule) error
+	remove(id string) error
+	flush() error
+}
+
+// Installs the rules masquerading a network and enables the forwarding of its families
+func Install(this Rules) error {
+	fw, err := selectFirewall()
+	if err != nil {
+		return err
+	}
+	var rules []rule
+	for _, pool := range this.Pools {
+		if pool == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(pool)
+		if err != nil {
+			return fmt.Errorf("bad pool %q", pool)
+		}
+		ipv6 := ip.To4() == nil
+		uplinks, err := defaultRouteLinks(ipv6)
+		if err != nil {
+			return err
+		}
+		if err := enableForwarding(ipv6); err != nil {
+			return err
+		}
+		for _, uplink := range uplinks {
+			rules = append(rules, rule{ipv6: ipv6, pool: pool, gateway: this.Gateway, uplink: uplink})
+		}
+	}
+
+	// the rules left by a previous install are replaced
+	if err := fw.remove(this.ID); err != nil {
+		return err
+	}
+	if err := fw.add(this.ID, rules); err != nil {
+		fw.remove(this.ID)
+		return err
+	}
+	log.Infof("Masquerade installed: [ %s ] [ %v ]", this.ID, this.Pools)
+	return nil
+}
+
+// Removes the rules masquerading a network
+func Remove(id string) error {
+	fw, err := selectFirewall()
+	if err != nil {
+		return err
+	}
+	log.Infof("Masquerade removed: [ %s ]", id)
+	return fw.remove(id)
+}
+
+// Removes the rules of every network, left by a previous run of the plugin
+func Flush() error {
+	fw, err := selectFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.flush()
+}
+
+// Returns the firewall selected by Firewall
+func selectFirewall() (firewall, error) {
+	switch Firewall {
+	case FirewallIptables:
+		return iptables{}, nil
+	case FirewallNftables:
+		return nftables{}, nil
+	case FirewallAuto, "":
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return iptables{}, nil
+		}
+		if _, err := exec.LookPath("nft"); err == nil {
+			return nftables{}, nil
+		}
+		return nil, errors.New("neither iptables nor nft found")
+	default:
+		return nil, fmt.Errorf("unknown firewall %q", Firewall)
+	}
+}
+
+// Returns the interfaces of the default routes of a family
+func defaultRouteLinks(ipv6 bool) ([]string, error) {
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		if route.Dst != nil && !route.Dst.IP.IsUnspecified() {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil || seen[link.Attrs().Name] {
+			continue
+		}
+		seen[link.Attrs().Name] = true
+		links = append(links, link.Attrs().Name)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no default route for %s", familyName(ipv6))
+	}
+	return links, nil
+}
+
+// Enables the forwarding of a family, docker enables it for IPv4 already
+func enableForwarding(ipv6 bool) error {
+	path := "/proc/sys/net/ipv4/ip_forward"
+	if ipv6 {
+		path = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	if buf, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(buf)) == "1" {
+		return nil
+	}
+	return os.WriteFile(path, []byte("1\n"), 0644)
+}
+
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// Runs a firewall command, its output is returned in the error
+func run(name string, args ...string) (string, error) {
+	log.Debugf("nat: [ %s %s ]", name, strings.Join(args, " "))
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
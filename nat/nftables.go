@@ -0,0 +1,75 @@
+package nat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rules installed with nft in a table of the plugin, with a nat chain and a forward chain
+type nftables struct{}
+
+// table of the plugin, shared by both families
+const nftTable = "vde_plug_docker"
+
+// handle of a rule as listed by nft -a
+var nftHandle = regexp.MustCompile(`comment "([^"]*)" # handle (\d+)`)
+
+func (this nftables) add(id string, rules []rule) error {
+	// the table and its chains are created if missing
+	for _, args := range [][]string{
+		{"add", "table", "inet", nftTable},
+		{"add", "chain", "inet", nftTable, "postrouting", "{ type nat hook postrouting priority srcnat ; }"},
+		{"add", "chain", "inet", nftTable, "forward", "{ type filter hook forward priority filter ; }"},
+	} {
+		if _, err := run("nft", args...); err != nil {
+			return err
+		}
+	}
+	comment := fmt.Sprintf("comment %q", CommentPrefix+id)
+	for _, r := range rules {
+		family := "ip"
+		if r.ipv6 {
+			family = "ip6"
+		}
+		for _, args := range [][]string{
+			{"add", "rule", "inet", nftTable, "postrouting", family, "saddr", r.pool, "oifname", r.uplink, "masquerade", comment},
+			{"add", "rule", "inet", nftTable, "forward", "iifname", r.gateway, "oifname", r.uplink, "accept", comment},
+			{"add", "rule", "inet", nftTable, "forward", "iifname", r.uplink, "oifname", r.gateway, "ct", "state", "established,related", "accept", comment},
+		} {
+			if _, err := run("nft", args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this nftables) remove(id string) error {
+	for _, chain := range []string{"postrouting", "forward"} {
+		out, err := run("nft", "-a", "list", "chain", "inet", nftTable, chain)
+		if err != nil {
+			// the table is created with the first rules
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			m := nftHandle.FindStringSubmatch(line)
+			if m == nil || m[1] != CommentPrefix+id {
+				continue
+			}
+			if _, err := run("nft", "delete", "rule", "inet", nftTable, chain, "handle", m[2]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Deletes the table of the plugin, along with the rules of every network
+func (this nftables) flush() error {
+	if _, err := run("nft", "list", "table", "inet", nftTable); err != nil {
+		return nil
+	}
+	_, err := run("nft", "delete", "table", "inet", nftTable)
+	return err
+}
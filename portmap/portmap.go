@@ -0,0 +1,167 @@
+// Published ports of the containers: the host ports are served by userspace proxies that reach
+// the containers from inside their network namespaces, so that the host needs no route to the VDE networks
+package portmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// option of ProgramExternalConnectivity holding the port bindings of the container
+const PortMapOption = "com.docker.network.portmap"
+
+// IP protocol numbers used by docker in the port bindings
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// timeout of the connections to the containers and of the idle UDP flows
+const (
+	DialTimeout = 10 * time.Second
+	UDPTimeout  = 90 * time.Second
+)
+
+// Port binding as sent by docker, HostPort is 0 if any port will do, otherwise a port between HostPort and HostPortEnd
+type Binding struct {
+	Proto       int    `json:"Proto"`
+	IP          string `json:"IP"`
+	Port        int    `json:"Port"`
+	HostIP      string `json:"HostIP"`
+	HostPort    int    `json:"HostPort"`
+	HostPortEnd int    `json:"HostPortEnd"`
+}
+
+// Published port of a container, as stored in the datastore
+type Mapping struct {
+	Proto         string `json:"Proto"`
+	HostIP        string `json:"HostIP"`
+	HostPort      int    `json:"HostPort"`
+	ContainerPort int    `json:"ContainerPort"`
+}
+
+func (this Mapping) String() string {
+	return net.JoinHostPort(this.HostIP, strconv.Itoa(this.HostPort)) + "->" + strconv.Itoa(this.ContainerPort) + "/" + this.Proto
+}
+
+// Returns the port bindings in the options of ProgramExternalConnectivity
+func ParseBindings(options map[string]interface{}) ([]Binding, error) {
+	value, ok := options[PortMapOption]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	// the options are decoded as generic JSON values
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []Binding
+	if err := json.Unmarshal(buf, &bindings); err != nil {
+		return nil, fmt.Errorf("bad port bindings: %s", err)
+	}
+	return bindings, nil
+}
+
+// Returns the mapping of a binding, with HostPort 0 if any port will do
+func (this Binding) Mapping() (Mapping, error) {
+	m := Mapping{HostIP: this.HostIP, HostPort: this.HostPort, ContainerPort: this.Port}
+	switch this.Proto {
+	case protoTCP:
+		m.Proto = "tcp"
+	case protoUDP:
+		m.Proto = "udp"
+	default:
+		return m, fmt.Errorf("protocol %d of port %d is not supported", this.Proto, this.Port)
+	}
+	return m, nil
+}
+
+// Proxy forwarding a host port to a container
+type Proxy interface {
+	// mapping served, with the host port chosen
+	Mapping() Mapping
+
+	// stops the proxy and closes its connections
+	Close() error
+}
+
+// Starts a proxy for m, forwarding to the address ip of the container in the network namespace at netnspath.
+// If m.HostPort is 0 any free port is used, if end is greater the first free port up to end
+func Start(m Mapping, end int, netnspath string, ip net.IP) (Proxy, error) {
+	target := net.JoinHostPort(ip.String(), strconv.Itoa(m.ContainerPort))
+	dial := func(network string) (net.Conn, error) {
+		return dialIn(netnspath, network, target)
+	}
+
+	ports := []int{m.HostPort}
+	for port := m.HostPort + 1; m.HostPort != 0 && port <= end; port++ {
+		ports = append(ports, port)
+	}
+	var err error
+	for _, port := range ports {
+		addr := net.JoinHostPort(m.HostIP, strconv.Itoa(port))
+		var proxy Proxy
+		switch m.Proto {
+		case "tcp":
+			proxy, err = newTCPProxy(m, addr, dial)
+		case "udp":
+			proxy, err = newUDPProxy(m, addr, dial)
+		default:
+			return nil, fmt.Errorf("protocol %s is not supported", m.Proto)
+		}
+		if err == nil {
+			log.Infof("Published [ %s ] to [ %s ]", proxy.Mapping(), target)
+			return proxy, nil
+		}
+	}
+	return nil, err
+}
+
+// Connects to addr from inside the network namespace at netnspath, the socket keeps the namespace
+func dialIn(netnspath, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result)
+
+	// namespaces are per thread, the goroutine runs on a dedicated thread that is
+	// thrown away if it can't go back to the host namespace
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() { ch <- res }()
+
+		host, err := netns.Get()
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer host.Close()
+		target, err := netns.GetFromPath(netnspath)
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer target.Close()
+
+		if res.err = netns.Set(target); res.err != nil {
+			return
+		}
+		res.conn, res.err = net.DialTimeout(network, addr, DialTimeout)
+		if netns.Set(host) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	res := <-ch
+	return res.conn, res.err
+}
@@ -0,0 +1,118 @@
+package portmap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Proxy of a TCP port, every connection accepted on the host is connected to the container
+type tcpProxy struct {
+	mapping  Mapping
+	listener net.Listener
+	dial     func(network string) (net.Conn, error)
+
+	// connections in progress, closed with the proxy
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newTCPProxy(m Mapping, addr string, dial func(network string) (net.Conn, error)) (*tcpProxy, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m.HostPort = listener.Addr().(*net.TCPAddr).Port
+	this := &tcpProxy{mapping: m, listener: listener, dial: dial, conns: make(map[net.Conn]struct{})}
+	go this.serve()
+	return this, nil
+}
+
+func (this *tcpProxy) Mapping() Mapping {
+	return this.mapping
+}
+
+// Accepts the connections until the proxy is closed
+func (this *tcpProxy) serve() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("Proxy [ %s ]: [ %s ]", this.mapping, err)
+			}
+			return
+		}
+		go this.forward(conn)
+	}
+}
+
+// Copies the data of a client connection to the container and back, until both sides are done
+func (this *tcpProxy) forward(client net.Conn) {
+	server, err := this.dial("tcp")
+	if err != nil {
+		log.Debugf("Proxy [ %s ]: [ %s ]", this.mapping, err)
+		client.Close()
+		return
+	}
+	if !this.track(client, server) {
+		return
+	}
+	defer this.untrack(client, server)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go pipe(&wg, server, client)
+	go pipe(&wg, client, server)
+	wg.Wait()
+}
+
+// Copies src to dst, then closes the write side of dst so that the peer sees the end of the data
+func pipe(wg *sync.WaitGroup, dst, src net.Conn) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if conn, ok := dst.(*net.TCPConn); ok {
+		conn.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// Adds the connections to the ones in progress, closes them if the proxy has been closed
+func (this *tcpProxy) track(conns ...net.Conn) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		this.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (this *tcpProxy) untrack(conns ...net.Conn) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		delete(this.conns, conn)
+	}
+}
+
+func (this *tcpProxy) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.closed = true
+	for conn := range this.conns {
+		conn.Close()
+	}
+	log.Infof("Unpublished [ %s ]", this.mapping)
+	return this.listener.Close()
+}
@@ -0,0 +1,121 @@
+package portmap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// size of the datagrams relayed by the UDP proxies
+const udpBufSize = 65507
+
+// Proxy of a UDP port, every client address gets its own flow to the container, closed when idle
+type udpProxy struct {
+	mapping Mapping
+	sock    *net.UDPConn
+	dial    func(network string) (net.Conn, error)
+
+	// key-value pairs where keys are the client addresses and values are the connections to the container
+	mutex  sync.Mutex
+	flows  map[string]net.Conn
+	closed bool
+}
+
+func newUDPProxy(m Mapping, addr string, dial func(network string) (net.Conn, error)) (*udpProxy, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	m.HostPort = sock.LocalAddr().(*net.UDPAddr).Port
+	this := &udpProxy{mapping: m, sock: sock, dial: dial, flows: make(map[string]net.Conn)}
+	go this.serve()
+	return this, nil
+}
+
+func (this *udpProxy) Mapping() Mapping {
+	return this.mapping
+}
+
+// Relays the datagrams of the clients to the container until the proxy is closed
+func (this *udpProxy) serve() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, client, err := this.sock.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("Proxy [ %s ]: [ %s ]", this.mapping, err)
+			}
+			return
+		}
+		flow, err := this.flow(client)
+		if err != nil {
+			log.Debugf("Proxy [ %s ]: [ %s ]", this.mapping, err)
+			continue
+		}
+		flow.SetReadDeadline(time.Now().Add(UDPTimeout))
+		flow.Write(buf[:n])
+	}
+}
+
+// Returns the flow of a client, a new one is connected to the container for new clients
+func (this *udpProxy) flow(client *net.UDPAddr) (net.Conn, error) {
+	this.mutex.Lock()
+	flow := this.flows[client.String()]
+	this.mutex.Unlock()
+	if flow != nil {
+		return flow, nil
+	}
+
+	flow, err := this.dial("udp")
+	if err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		flow.Close()
+		return nil, net.ErrClosed
+	}
+	this.flows[client.String()] = flow
+	go this.reply(client, flow)
+	return flow, nil
+}
+
+// Relays the replies of the container to a client, until the flow stays idle for UDPTimeout
+func (this *udpProxy) reply(client *net.UDPAddr, flow net.Conn) {
+	defer func() {
+		this.mutex.Lock()
+		delete(this.flows, client.String())
+		this.mutex.Unlock()
+		flow.Close()
+	}()
+	buf := make([]byte, udpBufSize)
+	for {
+		flow.SetReadDeadline(time.Now().Add(UDPTimeout))
+		n, err := flow.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := this.sock.WriteToUDP(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+func (this *udpProxy) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.closed = true
+	for _, flow := range this.flows {
+		flow.Close()
+	}
+	log.Infof("Unpublished [ %s ]", this.mapping)
+	return this.sock.Close()
+}
@@ -0,0 +1,546 @@
+package vdenet
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"phocs/vde_plug_docker/dhcp"
+	"phocs/vde_plug_docker/dns"
+	"phocs/vde_plug_docker/endpoint"
+	"phocs/vde_plug_docker/portmap"
+	"phocs/vde_plug_docker/vdeplug"
+	"phocs/vde_plug_docker/vdeswitch"
+
+	"github.com/docker/libnetwork/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read-only view of a network served by the admin API
+type NetworkStatus struct {
+	ID          string `json:"ID"`
+	Sock        string `json:"Sock"`
+	IfPrefix    string `json:"IfPrefix"`
+	IPv4Pool    string `json:"IPv4Pool"`
+	IPv4Gateway string `json:"IPv4Gateway"`
+	IPv6Pool    string `json:"IPv6Pool"`
+	IPv6Gateway string `json:"IPv6Gateway"`
+	Managed     bool   `json:"Managed"`
+	Switch      string `json:"Switch"`
+	Uplink      string `json:"Uplink"`
+	Vlan        uint16 `json:"Vlan,omitempty"`
+	MTU         int    `json:"MTU,omitempty"`
+
+	// gateway TAP device on the host, with the state of its plug
+	Gateway     string `json:"Gateway,omitempty"`
+	HostGateway string `json:"HostGateway,omitempty"`
+	HostPlugged bool   `json:"HostPlugged,omitempty"`
+	Masquerade  bool   `json:"Masquerade,omitempty"`
+
+	// range reserved to the DHCP server and its leases
+	DHCPRange string       `json:"DHCPRange,omitempty"`
+	Leases    []dhcp.Lease `json:"Leases,omitempty"`
+
+	// address of the DNS responder and the names it answers, of the containers of every host
+	DNS        string       `json:"DNS,omitempty"`
+	DNSDomain  string       `json:"DNSDomain,omitempty"`
+	DNSRecords []dns.Record `json:"DNSRecords,omitempty"`
+
+	// rate limits and impairments of the endpoints, unless overridden
+	Limits endpoint.Limits `json:"Limits"`
+	Netem  endpoint.Netem  `json:"Netem"`
+
+	// endpoints of the network, ordered by ID
+	Endpoints []*EndpointStatus `json:"Endpoints"`
+}
+
+// Read-only view of an endpoint served by the admin API, with the live state of its plug
+type EndpointStatus struct {
+	ID          string `json:"ID"`
+	NetworkID   string `json:"NetworkID"`
+	IfName      string `json:"IfName"`
+	SandboxKey  string `json:"SandboxKey"`
+	IPv4Address string `json:"IPv4Address"`
+	IPv6Address string `json:"IPv6Address"`
+	MacAddress  string `json:"MacAddress"`
+	Detached    bool   `json:"Detached"`
+
+	// rate limits and impairments of the plug
+	Limits endpoint.Limits `json:"Limits"`
+	Netem  endpoint.Netem  `json:"Netem"`
+
+	// ports of the container published on the host, not all of them have a running proxy if the
+	// host ports were taken when they were published again after a restart (gc tries again)
+	Ports          []portmap.Mapping `json:"Ports,omitempty"`
+	PortsPublished bool              `json:"PortsPublished"`
+
+	// true while the plug has a working connection to the VDE network
+	Plugged  bool              `json:"Plugged"`
+	Counters endpoint.Counters `json:"Counters"`
+	Events   []endpoint.Event  `json:"Events"`
+}
+
+// Returns the status of every network, ordered by ID
+func (this *Driver) NetworksStatus() []*NetworkStatus {
+	// locks Driver read
+	this.mutex.RLock()
+
+	// unlock driver read when functions ends
+	defer this.mutex.RUnlock()
+
+	list := make([]*NetworkStatus, 0, len(this.Networks))
+	for _, nwkey := range sortedIDs(this.Networks) {
+		list = append(list, this.networkStatus(nwkey))
+	}
+	return list
+}
+
+// Returns the status of the network with the given ID, or unique ID prefix
+func (this *Driver) NetworkStatus(id string) (*NetworkStatus, error) {
+	// locks Driver read
+	this.mutex.RLock()
+
+	// unlock driver read when functions ends
+	defer this.mutex.RUnlock()
+
+	nwkey, err := this.lookupNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	return this.networkStatus(nwkey), nil
+}
+
+// Returns the status of the endpoint with the given ID, or unique ID prefix
+func (this *Driver) EndpointStatus(id string) (*EndpointStatus, error) {
+	// locks Driver read
+	this.mutex.RLock()
+
+	// unlock driver read when functions ends
+	defer this.mutex.RUnlock()
+
+	nwkey, epkey, err := this.lookupEndpoint(id)
+	if err != nil {
+		return nil, err
+	}
+	return endpointStatus(nwkey, epkey, this.Networks[nwkey].Endpoints[epkey]), nil
+}
+
+// Stops the plug of a joined endpoint and plugs it again to the VNL of its network,
+// it also plugs back an endpoint detached by DetachEndpoint
+func (this *Driver) ReplugEndpoint(id string) error {
+	log.Debugf("Admin ReplugEndpoint: [ %s ]", id)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, epkey, err := this.lookupEndpoint(id)
+	if err != nil {
+		return err
+	}
+	nw := this.Networks[nwkey]
+	ep := nw.Endpoints[epkey]
+
+	// the TAP device of the endpoint is inside the sandbox only after the join
+	if ep.SandboxKey == "" {
+		return types.BadRequestErrorf("Endpoint %s is not joined to a sandbox.", epkey)
+	}
+
+	ep.LinkPlugStop()
+	if err := ep.LinkReplugTo(nw.Sock); err != nil {
+		return types.InternalErrorf("Failed replug of endpoint %s: %s", epkey, err)
+	}
+	ep.Detached = false
+
+	// saves driver in datastore
+	_ = this.store.Store(this)
+	return nil
+}
+
+// Stops the plug of an endpoint, the container keeps its interface but is disconnected from the VDE network
+// until the endpoint is replugged
+func (this *Driver) DetachEndpoint(id string) error {
+	log.Debugf("Admin DetachEndpoint: [ %s ]", id)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, epkey, err := this.lookupEndpoint(id)
+	if err != nil {
+		return err
+	}
+	ep := this.Networks[nwkey].Endpoints[epkey]
+
+	// error if there is nothing to detach
+	if ep.SandboxKey == "" {
+		return types.BadRequestErrorf("Endpoint %s is not joined to a sandbox.", epkey)
+	}
+
+	ep.LinkPlugStop()
+	ep.Detached = true
+
+	// saves driver in datastore
+	_ = this.store.Store(this)
+	return nil
+}
+
+// Changes the impairments of an endpoint with the netem options in opt, on top of the current ones,
+// the plug applies them at once. Returns the new impairments
+func (this *Driver) SetEndpointNetem(id string, opt map[string]interface{}) (*endpoint.Netem, error) {
+	log.Debugf("Admin SetEndpointNetem: [ %s ] [ %+v ]", id, opt)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, epkey, err := this.lookupEndpoint(id)
+	if err != nil {
+		return nil, err
+	}
+	ep := this.Networks[nwkey].Endpoints[epkey]
+	netem, err := endpoint.ParseNetem(opt, ep.Netem)
+	if err != nil {
+		return nil, types.BadRequestErrorf("Invalid network emulation: %s.", err)
+	}
+	ep.SetNetem(netem)
+
+	// saves driver in datastore
+	_ = this.store.Store(this)
+	return &netem, nil
+}
+
+// Changes the impairments of a network with the netem options in opt, on top of the current ones,
+// the same changes are applied to all its endpoints. Returns the new impairments of the network
+func (this *Driver) SetNetworkNetem(id string, opt map[string]interface{}) (*endpoint.Netem, error) {
+	log.Debugf("Admin SetNetworkNetem: [ %s ] [ %+v ]", id, opt)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, err := this.lookupNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	nw := this.Networks[nwkey]
+	netem, err := endpoint.ParseNetem(opt, nw.Netem)
+	if err != nil {
+		return nil, types.BadRequestErrorf("Invalid network emulation: %s.", err)
+	}
+
+	// the endpoints keep the impairments they override, unless opt changes them
+	netems := make(map[string]endpoint.Netem, len(nw.Endpoints))
+	for epkey, ep := range nw.Endpoints {
+		if netems[epkey], err = endpoint.ParseNetem(opt, ep.Netem); err != nil {
+			return nil, types.BadRequestErrorf("Invalid network emulation of endpoint %s: %s.", epkey, err)
+		}
+	}
+	nw.Netem = netem
+	for epkey, ep := range nw.Endpoints {
+		ep.SetNetem(netems[epkey])
+	}
+
+	// saves driver in datastore
+	_ = this.store.Store(this)
+	return &netem, nil
+}
+
+// Changes the VNL of a network and plugs its joined endpoints to the new one,
+// for a network with an embedded switch it changes the uplink of the switch
+func (this *Driver) MoveNetwork(id string, sock string) error {
+	log.Debugf("Admin MoveNetwork: [ %s ] [ %s ]", id, sock)
+
+	// error if socket is missing
+	if sock == "" {
+		return types.BadRequestErrorf("Sock URL miss.")
+	}
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, err := this.lookupNetwork(id)
+	if err != nil {
+		return err
+	}
+	nw := this.Networks[nwkey]
+
+	// the frames of the network must fit the new transport
+	if max := maxMTU(sock, nw.Vlan); nw.MTU > max {
+		return types.BadRequestErrorf("MTU %d exceeds the %d bytes carried by %s.", nw.MTU, max, sock)
+	}
+
+	// open the new VNL once, so that a wrong sock leaves the network untouched
+	conn, err := vdeplug.Open(sock)
+	if err != nil {
+		return types.BadRequestErrorf("Failed open of %s: %s", sock, err)
+	}
+	conn.Close()
+
+	// the endpoints of an embedded switch stay plugged to it, the switch moves to the new uplink
+	if sw, ok := this.switches[nwkey].(*vdeswitch.Embedded); ok && nw.Managed && nw.Switch == SwitchEmbedded {
+		log.Infof("Admin MoveNetwork: [ %s ] uplink from [ %s ] to [ %s ]", nwkey, nw.Uplink, sock)
+		sw.SetUplink(sock)
+		nw.Uplink = sock
+		_ = this.store.Store(this)
+		return nil
+	}
+
+	log.Infof("Admin MoveNetwork: [ %s ] from [ %s ] to [ %s ]", nwkey, nw.Sock, sock)
+	nw.Sock = sock
+
+	// plug the running containers to the new VNL, the detached ones stay detached
+	var failed []string
+	if gw := nw.HostGateway; gw != nil {
+		gw.LinkPlugStop()
+		if err := gw.LinkPlugTo(sock); err != nil {
+			log.Warnf("Admin MoveNetwork host gateway [ %s ]: [ %s ]", gw.IfName, err)
+			failed = append(failed, gw.IfName)
+		}
+	}
+	for _, epkey := range sortedIDs(nw.Endpoints) {
+		ep := nw.Endpoints[epkey]
+		if ep.SandboxKey == "" || ep.Detached {
+			continue
+		}
+		ep.LinkPlugStop()
+		if err := ep.LinkReplugTo(sock); err != nil {
+			log.Warnf("Admin MoveNetwork endpoint [ %s ]: [ %s ]", epkey, err)
+			failed = append(failed, epkey)
+		}
+	}
+
+	// the DHCP server and the DNS responder follow the network to the new VNL
+	if nw.DHCP != nil {
+		this.stopDHCP(nwkey)
+		if err := this.startDHCP(nwkey, nw); err != nil {
+			log.Warnf("Admin MoveNetwork DHCP server [ %s ]: [ %s ]", nwkey, err)
+			failed = append(failed, "dhcp")
+		}
+	}
+	if nw.DNS != nil {
+		this.stopDNS(nwkey)
+		if err := this.startDNS(nwkey, nw); err != nil {
+			log.Warnf("Admin MoveNetwork DNS responder [ %s ]: [ %s ]", nwkey, err)
+			failed = append(failed, "dns")
+		}
+	}
+
+	// the vde_switch of a managed network is no longer used
+	if nw.Managed {
+		this.stopSwitch(nwkey)
+		nw.Managed, nw.Switch = false, ""
+	}
+
+	// saves driver in datastore
+	_ = this.store.Store(this)
+
+	if len(failed) != 0 {
+		return types.InternalErrorf("Network %s moved to %s, failed replug of endpoints %s.", nwkey, sock, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Removes what is left of the containers that are gone without leaving their networks,
+// returns a description of each cleanup
+func (this *Driver) GC() []string {
+	log.Debugf("Admin GC")
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	report := make([]string, 0)
+	for _, nwkey := range sortedIDs(this.Networks) {
+		nw := this.Networks[nwkey]
+		collected := len(report)
+		for _, epkey := range sortedIDs(nw.Endpoints) {
+			ep := nw.Endpoints[epkey]
+			switch {
+			// the sandbox has been destroyed, along with the TAP device inside it
+			case ep.SandboxKey != "":
+				if _, err := os.Stat(ep.SandboxKey); err == nil {
+					// the ports that could not be published again after a restart are tried again
+					if !ep.PortsPublished() {
+						if err := ep.RepublishPorts(); err != nil {
+							report = append(report, fmt.Sprintf("endpoint %s: %s", epkey, err))
+						} else {
+							report = append(report, fmt.Sprintf("endpoint %s: published again %v", epkey, ep.Ports))
+						}
+					}
+					continue
+				}
+				ep.LinkPlugStop()
+				ep.LinkDel()
+				report = append(report, fmt.Sprintf("endpoint %s: sandbox %s is gone", epkey, ep.SandboxKey))
+				for _, m := range ep.Ports {
+					report = append(report, fmt.Sprintf("endpoint %s: unpublished %s", epkey, m))
+				}
+				ep.UnpublishPorts()
+				ep.SandboxKey = ""
+				ep.Detached = false
+
+			// the TAP device of a failed join is still on the host
+			case ep.LinkOnHost():
+				ep.LinkDel()
+				report = append(report, fmt.Sprintf("endpoint %s: removed TAP device %s", epkey, ep.IfName))
+			}
+		}
+
+		// the containers of the collected endpoints leave the DNS responder of the network
+		if len(report) != collected {
+			this.refreshNetworkDNS(nwkey)
+		}
+	}
+
+	// pools bound to networks that no longer exist
+	for _, poolkey := range sortedIDs(this.Pools) {
+		pool := this.Pools[poolkey]
+		if pool.NetworkID != "" && this.Networks[pool.NetworkID] == nil {
+			report = append(report, fmt.Sprintf("pool %s: unbound from missing network %s", poolkey, pool.NetworkID))
+			pool.NetworkID = ""
+		}
+	}
+
+	// control directories of the switches of networks that no longer exist
+	dirs, _ := os.ReadDir(vdeswitch.RunDir)
+	for _, dir := range dirs {
+		if nw := this.Networks[dir.Name()]; nw == nil || !nw.Managed || nw.Switch != SwitchProcess {
+			os.RemoveAll(vdeswitch.Dir(dir.Name()))
+			report = append(report, fmt.Sprintf("switch %s: removed stale directory", dir.Name()))
+		}
+	}
+
+	// saves driver in datastore
+	if len(report) != 0 {
+		_ = this.store.Store(this)
+	}
+	return report
+}
+
+// Returns the status of a network, the driver mutex must be held
+func (this *Driver) networkStatus(nwkey string) *NetworkStatus {
+	nw := this.Networks[nwkey]
+	status := &NetworkStatus{
+		ID:          nwkey,
+		Sock:        nw.Sock,
+		IfPrefix:    nw.IfPrefix,
+		IPv4Pool:    nw.IPv4Pool,
+		IPv4Gateway: nw.IPv4Gateway,
+		IPv6Pool:    nw.IPv6Pool,
+		IPv6Gateway: nw.IPv6Gateway,
+		Managed:     nw.Managed,
+		Switch:      nw.Switch,
+		Uplink:      nw.Uplink,
+		Vlan:        nw.Vlan,
+		MTU:         nw.MTU,
+		Limits:      nw.Limits,
+		Netem:       nw.Netem,
+		Gateway:     nw.Gateway,
+		Masquerade:  nw.Masquerade,
+		Endpoints:   make([]*EndpointStatus, 0, len(nw.Endpoints)),
+	}
+	if nw.HostGateway != nil {
+		status.HostGateway, status.HostPlugged = nw.HostGateway.IfName, nw.HostGateway.Plugged()
+	}
+	if nw.DHCP != nil && nw.DHCP.Leases != nil {
+		status.DHCPRange, status.Leases = nw.DHCP.Range, nw.DHCP.Leases.List()
+	}
+	if nw.DNS != nil {
+		status.DNS, status.DNSDomain = nw.DNS.IP, nw.DNS.Domain
+		if srv := this.dnsServers[nwkey]; srv != nil {
+			status.DNSRecords = srv.responder.Records()
+		}
+	}
+	for _, epkey := range sortedIDs(nw.Endpoints) {
+		status.Endpoints = append(status.Endpoints, endpointStatus(nwkey, epkey, nw.Endpoints[epkey]))
+	}
+	return status
+}
+
+// Returns the status of an endpoint
+func endpointStatus(nwkey, epkey string, ep *endpoint.EndpointStat) *EndpointStatus {
+	return &EndpointStatus{
+		ID:             epkey,
+		NetworkID:      nwkey,
+		IfName:         ep.IfName,
+		SandboxKey:     ep.SandboxKey,
+		IPv4Address:    ep.IPv4Address,
+		IPv6Address:    ep.IPv6Address,
+		MacAddress:     ep.MacAddress,
+		Detached:       ep.Detached,
+		Limits:         ep.Limits,
+		Netem:          ep.Netem,
+		Ports:          ep.Ports,
+		PortsPublished: ep.SandboxKey != "" && ep.PortsPublished(),
+		Plugged:        ep.Plugged(),
+		Counters:       ep.Counters(),
+		Events:         ep.Events(),
+	}
+}
+
+// Returns the ID of the network matching id, either the full ID or a unique prefix as docker accepts
+func (this *Driver) lookupNetwork(id string) (string, error) {
+	if this.Networks[id] != nil {
+		return id, nil
+	}
+	var found []string
+	for nwkey := range this.Networks {
+		if id != "" && strings.HasPrefix(nwkey, id) {
+			found = append(found, nwkey)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", types.NotFoundErrorf("Network %s not found.", id)
+	case 1:
+		return found[0], nil
+	}
+	return "", types.BadRequestErrorf("Network %s is ambiguous.", id)
+}
+
+// Returns the IDs of the endpoint matching id and of its network, id is either the full ID or a unique prefix
+func (this *Driver) lookupEndpoint(id string) (string, string, error) {
+	var found [][2]string
+	for nwkey, nw := range this.Networks {
+		if nw.Endpoints[id] != nil {
+			return nwkey, id, nil
+		}
+		for epkey := range nw.Endpoints {
+			if id != "" && strings.HasPrefix(epkey, id) {
+				found = append(found, [2]string{nwkey, epkey})
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", "", types.NotFoundErrorf("Endpoint %s not found.", id)
+	case 1:
+		return found[0][0], found[0][1], nil
+	}
+	return "", "", types.BadRequestErrorf("Endpoint %s is ambiguous.", id)
+}
+
+// Returns the keys of a map of networks or endpoints in order
+func sortedIDs[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,220 @@
+package vdenet
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"phocs/vde_plug_docker/capture"
+	"phocs/vde_plug_docker/endpoint"
+
+	"github.com/docker/libnetwork/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Starts a packet capture of the frames forwarded by the plug of an endpoint, written in pcapng format to out.
+// output describes out in the status of the capture, out is closed when the capture stops
+func (this *Driver) CaptureEndpoint(id string, out io.WriteCloser, output string, opts capture.Options) (*capture.Session, error) {
+	log.Debugf("Admin CaptureEndpoint: [ %s ] [ %s ] [ %+v ]", id, output, opts)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, epkey, err := this.lookupEndpoint(id)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	ep := this.Networks[nwkey].Endpoints[epkey]
+
+	// frames are forwarded only by the plugs of the joined endpoints
+	if ep.SandboxKey == "" {
+		out.Close()
+		return nil, types.BadRequestErrorf("Endpoint %s is not joined to a sandbox.", epkey)
+	}
+
+	session, err := this.newCapture("endpoint "+epkey, output, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	tap, err := session.AddInterface(ep.IfName, fmt.Sprintf("endpoint %s of network %s", epkey, nwkey))
+	if err != nil {
+		session.Stop(err)
+		go this.forgetCapture(session, func() {})
+		return nil, types.InternalErrorf("Failed capture start: %s", err)
+	}
+	ep.Taps().Add(tap)
+	go this.forgetCapture(session, func() { ep.Taps().Remove(tap) })
+	return session, nil
+}
+
+// Capture of all the endpoints of a network, the endpoints joining while it runs are added to it
+type networkCapture struct {
+	network string
+	session *capture.Session
+
+	// taps attached to the plugs of the endpoints, the keys are the endpoint IDs
+	taps map[string]*endpointTap
+}
+
+type endpointTap struct {
+	endpoint *endpoint.EndpointStat
+	tap      *capture.Tap
+}
+
+// Starts a packet capture of the frames forwarded by the plugs of all the endpoints of a network,
+// written in pcapng format to out with an interface for every endpoint, named after its container and its IfName.
+// output describes out in the status of the capture, out is closed when the capture stops
+func (this *Driver) CaptureNetwork(id string, out io.WriteCloser, output string, opts capture.Options) (*capture.Session, error) {
+	log.Debugf("Admin CaptureNetwork: [ %s ] [ %s ] [ %+v ]", id, output, opts)
+
+	// ask the names of the containers before locking, docker may be waiting on the driver
+	names := containerNames()
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	nwkey, err := this.lookupNetwork(id)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	session, err := this.newCapture("network "+nwkey, output, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	nc := &networkCapture{network: nwkey, session: session, taps: make(map[string]*endpointTap)}
+
+	// frames are forwarded only by the plugs of the joined endpoints
+	nw := this.Networks[nwkey]
+	for _, epkey := range sortedIDs(nw.Endpoints) {
+		if ep := nw.Endpoints[epkey]; ep.SandboxKey != "" {
+			if err = nc.add(epkey, ep, names[epkey]); err != nil {
+				break
+			}
+		}
+	}
+	this.networkCaptures[session.ID()] = nc
+	go this.forgetCapture(session, nc.untap)
+	if err != nil {
+		session.Stop(err)
+		return nil, types.InternalErrorf("Failed capture start: %s", err)
+	}
+	return session, nil
+}
+
+// Adds a joined endpoint to the network captures of its network, the driver mutex must be held
+func (this *Driver) captureJoined(nwkey, epkey string, ep *endpoint.EndpointStat) {
+	for _, nc := range this.networkCaptures {
+		if nc.network != nwkey || nc.taps[epkey] != nil {
+			continue
+		}
+		// the container is not known to docker until the join completes
+		if err := nc.add(epkey, ep, ""); err != nil {
+			log.Warnf("Capture [ %s ] of endpoint [ %s ]: [ %s ]", nc.session.ID(), epkey, err)
+		}
+	}
+}
+
+// Stops the network captures of a network, the driver mutex must be held
+func (this *Driver) stopNetworkCaptures(nwkey string) {
+	for _, nc := range this.networkCaptures {
+		if nc.network == nwkey {
+			nc.session.Stop(nil)
+		}
+	}
+}
+
+// Adds an interface for an endpoint to the capture and attaches it to the plug of the endpoint,
+// the interface is named container/IfName, or by the short endpoint ID if the container is unknown
+func (this *networkCapture) add(epkey string, ep *endpoint.EndpointStat, container string) error {
+	if container == "" {
+		container = epkey
+		if len(container) > 12 {
+			container = container[:12]
+		}
+	}
+	tap, err := this.session.AddInterface(container+"/"+ep.IfName, fmt.Sprintf("endpoint %s of network %s", epkey, this.network))
+	if err != nil {
+		return err
+	}
+	ep.Taps().Add(tap)
+	this.taps[epkey] = &endpointTap{endpoint: ep, tap: tap}
+	return nil
+}
+
+// Detaches the capture from the plugs of the endpoints
+func (this *networkCapture) untap() {
+	for _, et := range this.taps {
+		et.endpoint.Taps().Remove(et.tap)
+	}
+}
+
+// Returns the status of the running captures, oldest first
+func (this *Driver) Captures() []capture.Status {
+	// locks Driver read
+	this.mutex.RLock()
+
+	// unlock driver read when functions ends
+	defer this.mutex.RUnlock()
+
+	list := make([]capture.Status, 0, len(this.captures))
+	for _, session := range this.captures {
+		list = append(list, session.Status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// Stops a running capture and waits for its output to be closed
+func (this *Driver) StopCapture(id string) error {
+	log.Debugf("Admin StopCapture: [ %s ]", id)
+
+	// locks Driver read
+	this.mutex.RLock()
+	session := this.captures[id]
+	this.mutex.RUnlock()
+
+	if session == nil {
+		return types.NotFoundErrorf("Capture %s not found.", id)
+	}
+	session.Stop(nil)
+	<-session.Done()
+	return nil
+}
+
+// Creates a capture session with a new ID, the driver mutex must be held
+func (this *Driver) newCapture(target, output string, out io.WriteCloser, opts capture.Options) (*capture.Session, error) {
+	this.captureID++
+	session, err := capture.NewSession(strconv.Itoa(this.captureID), target, output, out, opts)
+	if err != nil {
+		out.Close()
+		return nil, types.BadRequestErrorf("Failed capture start: %s", err)
+	}
+	this.captures[session.ID()] = session
+	return session, nil
+}
+
+// Waits for a capture to stop, then removes it from the running ones and detaches it from the plugs
+func (this *Driver) forgetCapture(session *capture.Session, untap func()) {
+	err := session.Wait()
+
+	// lock driver mutex
+	this.mutex.Lock()
+	delete(this.captures, session.ID())
+	delete(this.networkCaptures, session.ID())
+	this.mutex.Unlock()
+
+	// the network captures are no longer changed once forgotten
+	untap()
+
+	status := session.Status()
+	log.Infof("Capture [ %s ] of [ %s ] to [ %s ] stopped: [ %d packets, %d drops, %v ]", status.ID, status.Target, status.Output, status.Packets, status.Drops, err)
+}
@@ -0,0 +1,73 @@
+package vdenet
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// socket of the docker engine API, asked for the names of the containers of the endpoints
+var DockerSock = "/var/run/docker.sock"
+
+// timeout of the requests to the docker engine API
+const DockerTimeout = 2 * time.Second
+
+// container as listed by the docker engine API, only the fields used here
+type container struct {
+	Names           []string `json:"Names"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			EndpointID string `json:"EndpointID"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Returns the names of the containers of the endpoints, the keys are the endpoint IDs.
+// Docker does not tell the plugins which container joins an endpoint, the names are asked to the docker engine,
+// the map is empty if it is not reachable. Must not be called holding the driver mutex, docker may be waiting on it
+func containerNames() map[string]string {
+	names := make(map[string]string)
+	client := http.Client{
+		Timeout: DockerTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", DockerSock)
+			},
+		},
+	}
+
+	// the host is ignored, the request goes to the docker socket
+	response, err := client.Get("http://docker/containers/json?all=1")
+	if err != nil {
+		log.Debugf("Container names: [ %s ]", err)
+		return names
+	}
+	defer response.Body.Close()
+
+	var containers []container
+	if response.StatusCode != http.StatusOK {
+		log.Debugf("Container names: [ %s ]", response.Status)
+		return names
+	}
+	if err := json.NewDecoder(response.Body).Decode(&containers); err != nil {
+		log.Debugf("Container names: [ %s ]", err)
+		return names
+	}
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		for _, settings := range c.NetworkSettings.Networks {
+			if settings.EndpointID != "" {
+				names[settings.EndpointID] = strings.TrimPrefix(c.Names[0], "/")
+			}
+		}
+	}
+	return names
+}
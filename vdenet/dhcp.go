@@ -0,0 +1,263 @@
+package vdenet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"phocs/vde_plug_docker/dhcp"
+	"phocs/vde_plug_docker/endpoint"
+
+	"github.com/docker/go-plugins-helpers/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// DHCPv4 server of a network, leasing the addresses reserved for the peers outside docker
+type DHCPStat struct {
+	// range of the pool reserved for the peers as first-last, the server takes the first address
+	Range string `json:"Range"`
+
+	// MAC address of the server, kept so that the peers renew their leases after a restart
+	MacAddress string `json:"MacAddress"`
+
+	// duration of the leases and DNS servers sent to the peers
+	LeaseTime time.Duration `json:"LeaseTime"`
+	DNS       []string      `json:"DNS,omitempty"`
+
+	Leases *dhcp.Leases `json:"Leases"`
+}
+
+// running DHCP server of a network and the plug attaching it to the VNL
+type dhcpServer struct {
+	server *dhcp.Server
+	frames *os.File
+	plug   *endpoint.Plug
+}
+
+// Returns the DHCP server set by the options dhcp, dhcp-range, dhcp-lease and dhcp-dns, nil if it is disabled.
+// By default the upper half of the pool is reserved for the peers
+func parseDHCP(opt map[string]interface{}, data *network.IPAMData) (*DHCPStat, error) {
+	enabled, err := parseBool(opt, "dhcp")
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	// only vde-ipam keeps the range away from the containers, the default IPAM driver may assign its
+	// addresses and the network driver is not told the --ip-range it assigns them from
+	if data.AddressSpace != LocalAddressSpace && data.AddressSpace != GlobalAddressSpace {
+		return nil, fmt.Errorf("the pool must be assigned by the vde-ipam driver (--ipam-driver vde-ipam), its address space is %s", data.AddressSpace)
+	}
+
+	pool, gateway := data.Pool, data.Gateway
+	_, subnet, err := net.ParseCIDR(pool)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("bad pool %q", pool)
+	}
+	stat := &DHCPStat{MacAddress: endpoint.RandomMacAddr(), LeaseTime: dhcp.LeaseTimeDefault, Leases: dhcp.NewLeases()}
+
+	// upper half of the pool, but the broadcast address
+	if stat.Range, _ = opt["dhcp-range"].(string); stat.Range == "" {
+		ones, bits := subnet.Mask.Size()
+		half := &net.IPNet{IP: lastAddress(subnet).Mask(net.CIDRMask(ones+1, bits)), Mask: net.CIDRMask(ones+1, bits)}
+		stat.Range = half.IP.String() + "-" + previousAddress(lastAddress(subnet)).String()
+	}
+	first, last, err := parseRange(stat.Range)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server and at least one peer, inside the pool
+	gw := net.ParseIP(strings.Split(gateway, "/")[0])
+	switch {
+	case !subnet.Contains(first) || !subnet.Contains(last):
+		return nil, fmt.Errorf("range %s out of pool %s", stat.Range, pool)
+	case first.Equal(subnet.IP) || last.Equal(lastAddress(subnet)):
+		return nil, fmt.Errorf("range %s holds the network or broadcast address", stat.Range)
+	case !(addressLess(first, last)):
+		return nil, fmt.Errorf("range %s holds less than 2 addresses", stat.Range)
+	case gw != nil && !addressLess(gw, first) && !addressLess(last, gw):
+		return nil, fmt.Errorf("range %s holds the gateway %s", stat.Range, gw)
+	}
+
+	if s, _ := opt["dhcp-lease"].(string); s != "" {
+		if stat.LeaseTime, err = time.ParseDuration(s); err != nil || stat.LeaseTime < time.Minute {
+			return nil, fmt.Errorf("bad dhcp-lease %q, it must be at least 1m", s)
+		}
+	}
+	if s, _ := opt["dhcp-dns"].(string); s != "" {
+		for _, dns := range strings.Split(s, ",") {
+			if ip := net.ParseIP(dns); ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("bad dhcp-dns %q", dns)
+			}
+			stat.DNS = append(stat.DNS, dns)
+		}
+	}
+	return stat, nil
+}
+
+// Returns the boolean option key, false if it is missing
+func parseBool(opt map[string]interface{}, key string) (bool, error) {
+	s, _ := opt[key].(string)
+	if s == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("bad %s %q", key, s)
+	}
+	return value, nil
+}
+
+// Returns the first and last address of a range first-last
+func parseRange(s string) (net.IP, net.IP, error) {
+	a, b, _ := strings.Cut(s, "-")
+	first, last := net.ParseIP(strings.TrimSpace(a)).To4(), net.ParseIP(strings.TrimSpace(b)).To4()
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("bad range %q, it must be first-last", s)
+	}
+	return first, last, nil
+}
+
+// Returns true if the address a comes before b
+func addressLess(a, b net.IP) bool {
+	return string(a.To16()) < string(b.To16())
+}
+
+// Returns true if ip is in the range first-last
+func inRange(s string, ip net.IP) bool {
+	first, last, err := parseRange(s)
+	return err == nil && ip != nil && !addressLess(ip, first) && !addressLess(last, ip)
+}
+
+// Returns the address preceding ip
+func previousAddress(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i]--; prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// Starts the DHCP server of a network, attached to its VNL. The addresses of the endpoints and of the gateway are reserved
+func (this *Driver) startDHCP(nwkey string, nw *NetworkStat) error {
+	stat := nw.DHCP
+	if stat.Leases == nil {
+		stat.Leases = dhcp.NewLeases()
+	}
+	first, last, err := parseRange(stat.Range)
+	if err != nil {
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(nw.IPv4Pool)
+	if err != nil {
+		return err
+	}
+	mac, err := net.ParseMAC(stat.MacAddress)
+	if err != nil {
+		return err
+	}
+
+	config := dhcp.Config{
+		IP:        first,
+		MAC:       mac,
+		Mask:      net.CIDRMask(subnet.Mask.Size()),
+		First:     nextAddress(first),
+		Last:      last,
+		Router:    net.ParseIP(strings.Split(nw.IPv4Gateway, "/")[0]),
+		MTU:       nw.MTU,
+		LeaseTime: stat.LeaseTime,
+	}
+	for _, dns := range stat.DNS {
+		config.DNS = append(config.DNS, net.ParseIP(dns))
+	}
+
+	// the peers resolve the containers through the DNS responder of the network, unless dhcp-dns is set
+	if nw.DNS != nil && len(config.DNS) == 0 {
+		config.DNS, config.Domain = []net.IP{net.ParseIP(nw.DNS.IP)}, nw.DNS.Domain
+	}
+
+	// the addresses assigned by docker are never leased
+	if config.Router != nil {
+		stat.Leases.Reserve(config.Router)
+	}
+	if nw.DNS != nil {
+		stat.Leases.Reserve(net.ParseIP(nw.DNS.IP))
+	}
+	for _, ep := range nw.Endpoints {
+		this.reserveAddress(nw, ep)
+	}
+
+	frames, plug, err := endpoint.NewServicePlug("dhcp:"+nwkey[:12], nw.Sock, endpoint.PlugOptions{Vlan: nw.Vlan, MTU: nw.MTU})
+	if err != nil {
+		return err
+	}
+	this.dhcpServers[nwkey] = &dhcpServer{
+		server: dhcp.Start(config, frames, stat.Leases, this.storeLeases),
+		frames: frames,
+		plug:   plug,
+	}
+	return nil
+}
+
+// Stops the DHCP server of a network, if it is running
+func (this *Driver) stopDHCP(nwkey string) {
+	if srv := this.dhcpServers[nwkey]; srv != nil {
+		srv.server.Close()
+		srv.plug.Stop()
+		delete(this.dhcpServers, nwkey)
+	}
+}
+
+// Starts the DHCP servers of the networks loaded from the datastore
+func (this *Driver) startDHCPs() {
+	for nwkey, nw := range this.Networks {
+		if nw.DHCP == nil {
+			continue
+		}
+		if err := this.startDHCP(nwkey, nw); err != nil {
+			log.Warnf("Start DHCP server of network [ %s ]: [ %s ]", nwkey, err)
+		}
+	}
+}
+
+// Reserves the address of an endpoint, a peer holding it loses its lease. vde-ipam never assigns the range,
+// but the networks created by older plugins may have a pool of the default IPAM driver
+func (this *Driver) reserveAddress(nw *NetworkStat, ep *endpoint.EndpointStat) {
+	if nw.DHCP == nil {
+		return
+	}
+	ip, _, err := net.ParseCIDR(ep.IPv4Address)
+	if err != nil {
+		return
+	}
+	if lease := nw.DHCP.Leases.Reserve(ip); lease != nil {
+		log.Warnf("DHCP lease of [ %s ] to [ %s ] dropped, the address is assigned to endpoint [ %s ]", lease.IP, lease.MAC, ep.IfName)
+	}
+}
+
+// Makes the address of an endpoint available to the peers again
+func (this *Driver) unreserveAddress(nw *NetworkStat, ep *endpoint.EndpointStat) {
+	if nw.DHCP == nil {
+		return
+	}
+	if ip, _, err := net.ParseCIDR(ep.IPv4Address); err == nil {
+		nw.DHCP.Leases.Unreserve(ip)
+	}
+}
+
+// Persists the leases changed by a DHCP server
+func (this *Driver) storeLeases() {
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	_ = this.store.Store(this)
+}
@@ -0,0 +1,230 @@
+package vdenet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"phocs/vde_plug_docker/dns"
+	"phocs/vde_plug_docker/endpoint"
+
+	"github.com/docker/go-plugins-helpers/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// domain of the names answered by the DNS responders when dns-domain is missing
+const DNSDomainDefault = "vde"
+
+// name of the auxiliary address of the DNS responder, set with --aux-address dns=<ip>
+const DNSAuxAddress = "dns"
+
+// DNS responder of a network, answering the names of the containers of every host attached to its VNL
+type DNSStat struct {
+	// address of the responder, the same on every host
+	IP string `json:"IP"`
+
+	// domain of the names, they are also answered without it
+	Domain string `json:"Domain"`
+
+	// MAC address of the responder of this host
+	MacAddress string `json:"MacAddress"`
+}
+
+// running DNS responder of a network, the plug attaching it to the VNL and the goroutine refreshing its records
+type dnsServer struct {
+	responder *dns.Responder
+	frames    *os.File
+	plug      *endpoint.Plug
+
+	// signaled when the endpoints of the network change, closed when the responder is stopped
+	kick chan struct{}
+	done chan struct{}
+}
+
+// Returns the DNS responder set by the options dns and dns-domain, nil if it is disabled. With dns=true
+// the responder takes the auxiliary address named dns, otherwise dns is its address
+func parseDNS(opt map[string]interface{}, data *network.IPAMData) (*DNSStat, error) {
+	s, _ := opt["dns"].(string)
+	if s == "" || s == "false" {
+		return nil, nil
+	}
+	aux, _ := data.AuxAddresses[DNSAuxAddress].(string)
+	if s == "true" {
+		if s = aux; s == "" {
+			return nil, fmt.Errorf("dns=true needs --aux-address %s=<ip>", DNSAuxAddress)
+		}
+	}
+	ip := net.ParseIP(strings.Split(s, "/")[0]).To4()
+	_, subnet, err := net.ParseCIDR(data.Pool)
+	if ip == nil || err != nil || !subnet.Contains(ip) {
+		return nil, fmt.Errorf("bad dns %q, it must be an IPv4 address of pool %s", s, data.Pool)
+	}
+	if gw := net.ParseIP(strings.Split(data.Gateway, "/")[0]); ip.Equal(gw) {
+		return nil, fmt.Errorf("dns %s is the gateway", ip)
+	}
+	if !ip.Equal(net.ParseIP(strings.Split(aux, "/")[0])) {
+		log.Warnf("DNS responder [ %s ] is not an auxiliary address, docker may assign it to a container: use --aux-address %s=%s", ip, DNSAuxAddress, ip)
+	}
+
+	domain, _ := opt["dns-domain"].(string)
+	if domain = strings.ToLower(strings.Trim(domain, ".")); domain == "" {
+		domain = DNSDomainDefault
+	}
+	return &DNSStat{IP: ip.String(), Domain: domain, MacAddress: endpoint.RandomMacAddr()}, nil
+}
+
+// Starts the DNS responder of a network, attached to its VNL
+func (this *Driver) startDNS(nwkey string, nw *NetworkStat) error {
+	mac, err := net.ParseMAC(nw.DNS.MacAddress)
+	if err != nil {
+		return err
+	}
+	frames, plug, err := endpoint.NewServicePlug("dns:"+nwkey[:12], nw.Sock, endpoint.PlugOptions{Vlan: nw.Vlan, MTU: nw.MTU})
+	if err != nil {
+		return err
+	}
+	mtu := nw.MTU
+	if mtu == 0 {
+		mtu = MTUDefault
+	}
+
+	// the host ID tells the responders apart in the announcements, a restarted plugin is a new host
+	id := make([]byte, 4)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+
+	srv := &dnsServer{
+		responder: dns.Start(dns.Config{
+			IP:       net.ParseIP(nw.DNS.IP),
+			MAC:      mac,
+			Domain:   nw.DNS.Domain,
+			Host:     hostname + "-" + hex.EncodeToString(id),
+			Interval: dns.IntervalDefault,
+			MTU:      mtu,
+		}, frames),
+		frames: frames,
+		plug:   plug,
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	this.dnsServers[nwkey] = srv
+	go this.refreshDNS(nwkey, srv)
+	srv.refresh()
+	return nil
+}
+
+// Stops the DNS responder of a network, if it is running
+func (this *Driver) stopDNS(nwkey string) {
+	if srv := this.dnsServers[nwkey]; srv != nil {
+		close(srv.done)
+		srv.responder.Close()
+		srv.plug.Stop()
+		delete(this.dnsServers, nwkey)
+	}
+}
+
+// Starts the DNS responders of the networks loaded from the datastore
+func (this *Driver) startDNSs() {
+	for nwkey, nw := range this.Networks {
+		if nw.DNS == nil {
+			continue
+		}
+		if err := this.startDNS(nwkey, nw); err != nil {
+			log.Warnf("Start DNS responder of network [ %s ]: [ %s ]", nwkey, err)
+		}
+	}
+}
+
+// Asks the DNS responder of a network to refresh its records, the endpoints of the network changed
+func (this *Driver) refreshNetworkDNS(nwkey string) {
+	if srv := this.dnsServers[nwkey]; srv != nil {
+		srv.refresh()
+	}
+}
+
+func (this *dnsServer) refresh() {
+	select {
+	case this.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Refreshes the records of the containers of this host joined to a network, when its endpoints change and every interval.
+// The names of the containers are asked to docker without holding the driver mutex
+func (this *Driver) refreshDNS(nwkey string, srv *dnsServer) {
+	ticker := time.NewTicker(dns.IntervalDefault)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.done:
+			return
+		case <-ticker.C:
+		case <-srv.kick:
+			// docker tells the name of the container once the join is over
+			select {
+			case <-srv.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		names := containerNames()
+
+		// lock driver mutex
+		this.mutex.RLock()
+		nw := this.Networks[nwkey]
+		if nw == nil {
+			this.mutex.RUnlock()
+			continue
+		}
+		records, clients := dnsRecords(nw, names)
+		this.mutex.RUnlock()
+
+		srv.responder.SetLocal(records, clients)
+	}
+}
+
+// Returns the records of the containers joined to a network and the MAC addresses of the hosts answered:
+// the containers, the host gateway and the peers of the DHCP server
+func dnsRecords(nw *NetworkStat, names map[string]string) ([]dns.Record, []net.HardwareAddr) {
+	var records []dns.Record
+	var clients []net.HardwareAddr
+	for epkey, ep := range nw.Endpoints {
+		if ep.SandboxKey == "" {
+			continue
+		}
+		if mac, err := net.ParseMAC(ep.MacAddress); err == nil {
+			clients = append(clients, mac)
+		}
+
+		// the names with dots can't be told apart from the domain
+		name := strings.ToLower(names[epkey])
+		if name == "" || strings.Contains(name, ".") {
+			continue
+		}
+		record := dns.Record{Name: name}
+		if ip, _, err := net.ParseCIDR(ep.IPv4Address); err == nil {
+			record.IPv4 = ip.String()
+		}
+		if ip, _, err := net.ParseCIDR(ep.IPv6Address); err == nil {
+			record.IPv6 = ip.String()
+		}
+		records = append(records, record)
+	}
+	if nw.HostGateway != nil {
+		if mac, err := net.ParseMAC(nw.HostGateway.MacAddress); err == nil {
+			clients = append(clients, mac)
+		}
+	}
+	if nw.DHCP != nil && nw.DHCP.Leases != nil {
+		for _, lease := range nw.DHCP.Leases.List() {
+			if mac, err := net.ParseMAC(lease.MAC); err == nil {
+				clients = append(clients, mac)
+			}
+		}
+	}
+	return records, clients
+}
@@ -2,12 +2,19 @@
 package vdenet
 
 import (
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 
+	"phocs/vde_plug_docker/capture"
 	"phocs/vde_plug_docker/datastore"
 	"phocs/vde_plug_docker/endpoint"
+	"phocs/vde_plug_docker/nat"
+	"phocs/vde_plug_docker/portmap"
+	"phocs/vde_plug_docker/vdeplug"
+	"phocs/vde_plug_docker/vdeswitch"
 
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/types"
@@ -19,6 +26,16 @@ type NetworkStat struct {
 	// VDE network socket in VNL syntax (e.g. vxvde://239.1.2.3)
 	Sock string `json:"Sock"`
 
+	// rate limits and impairments of the plugs of the endpoints, unless overridden by the endpoint options
+	Limits endpoint.Limits `json:"Limits"`
+	Netem  endpoint.Netem  `json:"Netem"`
+
+	// 802.1Q VLAN isolating the network from the others sharing its VNL, 0 if the frames are not tagged
+	Vlan uint16 `json:"Vlan,omitempty"`
+
+	// MTU of the TAP devices of the endpoints, 0 for the default one
+	MTU int `json:"MTU,omitempty"`
+
 	// used as the prefix to name the TAP devices associated with the endpoint of this network
 	IfPrefix string `json:"IfPrefix"`
 
@@ -30,6 +47,28 @@ type NetworkStat struct {
 	IPv6Pool    string `json:"IPv6Pool"`
 	IPv6Gateway string `json:"IPv6Gateway"`
 
+	// GatewayHost if the gateway addresses are held by a TAP device on the host plugged to the network
+	Gateway     string                 `json:"Gateway,omitempty"`
+	HostGateway *endpoint.EndpointStat `json:"HostGateway,omitempty"`
+
+	// true if the traffic of the pools leaving the host through its default route is masqueraded
+	Masquerade bool `json:"Masquerade,omitempty"`
+
+	// DHCPv4 server of the peers outside docker, nil if the network has none
+	DHCP *DHCPStat `json:"DHCP,omitempty"`
+
+	// DNS responder of the containers of every host on the network, nil if the network has none
+	DNS *DNSStat `json:"DNS,omitempty"`
+
+	// true if Sock is the VNL of a switch started by the plugin for this network
+	Managed bool `json:"Managed"`
+
+	// kind of the switch of a managed network, SwitchEmbedded or SwitchProcess
+	Switch string `json:"Switch"`
+
+	// VNL the embedded switch is connected to, to reach the peers outside the host
+	Uplink string `json:"Uplink"`
+
 	// key-value pairs where keys are the endpointID and the values are the endpoint struct
 	Endpoints map[string]*endpoint.EndpointStat `json:"Endpoints"`
 }
@@ -42,6 +81,33 @@ type Driver struct {
 
 	// key-value pairs where values are the network struct and the keys are the network ID provided by docker when calling CreateNetwork()
 	Networks map[string]*NetworkStat `json:"Networks"`
+
+	// key-value pairs where values are the address pools managed by the IPAM driver and the keys are the pool IDs
+	Pools map[string]*PoolStat `json:"Pools"`
+
+	// used only in global scope by the swarm manager, key-value pairs where keys are the network IDs
+	// and values are the options allocated for the network and sent to the workers
+	Allocations map[string]map[string]string `json:"Allocations"`
+
+	// network.LocalScope or network.GlobalScope
+	scope string `json:"-"` // ignore
+
+	// switches of the managed networks, the keys are the network IDs
+	switches map[string]vdeswitch.Switch `json:"-"` // ignore
+
+	// running packet captures started through the admin API, the keys are their IDs
+	captures  map[string]*capture.Session `json:"-"` // ignore
+	captureID int                         `json:"-"` // ignore
+
+	// running captures of whole networks, also in captures, the keys are their IDs
+	networkCaptures map[string]*networkCapture `json:"-"` // ignore
+
+	// running DHCP servers and DNS responders, the keys are the network IDs
+	dhcpServers map[string]*dhcpServer `json:"-"` // ignore
+	dnsServers  map[string]*dnsServer  `json:"-"` // ignore
+
+	// datastore persisting the driver through the backend received at construction
+	store *datastore.DataStore `json:"-"` // ignore
 }
 
 // default prefix used to name the endpoint's interface name
@@ -49,58 +115,324 @@ const (
 	IfPrefixDefault = "vde"
 )
 
+// value of the sock option asking for a switch managed by the plugin, as when sock is missing
+const (
+	SockManaged = "managed"
+)
+
+// kinds of switches of the managed networks, selected by the switch option
+const (
+	// learning switch inside the plugin, the default
+	SwitchEmbedded = "embedded"
+
+	// vde_switch process supervised by the plugin
+	SwitchProcess = "vde_switch"
+)
+
+// multicast range from which the swarm manager allocates the vxvde groups of global networks
+const (
+	GroupRangeDefault = "239.10.0.0/16"
+)
+
 // creates and returns a network driver following the Docker network extension API https://github.com/docker/go-plugins-helpers/blob/master/network/api.go
-func NewDriver(storepath string, clean bool) Driver {
+// backend is the storage engine of the datastore, if global is true the networks have swarm scope, otherwise they are local to the host
+func NewDriver(backend datastore.Backend, clean bool, global bool) *Driver {
 	// instantiate new driver with empty networks
-	driver := Driver{Networks: make(map[string]*NetworkStat)}
+	driver := newDriver(backend)
+	if global {
+		driver.scope = network.GlobalScope
+	}
 
-	// set datastore path
-	datastore.SetPath(storepath)
+	// remove the masquerade rules left by the previous daemon, they are installed again for the networks loaded
+	flushMasquerade()
 
 	// if clean flag is true, empties datastore file
 	if clean == true {
-		datastore.Clean()
+		driver.store.Clean()
 
 		// else, loads previous datastore networks in driver
-	} else if err := datastore.Load(&driver); err == nil {
-		// Check the old Driver data, nwkey id the networkID, nw is the NetworkStat instance
-		for nwkey, nw := range driver.Networks {
-			//Check each endpoint of every network, epkey is the EndpointID, ep is EndpointStat instance
-			for epkey, ep := range nw.Endpoints {
-				if ep.Plugger == 0 || ep.LinkDel() == nil {
-					/* Container has been stopped or is running (whitout plugger) */
-					delete(driver.Networks[nwkey].Endpoints, epkey)
+	} else if err := driver.load(); err == nil {
+		// start again the switches of the managed networks, before the endpoints are plugged to them
+		driver.startSwitches()
+
+		// plug again the endpoints of the containers that survived the restart
+		driver.reconcile()
+
+		// masquerade again the networks
+		driver.restoreMasquerade()
+
+		// start again the DHCP servers, with the leases loaded, and the DNS responders
+		driver.startDHCPs()
+		driver.startDNSs()
+
+		// stores the driver networks in the datastore
+		_ = driver.store.Store(driver)
+	}
+	return driver
+}
+
+// Returns a driver loaded from the datastore without touching the plugs of the endpoints,
+// used by the commands that work on the datastore while the daemon is stopped
+func OpenDriver(backend datastore.Backend) (*Driver, error) {
+	driver := newDriver(backend)
+	if err := driver.load(); err != nil {
+		return nil, err
+	}
+	return driver, nil
+}
+
+// Returns a driver with empty networks
+func newDriver(backend datastore.Backend) *Driver {
+	return &Driver{
+		Networks:    make(map[string]*NetworkStat),
+		Pools:       make(map[string]*PoolStat),
+		Allocations: make(map[string]map[string]string),
+		scope:       network.LocalScope,
+		switches:    make(map[string]vdeswitch.Switch),
+		captures:    make(map[string]*capture.Session),
+		store:       datastore.New(backend),
+
+		networkCaptures: make(map[string]*networkCapture),
+		dhcpServers:     make(map[string]*dhcpServer),
+		dnsServers:      make(map[string]*dnsServer),
+	}
+}
+
+// Loads the networks of the datastore in the driver
+func (this *Driver) load() error {
+	if err := this.store.Load(this); err != nil {
+		return err
+	}
+
+	// datastores written before the IPAM driver and the global scope have no pools and allocations
+	if this.Pools == nil {
+		this.Pools = make(map[string]*PoolStat)
+	}
+	if this.Allocations == nil {
+		this.Allocations = make(map[string]map[string]string)
+	}
+	return nil
+}
+
+// Closes the datastore of the driver
+func (this *Driver) Close() error {
+	return this.store.Close()
+}
+
+// Starts the switches of the managed networks loaded from the datastore, they exited along with the previous daemon
+func (this *Driver) startSwitches() {
+	for nwkey, nw := range this.Networks {
+		if !nw.Managed {
+			continue
+		}
+		sw, err := startSwitch(nwkey, nw.Switch, nw.Uplink)
+		if err != nil {
+			log.Warnf("Start switch of network [ %s ]: [ %s ]", nwkey, err)
+			continue
+		}
+		this.switches[nwkey] = sw
+	}
+}
+
+// Starts the switch of a managed network
+func startSwitch(nwkey, kind, uplink string) (vdeswitch.Switch, error) {
+	if kind == SwitchProcess {
+		return vdeswitch.StartProcess(vdeswitch.Dir(nwkey))
+	}
+	return vdeswitch.StartEmbedded(nwkey, uplink)
+}
+
+// Stops the switch of a managed network
+func (this *Driver) stopSwitch(nwkey string) {
+	if sw := this.switches[nwkey]; sw != nil {
+		if err := sw.Close(); err != nil {
+			log.Warnf("Stop switch of network [ %s ]: [ %s ]", nwkey, err)
+		}
+		delete(this.switches, nwkey)
+	}
+}
+
+// Stops what the plugin runs for a network, in the reverse order of CreateNetwork
+func (this *Driver) stopNetwork(nwkey string, nw *NetworkStat) {
+	// stop the DNS responder and the DHCP server of the network
+	this.stopDNS(nwkey)
+	this.stopDHCP(nwkey)
+
+	// remove the masquerade rules of the network
+	if nw.Masquerade {
+		if err := nat.Remove(nwkey); err != nil {
+			log.Warnf("Remove masquerade of network [ %s ]: [ %s ]", nwkey, err)
+		}
+	}
+
+	// remove the gateway TAP device from the host, before its switch is gone
+	if nw.HostGateway != nil {
+		stopHostGateway(nw.HostGateway)
+	}
+
+	// stop the switch of a managed network
+	if nw.Managed {
+		this.stopSwitch(nwkey)
+	}
+}
+
+// Restores the VDE plugs of the endpoints loaded from the datastore, the plugs
+// of the previous daemon are gone along with its process
+func (this *Driver) reconcile() {
+	// Check the old Driver data, nw is the NetworkStat instance
+	for nwkey, nw := range this.Networks {
+		/* The gateway TAP device is still on the host unless the host rebooted */
+		if nw.HostGateway != nil {
+			if err := startHostGateway(nw.HostGateway, nw.Sock); err != nil {
+				log.Warnf("Reconcile host gateway of network [ %s ]: [ %s ]", nwkey, err)
+			}
+		}
+
+		//Check each endpoint of every network, epkey is the EndpointID, ep is EndpointStat instance
+		for epkey, ep := range nw.Endpoints {
+			/* Container has been created but is not joined, docker still owns the endpoint */
+			if ep.SandboxKey == "" {
+				continue
+			}
+
+			/* Endpoint detached by the admin, it stays unplugged but its ports are still published */
+			if ep.Detached {
+				if err := ep.RepublishPorts(); err != nil {
+					log.Warnf("Reconcile endpoint [ %s ]: [ %s ]", epkey, err)
 				}
+				continue
+			}
+
+			// open the TAP inside the container namespace and plug it again to the network
+			if err := ep.LinkReplugTo(nw.Sock); err != nil {
+				log.Warnf("Reconcile endpoint [ %s ]: [ %s ]", epkey, err)
+
+				/* Container has been stopped: remove the TAP if it is still on the host, and its published ports */
+				ep.LinkDel()
+				ep.SandboxKey = ""
+				ep.Ports = nil
+				continue
+			}
+			log.Debugf("Reconcile endpoint [ %s ]: replugged to [ %s ]", epkey, nw.Sock)
+
+			// the proxies of the published ports exited along with the previous daemon
+			if err := ep.RepublishPorts(); err != nil {
+				log.Warnf("Reconcile endpoint [ %s ]: [ %s ]", epkey, err)
 			}
 		}
-		// stores the driver networks in the datastore
-		_ = datastore.Store(&driver)
 	}
-	return driver
 }
 
 /* CapabilitiesResponse returns whether or not this network is global or local, */
 func (this *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
-	return &network.CapabilitiesResponse{Scope: network.LocalScope}, nil
+	return &network.CapabilitiesResponse{Scope: this.scope, ConnectivityScope: this.scope}, nil
+}
+
+// Returns the driver options of a network, in global scope the options allocated by the manager
+// may be delivered outside the generic options
+func networkOptions(options map[string]interface{}) map[string]interface{} {
+	opt := make(map[string]interface{})
+	for key, value := range options {
+		if _, ok := value.(string); ok {
+			opt[key] = value
+		}
+	}
+	if generic, ok := options["com.docker.network.generic"].(map[string]interface{}); ok {
+		for key, value := range generic {
+			opt[key] = value
+		}
+	}
+	return opt
+}
+
+// smallest MTU of the networks, as required by IPv4 and IPv6
+const (
+	MinMTU     = 68
+	MinMTUIPv6 = 1280
+)
+
+// MTU of the TAP devices when it is not set
+const MTUDefault = 1500
+
+// Returns the MTU set by the mtu option, or by the docker one, 0 if none is set.
+// The frames, tagged if vlan is not 0, must be carried by the VNL without IP fragmentation
+func networkMTU(opt map[string]interface{}, vnl string, vlan uint16, ipv6 bool) (int, error) {
+	s, _ := opt["mtu"].(string)
+	if s == "" {
+		s, _ = opt["com.docker.network.driver.mtu"].(string)
+	}
+	max := maxMTU(vnl, vlan)
+
+	// the default MTU may be too large for the transport, it is kept unless set
+	if s == "" {
+		if max < MTUDefault {
+			log.Warnf("Frames of the default MTU %d exceed the %d bytes carried by [ %s ], set the mtu option", MTUDefault, max, vnl)
+		}
+		return 0, nil
+	}
+
+	mtu, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad mtu %q", s)
+	}
+	min := MinMTU
+	if ipv6 {
+		min = MinMTUIPv6
+	}
+	if mtu < min {
+		return 0, fmt.Errorf("mtu %d is lower than %d", mtu, min)
+	}
+	if mtu > max {
+		return 0, fmt.Errorf("mtu %d exceeds the %d bytes carried by %s", mtu, max, vnl)
+	}
+	return mtu, nil
+}
+
+// Returns the largest MTU of the frames carried by the VNL, tagged if vlan is not 0
+func maxMTU(vnl string, vlan uint16) int {
+	max := vdeplug.MaxMTU(vnl)
+	if vlan != 0 {
+		max -= endpoint.VlanHdrLen
+	}
+	return max
 }
 
 // Driver method that creates a new network, receives a CreateNetworkRequest as parameter when a network needs to be created
 func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 	log.Debugf("Createnetwork Request: [ %+v ]", r)
 
-	var sock, ifprefix, ipv6pool, ipv6gateway string
+	var sock, ifprefix, ipv6pool, ipv6gateway, kind, uplink string
+	var managed bool
 
 	// opt contains the options passed when creating the docker vde network
-	opt := r.Options["com.docker.network.generic"].(map[string]interface{})
+	opt := networkOptions(r.Options)
 
 	// error if there are no IPv4 address information
 	if r.IPv4Data == nil || len(r.IPv4Data) == 0 {
 		return types.BadRequestErrorf("Network IPv4Data config miss.")
 	}
 
-	// error if socket is missing in the options
-	if sock, _ = opt["sock"].(string); sock == "" {
-		return types.NotFoundErrorf("Sock URL miss.")
+	// if socket is missing in the options, the plugin starts a switch for the network
+	if sock, _ = opt["sock"].(string); sock == "" || sock == SockManaged {
+		managed = true
+	}
+
+	// with an embedded switch the socket is its uplink, the endpoints are plugged to the switch
+	switch kind, _ = opt["switch"].(string); kind {
+	case "":
+		if managed {
+			kind = SwitchEmbedded
+		}
+	case SwitchEmbedded:
+		if !managed {
+			managed, uplink = true, sock
+		}
+	case SwitchProcess:
+		if !managed {
+			return types.BadRequestErrorf("The vde_switch can't be connected to sock, use switch=%s.", SwitchEmbedded)
+		}
+	default:
+		return types.BadRequestErrorf("Unknown switch %s.", kind)
 	}
 
 	// if interface prefix is missing, use default interface prefix
@@ -113,40 +445,220 @@ func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 		return types.BadRequestErrorf("Interface prefix exceeds 4 character limit.")
 	}
 
+	// rate limits of the endpoints
+	limits, err := endpoint.ParseLimits(opt, endpoint.Limits{})
+	if err != nil {
+		return types.BadRequestErrorf("Invalid rate limit: %s.", err)
+	}
+
+	// impairments of the frames sent by the endpoints
+	netem, err := endpoint.ParseNetem(opt, endpoint.Netem{})
+	if err != nil {
+		return types.BadRequestErrorf("Invalid network emulation: %s.", err)
+	}
+
+	// VLAN tagging the frames of the endpoints
+	vlan, err := endpoint.ParseVlan(opt)
+	if err != nil {
+		return types.BadRequestErrorf("Invalid VLAN: %s.", err)
+	}
+
+	// the frames of a managed network leave the host through the uplink of its switch, if any
+	transport := sock
+	if managed {
+		transport = uplink
+	}
+
+	// MTU of the endpoints, the frames must fit the transport of the VNL
+	mtu, err := networkMTU(opt, transport, vlan, len(r.IPv6Data) > 0)
+	if err != nil {
+		return types.BadRequestErrorf("Invalid MTU: %s.", err)
+	}
+
 	// if there is any IPv6 information, set it
 	if r.IPv6Data != nil && len(r.IPv6Data) > 0 {
 		ipv6pool = r.IPv6Data[0].Pool
 		ipv6gateway = r.IPv6Data[0].Gateway
 	}
 
+	// TAP device on the host answering as the gateway of the containers
+	gateway, err := parseGateway(opt)
+	if err != nil {
+		return types.BadRequestErrorf("Invalid gateway: %s.", err)
+	}
+	if gateway == GatewayHost && r.IPv4Data[0].Gateway == "" {
+		return types.BadRequestErrorf("Network IPv4 gateway miss.")
+	}
+
+	// masquerade of the traffic routed by the host gateway
+	masquerade, err := parseBool(opt, "masquerade")
+	if err != nil {
+		return types.BadRequestErrorf("Invalid masquerade: %s.", err)
+	}
+	if masquerade && gateway != GatewayHost {
+		return types.BadRequestErrorf("Masquerade needs gateway=%s.", GatewayHost)
+	}
+
+	// DHCP server of the peers outside docker
+	dhcpStat, err := parseDHCP(opt, r.IPv4Data[0])
+	if err != nil {
+		return types.BadRequestErrorf("Invalid DHCP: %s.", err)
+	}
+
+	// DNS responder of the containers across hosts
+	dnsStat, err := parseDNS(opt, r.IPv4Data[0])
+	if err != nil {
+		return types.BadRequestErrorf("Invalid DNS: %s.", err)
+	}
+	if dnsStat != nil && dhcpStat != nil && inRange(dhcpStat.Range, net.ParseIP(dnsStat.IP)) {
+		return types.BadRequestErrorf("Invalid DNS: %s is in the DHCP range %s.", dnsStat.IP, dhcpStat.Range)
+	}
+
 	// lock driver mutex
 	this.mutex.Lock()
 
 	// unlock driver lock function ends
 	defer this.mutex.Unlock()
 
-	// store driver networks when function ends
-	defer datastore.Store(&this)
+	// start the switch of a managed network, its VNL is the socket of the network
+	if managed {
+		sw, err := startSwitch(r.NetworkID, kind, uplink)
+		if err != nil {
+			return types.InternalErrorf("Failed switch start: %s", err)
+		}
+		this.switches[r.NetworkID] = sw
+		sock = sw.VNL()
+	}
 
-	// add network to driver, r.NetworkID has
-	this.Networks[r.NetworkID] = &NetworkStat{
+	netw := &NetworkStat{
 		Sock:        sock,
+		Limits:      limits,
+		Netem:       netem,
+		Vlan:        vlan,
+		MTU:         mtu,
 		IfPrefix:    ifprefix,
 		IPv4Pool:    r.IPv4Data[0].Pool,
 		IPv4Gateway: r.IPv4Data[0].Gateway,
 		IPv6Pool:    ipv6pool,
 		IPv6Gateway: ipv6gateway,
+		Managed:     managed,
+		Switch:      kind,
+		Uplink:      uplink,
+		Gateway:     gateway,
+		Masquerade:  masquerade,
+		DHCP:        dhcpStat,
+		DNS:         dnsStat,
 
 		// empty endpoint struct
 		Endpoints: make(map[string]*endpoint.EndpointStat),
 	}
+
+	// create the gateway TAP device on the host and plug it to the network
+	if gateway == GatewayHost {
+		netw.HostGateway = newHostGateway(r.NetworkID, netw)
+		if err := startHostGateway(netw.HostGateway, sock); err != nil {
+			this.stopNetwork(r.NetworkID, netw)
+			return types.InternalErrorf("Failed host gateway start: %s", err)
+		}
+	}
+
+	// masquerade the traffic of the network leaving the host
+	if masquerade {
+		if err := nat.Install(masqueradeRules(r.NetworkID, netw)); err != nil {
+			this.stopNetwork(r.NetworkID, netw)
+			return types.InternalErrorf("Failed masquerade: %s", err)
+		}
+	}
+
+	// start the DHCP server on the VNL of the network
+	if dhcpStat != nil {
+		if err := this.startDHCP(r.NetworkID, netw); err != nil {
+			this.stopNetwork(r.NetworkID, netw)
+			return types.InternalErrorf("Failed DHCP server start: %s", err)
+		}
+	}
+
+	// start the DNS responder on the VNL of the network
+	if dnsStat != nil {
+		if err := this.startDNS(r.NetworkID, netw); err != nil {
+			this.stopNetwork(r.NetworkID, netw)
+			return types.InternalErrorf("Failed DNS responder start: %s", err)
+		}
+	}
+
+	// store driver networks when function ends
+	defer this.store.Store(this)
+
+	// add network to driver, r.NetworkID has
+	this.Networks[r.NetworkID] = netw
+
+	// if the pool is managed by the IPAM driver, bind it to the network, the range of the DHCP server is not assigned to the endpoints
+	if pool := this.Pools[r.IPv4Data[0].AddressSpace+"/"+r.IPv4Data[0].Pool]; pool != nil {
+		pool.NetworkID = r.NetworkID
+		if dhcpStat != nil {
+			pool.Reserved = dhcpStat.Range
+		}
+	}
 	return nil
 }
 
-// Not implemented
+// Called on the swarm manager in global scope, allocates the VNL and the interface prefix shared by every worker
 func (this *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
-	//  log.Debugf("Allocatenetwork Request: [ %+v ]", r)
-	return nil, types.NotImplementedErrorf("Not implementethis.")
+	log.Debugf("Allocatenetwork Request: [ %+v ]", r)
+
+	// networks are allocated only by the manager of a swarm
+	if this.scope != network.GlobalScope {
+		return nil, types.NotImplementedErrorf("Not implemented in local scope.")
+	}
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver lock function ends
+	defer this.mutex.Unlock()
+
+	// the allocation is idempotent
+	if options := this.Allocations[r.NetworkID]; options != nil {
+		return &network.AllocateNetworkResponse{Options: options}, nil
+	}
+
+	options := map[string]string{"sock": r.Options["sock"], "if": r.Options["if"]}
+
+	// if the socket is missing, allocate a vxvde group not used by other networks
+	if options["sock"] == "" {
+		if options["sock"] = this.freeGroup(); options["sock"] == "" {
+			return nil, types.NoServiceErrorf("No free group in %s.", GroupRangeDefault)
+		}
+	}
+
+	// if interface prefix is missing, use default interface prefix
+	if options["if"] == "" {
+		options["if"] = IfPrefixDefault
+	}
+
+	// error if interface name prefix exceeds 4 characters
+	if len(options["if"]) > 4 {
+		return nil, types.BadRequestErrorf("Interface prefix exceeds 4 character limit.")
+	}
+
+	this.Allocations[r.NetworkID] = options
+	_ = this.store.Store(this)
+	return &network.AllocateNetworkResponse{Options: options}, nil
+}
+
+// Returns the first vxvde VNL of the default multicast range not yet allocated
+func (this *Driver) freeGroup() string {
+	used := make(map[string]bool)
+	for _, options := range this.Allocations {
+		used[options["sock"]] = true
+	}
+	_, rng, _ := net.ParseCIDR(GroupRangeDefault)
+	for ip := nextAddress(rng.IP); rng.Contains(ip); ip = nextAddress(ip) {
+		if sock := fmt.Sprintf("vxvde://%s", ip); !used[sock] {
+			return sock
+		}
+	}
+	return ""
 }
 
 // Called when a network needs to be removec, deletes a network
@@ -170,18 +682,50 @@ func (this *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
 		return types.BadRequestErrorf("There are still active endpoints.")
 	}
 
+	// stop the DNS responder, the DHCP server, the masquerade, the host gateway and the switch of the network
+	this.stopNetwork(r.NetworkID, netw)
+
+	// stop the captures of the network, no endpoint can join it anymore
+	this.stopNetworkCaptures(r.NetworkID)
+
+	// unbind the IPAM pools of the network, docker releases them afterwards
+	for _, pool := range this.Pools {
+		if pool.NetworkID == r.NetworkID {
+			pool.NetworkID, pool.Reserved = "", ""
+		}
+	}
+
 	// delete specific network from driver struct
 	delete(this.Networks, r.NetworkID)
 
 	// store the now updated driver onto the datastorage
-	_ = datastore.Store(&this)
+	_ = this.store.Store(this)
 	return nil
 }
 
-// Not implemented
+// Called on the swarm manager in global scope, frees the options allocated for the network
 func (this *Driver) FreeNetwork(r *network.FreeNetworkRequest) error {
-	//  log.Warnf("Freenetwork Request: [ %+v ]", r)
-	return types.NotImplementedErrorf("Not implementethis.")
+	log.Debugf("Freenetwork Request: [ %+v ]", r)
+
+	// networks are allocated only by the manager of a swarm
+	if this.scope != network.GlobalScope {
+		return types.NotImplementedErrorf("Not implemented in local scope.")
+	}
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver lock function ends
+	defer this.mutex.Unlock()
+
+	// error if the network has not been allocated
+	if this.Allocations[r.NetworkID] == nil {
+		return types.NotFoundErrorf("Network not allocated.")
+	}
+
+	delete(this.Allocations, r.NetworkID)
+	_ = this.store.Store(this)
+	return nil
 }
 
 // Called when an endpoint should be created, creates an endpoint for the container
@@ -207,8 +751,25 @@ func (this *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.C
 		return nil, types.BadRequestErrorf("EndpointID already exists.")
 	}
 
+	// the endpoint options override the rate limits of the network
+	limits, err := endpoint.ParseLimits(r.Options, netw.Limits)
+	if err != nil {
+		return nil, types.BadRequestErrorf("Invalid rate limit: %s.", err)
+	}
+	netem, err := endpoint.ParseNetem(r.Options, netw.Netem)
+	if err != nil {
+		return nil, types.BadRequestErrorf("Invalid network emulation: %s.", err)
+	}
+
 	// populates new endpoint with initial stats
 	netw.Endpoints[r.EndpointID] = endpoint.NewEndpointStat(r, netw.IfPrefix)
+	netw.Endpoints[r.EndpointID].Limits = limits
+	netw.Endpoints[r.EndpointID].Netem = netem
+	netw.Endpoints[r.EndpointID].Vlan = netw.Vlan
+	netw.Endpoints[r.EndpointID].MTU = netw.MTU
+
+	// the DHCP server never leases the address of the endpoint
+	this.reserveAddress(netw, netw.Endpoints[r.EndpointID])
 
 	// create reponse using CreateEndpointResponse provided by go-plugins-helpers
 	response := &network.CreateEndpointResponse{
@@ -223,7 +784,7 @@ func (this *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.C
 	}
 
 	// save the driver data in the datastore
-	_ = datastore.Store(&this)
+	_ = this.store.Store(this)
 
 	//send created response
 	return response, nil
@@ -249,14 +810,18 @@ func (this *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 		return types.NotFoundErrorf("Endpoint not found.")
 	}
 
-	// deletes link between endpoint and VDE network
+	// deletes link between endpoint and VDE network, and the proxies of its ports if they are still published
+	this.Networks[r.NetworkID].Endpoints[r.EndpointID].UnpublishPorts()
 	this.Networks[r.NetworkID].Endpoints[r.EndpointID].LinkDel()
 
+	// the address of the endpoint can be leased by the DHCP server
+	this.unreserveAddress(this.Networks[r.NetworkID], this.Networks[r.NetworkID].Endpoints[r.EndpointID])
+
 	// deletes endppoint data from driver
 	delete(this.Networks[r.NetworkID].Endpoints, r.EndpointID)
 
 	// saves driver in datastore
-	_ = datastore.Store(&this)
+	_ = this.store.Store(this)
 	return nil
 }
 
@@ -289,7 +854,12 @@ func (this *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse,
 	// set the TAP interface name in the docker network namespace
 	info.Value["srcName"] = this.Networks[r.NetworkID].Endpoints[r.EndpointID].IfName
 
-	log.Debugf("In EndpointInfo: ", this.Networks[r.NetworkID].Endpoints[r.EndpointID].IfName)
+	// report the traffic counters of the vde plug
+	for key, value := range this.Networks[r.NetworkID].Endpoints[r.EndpointID].Counters().Map() {
+		info.Value[key] = value
+	}
+
+	log.Debugf("In EndpointInfo: [ %s ]", this.Networks[r.NetworkID].Endpoints[r.EndpointID].IfName)
 
 	return info, nil
 }
@@ -326,11 +896,16 @@ func (this *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error)
 	// use a VDE plug to plug the endpoint to the VDE network with the given VNL
 	if err := edpt.LinkPlugTo(netw.Sock); err != nil {
 		edpt.LinkDel()
-		return nil, types.NotFoundErrorf("Failed plug to interface", err)
+		return nil, types.NotFoundErrorf("Failed plug to interface: %s", err)
 	}
 
 	// add SandboxKey to Endpoint struct
 	edpt.SandboxKey = r.SandboxKey
+	edpt.Detached = false
+
+	// add the endpoint to the running captures of the network, and its container to the DNS responder
+	this.captureJoined(r.NetworkID, r.EndpointID, edpt)
+	this.refreshNetworkDNS(r.NetworkID)
 
 	// remove subnet mask from IPv4 gateway
 	if netw.IPv4Gateway != "" {
@@ -355,7 +930,7 @@ func (this *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error)
 		Gateway:     gateway,
 		GatewayIPv6: gateway6,
 	}
-	_ = datastore.Store(&this)
+	_ = this.store.Store(this)
 	return response, nil
 }
 
@@ -381,14 +956,20 @@ func (this *Driver) Leave(r *network.LeaveRequest) error {
 		return types.NotFoundErrorf("Endpoint not found.")
 	}
 
-	// stops the vde plug connecting the endpoint to the vde network
+	// stops the vde plug connecting the endpoint to the vde network, and the proxies of its ports
 	edpt.LinkPlugStop()
+	edpt.UnpublishPorts()
 
 	// deletes the TAP device for this endpoint
 	edpt.LinkDel()
 
+	// the endpoint is no longer attached to a sandbox, its container leaves the DNS responder
+	edpt.SandboxKey = ""
+	edpt.Detached = false
+	this.refreshNetworkDNS(r.NetworkID)
+
 	// updates datastore
-	_ = datastore.Store(&this)
+	_ = this.store.Store(this)
 	return nil
 }
 
@@ -405,16 +986,69 @@ func (this *Driver) DiscoverDelete(r *network.DiscoveryNotification) error {
 	return nil
 }
 
-// Not implemented
-
+// Publishes the ports of a joined endpoint on the host, as requested with docker run -p
 func (this *Driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
-	//  log.Debugf("PROGRAM EXTERNAL CONNECTIVITY Called: [ %+v ]", r)
+	log.Debugf("PROGRAM EXTERNAL CONNECTIVITY: [ %+v ]", r)
+
+	bindings, err := portmap.ParseBindings(r.Options)
+	if err != nil {
+		return types.BadRequestErrorf("Invalid port bindings: %s", err)
+	}
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	// error if the network isnt found
+	netw := this.Networks[r.NetworkID]
+	if netw == nil {
+		return types.NotFoundErrorf("Network not found.")
+	}
+
+	// error if the endpoint isnt found
+	edpt := netw.Endpoints[r.EndpointID]
+	if edpt == nil {
+		return types.NotFoundErrorf("Endpoint not found.")
+	}
+
+	// the proxies reach the container inside its sandbox
+	if edpt.SandboxKey == "" {
+		return types.BadRequestErrorf("Endpoint %s is not joined to a sandbox.", r.EndpointID)
+	}
+	if err := edpt.PublishPorts(bindings); err != nil {
+		return types.InternalErrorf("Failed port publish: %s", err)
+	}
+
+	// store the published ports, they are published again when the plugin restarts
+	_ = this.store.Store(this)
 	return nil
 }
 
-// Not implemented
-
+// Stops publishing the ports of an endpoint
 func (this *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
-	//  log.Debugf("REVOKE EXTERNAL CONNECTIVITY Called: [ %+v ]", r)
+	log.Debugf("REVOKE EXTERNAL CONNECTIVITY: [ %+v ]", r)
+
+	// lock driver mutex
+	this.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.mutex.Unlock()
+
+	// error if the network isnt found
+	netw := this.Networks[r.NetworkID]
+	if netw == nil {
+		return types.NotFoundErrorf("Network not found.")
+	}
+
+	// error if the endpoint isnt found
+	edpt := netw.Endpoints[r.EndpointID]
+	if edpt == nil {
+		return types.NotFoundErrorf("Endpoint not found.")
+	}
+	edpt.UnpublishPorts()
+
+	_ = this.store.Store(this)
 	return nil
 }
@@ -0,0 +1,100 @@
+package vdenet
+
+import (
+	"fmt"
+
+	"phocs/vde_plug_docker/endpoint"
+	"phocs/vde_plug_docker/nat"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// value of the gateway option asking for a TAP device on the host holding the gateway addresses
+const (
+	GatewayHost = "host"
+)
+
+// Returns the gateway option of a network, empty if the gateway is left to the user
+func parseGateway(opt map[string]interface{}) (string, error) {
+	switch gateway, _ := opt["gateway"].(string); gateway {
+	case "", GatewayHost:
+		return gateway, nil
+	default:
+		return "", fmt.Errorf("unknown gateway %q, only %s is supported", gateway, GatewayHost)
+	}
+}
+
+// Returns the TAP device on the host holding the gateway addresses of a network,
+// named after the network so that it never clashes with the TAP devices of the endpoints
+func newHostGateway(nwkey string, nw *NetworkStat) *endpoint.EndpointStat {
+	return &endpoint.EndpointStat{
+		IfName:      nw.IfPrefix + "g" + nwkey[:10],
+		IPv4Address: nw.IPv4Gateway,
+		IPv6Address: nw.IPv6Gateway,
+		MacAddress:  endpoint.RandomMacAddr(),
+		Vlan:        nw.Vlan,
+		MTU:         nw.MTU,
+	}
+}
+
+// Creates the gateway TAP device of a network on the host and plugs it to the VNL of the network.
+// The TAP device is persistent, if it survived a restart of the plugin it is plugged again
+func startHostGateway(gw *endpoint.EndpointStat, sock string) error {
+	log.Debugf("Start host gateway: [ %s ] [ %s ]", gw.IfName, sock)
+
+	created := false
+	if !gw.LinkOnHost() {
+		if err := gw.LinkAdd(); err != nil {
+			return err
+		}
+		created = true
+	}
+	if err := gw.LinkUp(); err != nil {
+		if created {
+			gw.LinkDel()
+		}
+		return err
+	}
+	if err := gw.LinkPlugTo(sock); err != nil {
+		if created {
+			gw.LinkDel()
+		}
+		return err
+	}
+	return nil
+}
+
+// Unplugs and deletes the gateway TAP device of a network
+func stopHostGateway(gw *endpoint.EndpointStat) {
+	log.Debugf("Stop host gateway: [ %s ]", gw.IfName)
+	gw.LinkPlugStop()
+	gw.LinkDel()
+}
+
+// Returns the masquerade rules of a network, for its pools routed by its host gateway
+func masqueradeRules(nwkey string, nw *NetworkStat) nat.Rules {
+	return nat.Rules{
+		ID:      nwkey,
+		Gateway: nw.HostGateway.IfName,
+		Pools:   []string{nw.IPv4Pool, nw.IPv6Pool},
+	}
+}
+
+// Removes the masquerade rules of every network, a host without firewall has none
+func flushMasquerade() {
+	if err := nat.Flush(); err != nil {
+		log.Debugf("Flush masquerade: [ %s ]", err)
+	}
+}
+
+// Installs again the masquerade rules of the networks loaded from the datastore
+func (this *Driver) restoreMasquerade() {
+	for nwkey, nw := range this.Networks {
+		if !nw.Masquerade || nw.HostGateway == nil {
+			continue
+		}
+		if err := nat.Install(masqueradeRules(nwkey, nw)); err != nil {
+			log.Warnf("Restore masquerade of network [ %s ]: [ %s ]", nwkey, err)
+		}
+	}
+}
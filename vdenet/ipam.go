@@ -0,0 +1,366 @@
+// Impementation of the IPAM driver interface
+package vdenet
+
+import (
+	"net"
+	"strings"
+
+	"phocs/vde_plug_docker/datastore"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Holds the info about an address pool assigned to a vde network
+type PoolStat struct {
+	// address space which the pool belongs to
+	AddressSpace string `json:"AddressSpace"`
+
+	// range of IP Addresses represented in CIDR format address/mask
+	Pool string `json:"Pool"`
+
+	// optional, range of the pool from which the addresses are assigned
+	SubPool string `json:"SubPool"`
+
+	// ID of the vde network using the pool, set when the network is created
+	NetworkID string `json:"NetworkID"`
+
+	// range first-last leased by the DHCP server of the network, never assigned to the endpoints
+	Reserved string `json:"Reserved,omitempty"`
+
+	// key-value pairs where keys are the allocated IP addresses and the values are the requesting MAC addresses
+	Allocated map[string]string `json:"Allocated"`
+}
+
+// IPAM driver struct, shares networks, mutex and datastore with the network driver
+type IpamDriver struct {
+	driver *Driver
+}
+
+// default address spaces and the range from which pools are carved when docker provides no subnet
+const (
+	LocalAddressSpace  = "VdeLocal"
+	GlobalAddressSpace = "VdeGlobal"
+	PoolRangeDefault   = "10.200.0.0/16"
+	PoolPrefixDefault  = 24
+)
+
+// attempts of an IPAM call whose datastore write lost the race with another daemon sharing the pools
+const PoolWriteAttempts = 3
+
+// option set by libnetwork when the requested address is the gateway of the pool
+const gatewayAddressType = "com.docker.network.gateway"
+
+// creates and returns an IPAM driver following the Docker IPAM extension API https://github.com/docker/go-plugins-helpers/blob/master/ipam/api.go
+func NewIpamDriver(driver *Driver) *IpamDriver {
+	return &IpamDriver{driver: driver}
+}
+
+// MAC addresses are not needed to assign addresses
+func (this *IpamDriver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	return &ipam.CapabilitiesResponse{RequiresMACAddress: false}, nil
+}
+
+// Returns the names of the address spaces managed by the driver
+func (this *IpamDriver) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+	return &ipam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  LocalAddressSpace,
+		GlobalDefaultAddressSpace: GlobalAddressSpace,
+	}, nil
+}
+
+// Registers a new address pool, if docker provides no subnet a free one is chosen from the default range
+func (this *IpamDriver) RequestPool(r *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
+	log.Debugf("RequestPool Request: [ %+v ]", r)
+	var response *ipam.RequestPoolResponse
+
+	// lock driver mutex
+	this.driver.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.driver.mutex.Unlock()
+
+	err := this.update(func() error {
+		pool := r.Pool
+		if pool == "" {
+			// IPv6 pools are too wide to be guessed
+			if r.V6 {
+				return types.BadRequestErrorf("IPv6 subnet miss.")
+			}
+			if pool = this.freePool(r.AddressSpace); pool == "" {
+				return types.NoServiceErrorf("No free pool in %s.", PoolRangeDefault)
+			}
+		}
+
+		// normalize the pool to its network address
+		_, subnet, err := net.ParseCIDR(pool)
+		if err != nil {
+			return types.BadRequestErrorf("Invalid pool %s.", pool)
+		}
+		pool = subnet.String()
+
+		// the optional sub pool must be contained in the pool
+		if r.SubPool != "" {
+			_, subpool, err := net.ParseCIDR(r.SubPool)
+			if err != nil || !subnet.Contains(subpool.IP) {
+				return types.BadRequestErrorf("Invalid sub pool %s.", r.SubPool)
+			}
+		}
+
+		// error if the pool overlaps with another pool of the same address space
+		if this.overlaps(r.AddressSpace, subnet) {
+			return types.ForbiddenErrorf("Pool %s overlaps with an existing pool.", pool)
+		}
+
+		poolID := r.AddressSpace + "/" + pool
+		this.driver.Pools[poolID] = &PoolStat{
+			AddressSpace: r.AddressSpace,
+			Pool:         pool,
+			SubPool:      r.SubPool,
+			Allocated:    make(map[string]string),
+		}
+		response = &ipam.RequestPoolResponse{PoolID: poolID, Pool: pool}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Releases a previously registered address pool
+func (this *IpamDriver) ReleasePool(r *ipam.ReleasePoolRequest) error {
+	log.Debugf("ReleasePool Request: [ %+v ]", r)
+
+	// lock driver mutex
+	this.driver.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.driver.mutex.Unlock()
+
+	return this.update(func() error {
+		// error if the pool doesn't exist
+		if this.driver.Pools[r.PoolID] == nil {
+			return types.NotFoundErrorf("Pool not found.")
+		}
+
+		delete(this.driver.Pools, r.PoolID)
+		return nil
+	})
+}
+
+// Assigns the requested address, or the first free one, from the given pool
+func (this *IpamDriver) RequestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	log.Debugf("RequestAddress Request: [ %+v ]", r)
+	var response *ipam.RequestAddressResponse
+
+	// lock driver mutex
+	this.driver.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.driver.mutex.Unlock()
+
+	err := this.update(func() error {
+		var pool *PoolStat
+
+		// error if the pool doesn't exist
+		if pool = this.driver.Pools[r.PoolID]; pool == nil {
+			return types.NotFoundErrorf("Pool not found.")
+		}
+
+		_, subnet, _ := net.ParseCIDR(pool.Pool)
+		var ip net.IP
+
+		if r.Address != "" {
+			// error if the requested address is out of the pool or already taken
+			if ip = net.ParseIP(r.Address); ip == nil || !subnet.Contains(ip) {
+				return types.BadRequestErrorf("Address %s out of pool %s.", r.Address, pool.Pool)
+			}
+			if _, taken := pool.Allocated[ip.String()]; taken {
+				return types.ForbiddenErrorf("Address %s already allocated.", r.Address)
+			}
+			if inRange(pool.Reserved, ip) {
+				return types.ForbiddenErrorf("Address %s reserved for DHCP.", r.Address)
+			}
+		} else if ip = pool.freeAddress(); ip == nil {
+			return types.NoServiceErrorf("No free address in pool %s.", pool.Pool)
+		}
+
+		// the value tells the gateway apart from the container addresses
+		owner := r.Options["com.docker.network.endpoint.macaddress"]
+		if r.Options["RequestAddressType"] == gatewayAddressType {
+			owner = "gateway"
+		}
+		pool.Allocated[ip.String()] = owner
+
+		ones, _ := subnet.Mask.Size()
+		address := (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, len(subnet.Mask)*8)}).String()
+		response = &ipam.RequestAddressResponse{Address: address}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Frees an address previously assigned from the given pool
+func (this *IpamDriver) ReleaseAddress(r *ipam.ReleaseAddressRequest) error {
+	log.Debugf("ReleaseAddress Request: [ %+v ]", r)
+
+	// lock driver mutex
+	this.driver.mutex.Lock()
+
+	// unlock driver mutex when function ends
+	defer this.driver.mutex.Unlock()
+
+	return this.update(func() error {
+		var pool *PoolStat
+
+		// error if the pool doesn't exist
+		if pool = this.driver.Pools[r.PoolID]; pool == nil {
+			return types.NotFoundErrorf("Pool not found.")
+		}
+
+		ip := net.ParseIP(strings.Split(r.Address, "/")[0])
+		if ip == nil {
+			return types.BadRequestErrorf("Invalid address %s.", r.Address)
+		}
+
+		delete(pool.Allocated, ip.String())
+		return nil
+	})
+}
+
+// Reads the pools again from the datastore, applies change to them and stores the driver: docker must not
+// use a pool or an address that is not stored. When another daemon sharing the datastore changed the same
+// pools first, change is applied again to the fresh pools. The pools are restored if the change can't be stored
+func (this *IpamDriver) update(change func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := this.reloadPools(); err != nil {
+			return types.InternalErrorf("Failed to read the pools: %s", err)
+		}
+
+		saved := clonePools(this.driver.Pools)
+		if err := change(); err != nil {
+			return err
+		}
+		err := this.driver.store.Store(this.driver)
+		if err == nil {
+			return nil
+		}
+		this.driver.Pools = saved
+
+		if err != datastore.ErrConflict || attempt == PoolWriteAttempts {
+			return types.InternalErrorf("Failed to store the pools: %s", err)
+		}
+		log.Debugf("IPAM: [ pools changed by another daemon, attempt %d ]", attempt)
+	}
+}
+
+// Replaces the pools with the ones in the datastore when it is shared with other daemons,
+// otherwise this daemon is the only writer and the pools it holds are up to date
+func (this *IpamDriver) reloadPools() error {
+	pools := make(map[string]*PoolStat)
+	shared, err := this.driver.store.Reload("Pools", &pools)
+	if err != nil || !shared {
+		return err
+	}
+	for _, pool := range pools {
+		if pool.Allocated == nil {
+			pool.Allocated = make(map[string]string)
+		}
+	}
+	this.driver.Pools = pools
+	return nil
+}
+
+// Returns a copy of the pools and of their allocations
+func clonePools(pools map[string]*PoolStat) map[string]*PoolStat {
+	clone := make(map[string]*PoolStat, len(pools))
+	for id, pool := range pools {
+		copied := *pool
+		copied.Allocated = make(map[string]string, len(pool.Allocated))
+		for ip, owner := range pool.Allocated {
+			copied.Allocated[ip] = owner
+		}
+		clone[id] = &copied
+	}
+	return clone
+}
+
+// Returns true if subnet overlaps with a pool already registered in the address space
+func (this *IpamDriver) overlaps(space string, subnet *net.IPNet) bool {
+	for _, pool := range this.driver.Pools {
+		if pool.AddressSpace != space {
+			continue
+		}
+		if _, other, err := net.ParseCIDR(pool.Pool); err == nil {
+			if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the first pool of the default range not yet registered in the address space
+func (this *IpamDriver) freePool(space string) string {
+	_, rng, _ := net.ParseCIDR(PoolRangeDefault)
+	step := &net.IPNet{IP: rng.IP.To4(), Mask: net.CIDRMask(PoolPrefixDefault, 32)}
+	for rng.Contains(step.IP) {
+		if !this.overlaps(space, step) {
+			return step.String()
+		}
+		// move to the next subnet of the same size
+		step = &net.IPNet{IP: nextAddress(lastAddress(step)), Mask: step.Mask}
+	}
+	return ""
+}
+
+// Returns the first address of the (sub)pool that is not allocated
+func (this *PoolStat) freeAddress() net.IP {
+	_, subnet, _ := net.ParseCIDR(this.Pool)
+	if this.SubPool != "" {
+		_, subnet, _ = net.ParseCIDR(this.SubPool)
+	}
+	_, pool, _ := net.ParseCIDR(this.Pool)
+	broadcast := lastAddress(pool)
+
+	for ip := subnet.IP; subnet.Contains(ip); ip = nextAddress(ip) {
+		// the network address of the pool is never assigned, the first address of a sub pool is
+		if ip.Equal(pool.IP) {
+			continue
+		}
+		// the broadcast address of IPv4 pools is never assigned
+		if ip.To4() != nil && ip.Equal(broadcast) {
+			break
+		}
+		if _, taken := this.Allocated[ip.String()]; !taken && !inRange(this.Reserved, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Returns the address following ip
+func nextAddress(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Returns the last address of the subnet
+func lastAddress(subnet *net.IPNet) net.IP {
+	last := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		last[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return last
+}
@@ -0,0 +1,67 @@
+package vdenet
+
+import (
+	"io"
+
+	"phocs/vde_plug_docker/endpoint"
+	"phocs/vde_plug_docker/metrics"
+)
+
+// Writes the metrics about networks, endpoints and plugs of the driver
+func (this *Driver) Collect(w io.Writer) {
+	// locks Driver read
+	this.mutex.RLock()
+
+	// unlock driver read when functions ends
+	defer this.mutex.RUnlock()
+
+	metrics.WriteHeader(w, "vde_networks", "gauge", "Number of VDE networks.")
+	metrics.WriteSample(w, "vde_networks", float64(len(this.Networks)))
+
+	plugs := 0
+	metrics.WriteHeader(w, "vde_network_endpoints", "gauge", "Number of endpoints of each VDE network.")
+	for nwkey, nw := range this.Networks {
+		metrics.WriteSample(w, "vde_network_endpoints", float64(len(nw.Endpoints)), metrics.Label{Name: "network", Value: nwkey})
+		for _, ep := range nw.Endpoints {
+			if ep.Plugged() {
+				plugs++
+			}
+		}
+	}
+
+	metrics.WriteHeader(w, "vde_plugs_active", "gauge", "Number of endpoints plugged to their VDE network.")
+	metrics.WriteSample(w, "vde_plugs_active", float64(plugs))
+
+	metrics.WriteHeader(w, "vde_endpoint_reconnects_total", "counter", "Times the endpoint plug connected again to the VDE network.")
+	for nwkey, nw := range this.Networks {
+		for epkey, ep := range nw.Endpoints {
+			metrics.WriteSample(w, "vde_endpoint_reconnects_total", float64(ep.Counters().Reconnects),
+				metrics.Label{Name: "network", Value: nwkey}, metrics.Label{Name: "endpoint", Value: epkey}, metrics.Label{Name: "ifname", Value: ep.IfName})
+		}
+	}
+
+	// per-endpoint traffic, one metric per counter with the direction as label
+	for _, metric := range []struct {
+		name, help string
+		in, out    func(c endpoint.Counters) uint64
+	}{
+		{"vde_endpoint_packets_total", "Frames forwarded by the endpoint plug.",
+			func(c endpoint.Counters) uint64 { return c.InPackets }, func(c endpoint.Counters) uint64 { return c.OutPackets }},
+		{"vde_endpoint_bytes_total", "Bytes forwarded by the endpoint plug.",
+			func(c endpoint.Counters) uint64 { return c.InBytes }, func(c endpoint.Counters) uint64 { return c.OutBytes }},
+		{"vde_endpoint_errors_total", "Frames the endpoint plug failed to forward.",
+			func(c endpoint.Counters) uint64 { return c.InErrors }, func(c endpoint.Counters) uint64 { return c.OutErrors }},
+		{"vde_endpoint_drops_total", "Frames dropped by the endpoint plug.",
+			func(c endpoint.Counters) uint64 { return c.InDrops }, func(c endpoint.Counters) uint64 { return c.OutDrops }},
+	} {
+		metrics.WriteHeader(w, metric.name, "counter", metric.help)
+		for nwkey, nw := range this.Networks {
+			for epkey, ep := range nw.Endpoints {
+				counters := ep.Counters()
+				labels := []metrics.Label{{Name: "network", Value: nwkey}, {Name: "endpoint", Value: epkey}, {Name: "ifname", Value: ep.IfName}}
+				metrics.WriteSample(w, metric.name, float64(metric.in(counters)), append(labels, metrics.Label{Name: "direction", Value: "in"})...)
+				metrics.WriteSample(w, metric.name, float64(metric.out(counters)), append(labels, metrics.Label{Name: "direction", Value: "out"})...)
+			}
+		}
+	}
+}
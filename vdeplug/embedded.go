@@ -0,0 +1,43 @@
+package vdeplug
+
+import (
+	"errors"
+	"sync"
+)
+
+// Opens a new port of a VDE network served inside this process
+type PortOpener func() (Conn, error)
+
+// networks served inside this process (embedded://name), the keys are their names
+var (
+	embeddedMutex sync.RWMutex
+	embedded      = make(map[string]PortOpener)
+)
+
+// Makes the network served by open reachable at embedded://name
+func RegisterEmbedded(name string, open PortOpener) error {
+	embeddedMutex.Lock()
+	defer embeddedMutex.Unlock()
+	if embedded[name] != nil {
+		return errors.New("embedded " + name + ": already registered")
+	}
+	embedded[name] = open
+	return nil
+}
+
+// Removes the network at embedded://name, the ports already open are not affected
+func UnregisterEmbedded(name string) {
+	embeddedMutex.Lock()
+	defer embeddedMutex.Unlock()
+	delete(embedded, name)
+}
+
+func openEmbedded(name string) (Conn, error) {
+	embeddedMutex.RLock()
+	open := embedded[name]
+	embeddedMutex.RUnlock()
+	if open == nil {
+		return nil, errors.New("embedded " + name + ": no such network")
+	}
+	return open()
+}
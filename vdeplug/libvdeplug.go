@@ -0,0 +1,123 @@
+//go:build cgo
+
+package vdeplug
+
+/*
+#cgo LDFLAGS: -lvdeplug
+#define _GNU_SOURCE
+#include <poll.h>
+#include <errno.h>
+#include <stdlib.h>
+#include <unistd.h>
+#include <libvdeplug.h>
+
+static VDECONN *vdeconn_open(char *url)
+{
+  return vde_open(url, "vde_plug_docker", NULL);
+}
+
+// waits for a frame on the data socket or for the wake up of wakefd, returns -1 with ECANCELED when woken up
+static ssize_t vdeconn_recv(VDECONN *conn, void *buf, size_t len, int wakefd)
+{
+  struct pollfd pfd[] = {{vde_datafd(conn), POLLIN, 0}, {wakefd, POLLIN, 0}};
+  while (poll(pfd, 2, -1) < 0)
+    if (errno != EINTR)
+      return -1;
+  if (pfd[1].revents & POLLIN)
+  {
+    errno = ECANCELED;
+    return -1;
+  }
+  return vde_recv(conn, buf, len, 0);
+}
+
+static ssize_t vdeconn_send(VDECONN *conn, void *buf, size_t len)
+{
+  return vde_send(conn, buf, len, 0);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Connection opened through libvdeplug, for the VNL schemes without a native implementation
+type libConn struct {
+	conn *C.VDECONN
+
+	// eventfd waking up the pending Recv when the connection is closed
+	wakefd int
+
+	// held while libvdeplug is using the connection, so that it is not closed under its feet
+	recv, send sync.Mutex
+	once       sync.Once
+}
+
+func openLibvdeplug(vnl string) (Conn, error) {
+	curl := C.CString(vnl)
+	defer C.free(unsafe.Pointer(curl))
+
+	conn, err := C.vdeconn_open(curl)
+	if conn == nil {
+		if err == nil {
+			err = errors.New("vde_open failed")
+		}
+		return nil, errors.New("libvdeplug " + vnl + ": " + err.Error())
+	}
+	wakefd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		C.vde_close(conn)
+		return nil, err
+	}
+	return &libConn{conn: conn, wakefd: wakefd}, nil
+}
+
+func (this *libConn) Recv(buf []byte) (int, error) {
+	this.recv.Lock()
+	defer this.recv.Unlock()
+	if this.conn == nil {
+		return 0, ErrClosed
+	}
+	n, err := C.vdeconn_recv(this.conn, unsafe.Pointer(&buf[0]), C.size_t(len(buf)), C.int(this.wakefd))
+	if n < 0 {
+		if err == syscall.ECANCELED {
+			return 0, ErrClosed
+		}
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (this *libConn) Send(buf []byte) (int, error) {
+	this.send.Lock()
+	defer this.send.Unlock()
+	if this.conn == nil {
+		return 0, ErrClosed
+	}
+	n, err := C.vdeconn_send(this.conn, unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if n < 0 {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (this *libConn) Close() error {
+	this.once.Do(func() {
+		// wake up the pending Recv, then wait for libvdeplug to release the connection
+		unix.Write(this.wakefd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		this.recv.Lock()
+		this.send.Lock()
+		C.vde_close(this.conn)
+		this.conn = nil
+		this.send.Unlock()
+		this.recv.Unlock()
+		unix.Close(this.wakefd)
+	})
+	return nil
+}
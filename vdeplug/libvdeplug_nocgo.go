@@ -0,0 +1,12 @@
+//go:build !cgo
+
+package vdeplug
+
+import (
+	"errors"
+)
+
+// Without cgo only the native schemes are available
+func openLibvdeplug(vnl string) (Conn, error) {
+	return nil, errors.New("libvdeplug " + vnl + ": scheme not supported by a static build")
+}
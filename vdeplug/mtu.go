@@ -0,0 +1,96 @@
+package vdeplug
+
+import (
+	"net"
+	"strings"
+)
+
+// size of the ethernet header of the frames carried by the VDE networks
+const EthHdrLen = 14
+
+// largest MTU of the networks not carried over IP, bound by the buffers of the vde switches
+const MaxMTUDefault = EthBufSize - EthHdrLen - 4
+
+// MTU of the host interfaces assumed when the interface carrying a VNL can't be found
+const HostMTUDefault = 1500
+
+// headers added to every frame by the IP transports
+const (
+	ipv4HdrLen = 20
+	ipv6HdrLen = 40
+	udpHdrLen  = 8
+)
+
+// Returns the largest MTU of the frames carried by the VDE network at vnl without IP fragmentation,
+// the schemes not carried over IP are bound only by the buffers
+func MaxMTU(vnl string) int {
+	if mtu := transportMTU(vnl); mtu < MaxMTUDefault {
+		return mtu
+	}
+	return MaxMTUDefault
+}
+
+// Returns the MTU of the IP transports, MaxMTUDefault for the others
+func transportMTU(vnl string) int {
+	scheme, rest, ok := strings.Cut(vnl, "://")
+	if !ok {
+		return MaxMTUDefault
+	}
+	switch scheme {
+	case "vxvde":
+		addr, options := splitOptions(rest)
+		if addr == "" {
+			addr = vxvdeGroupDefault
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return MaxMTUDefault
+		}
+		// the multicast frames go through the interface given in the options, otherwise by the route to the group
+		mtu := routeMTU(ip)
+		if ifi, err := net.InterfaceByName(options["if"]); err == nil {
+			mtu = ifi.MTU
+		}
+		return mtu - ipHdrLen(ip) - udpHdrLen - vxvdeHdrLen - EthHdrLen
+	case "udp":
+		_, remote, _ := strings.Cut(rest, "/")
+		raddr, err := net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return MaxMTUDefault
+		}
+		return routeMTU(raddr.IP) - ipHdrLen(raddr.IP) - udpHdrLen - EthHdrLen
+	}
+	return MaxMTUDefault
+}
+
+// Returns the MTU of the host interface routing the packets to ip
+func routeMTU(ip net.IP) int {
+	// connecting a UDP socket only selects the route, nothing is sent
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return HostMTUDefault
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return HostMTUDefault
+	}
+	for _, ifi := range interfaces {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return ifi.MTU
+			}
+		}
+	}
+	return HostMTUDefault
+}
+
+func ipHdrLen(ip net.IP) int {
+	if ip.To4() == nil {
+		return ipv6HdrLen
+	}
+	return ipv4HdrLen
+}
@@ -0,0 +1,60 @@
+package vdeplug
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opens the TAP device with the given name in the network namespace of the calling thread,
+// the device is non blocking so that closing the file interrupts pending reads
+func OpenTap(name string) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// TAP device without packet information, equivalent to IFF_TAP | IFF_NO_PI
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF "+name, err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun:"+name), nil
+}
+
+// Connection to a TAP device of the host (tap://name)
+type tapConn struct {
+	file *os.File
+}
+
+func openTap(vnl string) (Conn, error) {
+	name, _ := splitOptions(vnl)
+	file, err := OpenTap(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tapConn{file: file}, nil
+}
+
+func (this *tapConn) Recv(buf []byte) (int, error) {
+	n, err := this.file.Read(buf)
+	if err == os.ErrClosed {
+		err = ErrClosed
+	}
+	return n, err
+}
+
+func (this *tapConn) Send(buf []byte) (int, error) {
+	return this.file.Write(buf)
+}
+
+func (this *tapConn) Close() error {
+	return this.file.Close()
+}
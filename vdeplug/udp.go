@@ -0,0 +1,59 @@
+package vdeplug
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Point to point connection over UDP (udp://[laddr]:lport/raddr:rport), one frame per datagram
+type udpConn struct {
+	sock   *net.UDPConn
+	remote *net.UDPAddr
+}
+
+func openUdp(vnl string) (Conn, error) {
+	local, remote, ok := strings.Cut(vnl, "/")
+	if !ok || remote == "" {
+		return nil, fmt.Errorf("udp: remote address miss in %s", vnl)
+	}
+	if !strings.Contains(local, ":") {
+		local = ":" + local
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{sock: sock, remote: raddr}, nil
+}
+
+func (this *udpConn) Recv(buf []byte) (int, error) {
+	for {
+		n, from, err := this.sock.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return 0, ErrClosed
+		}
+		// datagrams not coming from the peer are dropped
+		if err != nil || from.Port == this.remote.Port && from.IP.Equal(this.remote.IP) {
+			return n, err
+		}
+	}
+}
+
+func (this *udpConn) Send(buf []byte) (int, error) {
+	return this.sock.WriteToUDP(buf, this.remote)
+}
+
+func (this *udpConn) Close() error {
+	return this.sock.Close()
+}
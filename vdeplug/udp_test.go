@@ -0,0 +1,90 @@
+package vdeplug
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUdpOpen(t *testing.T) {
+	tests := []struct {
+		vnl   string
+		fails bool
+	}{
+		{"udp://127.0.0.1:0/127.0.0.1:9", false},
+		{"udp://0/127.0.0.1:9", false},
+		{"udp://127.0.0.1:0", true},
+		{"udp://127.0.0.1:0/", true},
+		{"udp://127.0.0.1:0/nowhere", true},
+	}
+	for _, test := range tests {
+		t.Run(test.vnl, func(t *testing.T) {
+			conn, err := Open(test.vnl)
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != test.fails {
+				t.Errorf("error %v, want failure %v", err, test.fails)
+			}
+		})
+	}
+}
+
+func TestUdpPeerFilter(t *testing.T) {
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	conn, err := Open("udp://127.0.0.1:0/" + peer.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := conn.(*udpConn).sock.LocalAddr().(*net.UDPAddr)
+	frames := receiver(conn)
+
+	// a stranger on the host of the peer, from another port
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	tests := []struct {
+		name   string
+		sender *net.UDPConn
+		passes bool
+	}{
+		{"stranger", stranger, false},
+		{"peer", peer, true},
+	}
+	for i, test := range tests {
+		frame := testFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01", test.name+strconv.Itoa(i))
+		if _, err := test.sender.WriteToUDP(frame, local); err != nil {
+			t.Fatal(err)
+		}
+		got := expectFrame(frames, 200*time.Millisecond)
+		if test.passes && !bytes.Equal(got, frame) {
+			t.Errorf("%s: received %x, want %x", test.name, got, frame)
+		}
+		if !test.passes && got != nil {
+			t.Errorf("%s: received %x", test.name, got)
+		}
+	}
+
+	// frames are sent to the peer
+	frame := testFrame("02:00:00:00:00:02", "02:00:00:00:00:01", "reply")
+	if _, err := conn.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, EthBufSize)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := peer.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Errorf("peer received %x, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,168 @@
+package vdeplug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// constants of the vde_switch control protocol
+const (
+	switchMagic      = 0xfeedface
+	switchVersion    = 3
+	reqNewControl    = 0
+	maxDescr         = 128
+	sockaddrUnLen    = 110
+	vdeCtlDefault    = "/var/run/vde.ctl"
+	vdeDataSockDir   = "/tmp"
+	vdeCtlSocketName = "ctl"
+)
+
+// counter used to name the data sockets of the connections opened by this process
+var vdeSockCounter uint32
+
+// Connection to a vde_switch (vde:///path/to/switch[port]), frames travel on a datagram socket
+// registered through the stream control socket of the switch
+type vdeConn struct {
+	ctl    *net.UnixConn
+	data   *net.UnixConn
+	remote *net.UnixAddr
+	path   string
+	hangup int32
+	closed int32
+	once   sync.Once
+}
+
+func openVde(vnl string) (Conn, error) {
+	path := "/" + strings.TrimPrefix(vnl, "/")
+	port := 0
+
+	// the optional port is given in square brackets
+	if i := strings.LastIndex(path, "["); i >= 0 && strings.HasSuffix(path, "]") {
+		p, err := strconv.Atoi(path[i+1 : len(path)-1])
+		if err != nil {
+			return nil, fmt.Errorf("vde: invalid port in %s", vnl)
+		}
+		path, port = path[:i], p
+	}
+	if path == "/" {
+		path = vdeCtlDefault
+	}
+
+	// new switches have a directory holding the control socket, old ones a single socket
+	ctlpath, sockdir := path, vdeDataSockDir
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		ctlpath, sockdir = filepath.Join(path, vdeCtlSocketName), path
+	}
+
+	ctl, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: ctlpath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// bind the local data socket, the switch sends the frames to it
+	n := atomic.AddUint32(&vdeSockCounter, 1)
+	local := filepath.Join(sockdir, fmt.Sprintf(".%05d-%05d", os.Getpid(), n))
+	os.Remove(local)
+	data, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		ctl.Close()
+		return nil, err
+	}
+
+	conn := &vdeConn{ctl: ctl, data: data, path: local}
+	if conn.remote, err = conn.register(local, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the switch closes the control socket when the port is removed
+	go conn.watch()
+	return conn, nil
+}
+
+// Sends the request for a new port to the switch and returns the address of its data socket
+func (this *vdeConn) register(local string, port int) (*net.UnixAddr, error) {
+	var req bytes.Buffer
+	binary.Write(&req, binary.LittleEndian, uint32(switchMagic))
+	binary.Write(&req, binary.LittleEndian, uint32(switchVersion))
+	binary.Write(&req, binary.LittleEndian, uint32(reqNewControl|port<<8))
+
+	// struct sockaddr_un of the local data socket
+	sun := make([]byte, sockaddrUnLen)
+	binary.LittleEndian.PutUint16(sun, 1 /* AF_UNIX */)
+	copy(sun[2:len(sun)-1], local)
+	req.Write(sun)
+
+	descr := make([]byte, maxDescr)
+	copy(descr[:maxDescr-1], fmt.Sprintf("%s PID=%d", Description, os.Getpid()))
+	req.Write(descr)
+
+	if _, err := this.ctl.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// the reply is the struct sockaddr_un of the switch data socket
+	reply := make([]byte, sockaddrUnLen)
+	n, err := this.ctl.Read(reply)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 2 {
+		return nil, errors.New("vde: switch refused the connection")
+	}
+	name := reply[2:n]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return &net.UnixAddr{Name: string(name), Net: "unixgram"}, nil
+}
+
+// Waits for the switch to close the control socket
+func (this *vdeConn) watch() {
+	buf := make([]byte, 1)
+	for {
+		if _, err := this.ctl.Read(buf); err != nil {
+			if atomic.LoadInt32(&this.closed) == 0 {
+				atomic.StoreInt32(&this.hangup, 1)
+				this.data.Close()
+			}
+			return
+		}
+	}
+}
+
+func (this *vdeConn) Recv(buf []byte) (int, error) {
+	n, _, err := this.data.ReadFromUnix(buf)
+	if err != nil {
+		if atomic.LoadInt32(&this.hangup) != 0 {
+			return 0, nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return 0, ErrClosed
+		}
+	}
+	return n, err
+}
+
+func (this *vdeConn) Send(buf []byte) (int, error) {
+	return this.data.WriteToUnix(buf, this.remote)
+}
+
+func (this *vdeConn) Close() error {
+	this.once.Do(func() {
+		atomic.StoreInt32(&this.closed, 1)
+		this.ctl.Close()
+		this.data.Close()
+		os.Remove(this.path)
+	})
+	return nil
+}
@@ -0,0 +1,178 @@
+package vdeplug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// size of the request for a new port: magic, version, request type and port, sockaddr_un and description
+const switchRequestLen = 12 + sockaddrUnLen + maxDescr
+
+// request received by a fake switch
+type switchRequest struct {
+	magic, version, port uint32
+	sock, descr          string
+}
+
+// Serves a fake vde_switch on the control socket of dir, it answers the first request with the
+// address of its data socket, or with a short reply if refuse is true. The control connection
+// and the data socket are sent on the returned channels
+func fakeSwitch(t *testing.T, dir string, refuse bool) (chan switchRequest, chan net.Conn, *net.UnixConn) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, vdeCtlSocketName), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "data"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		data.Close()
+	})
+
+	requests := make(chan switchRequest, 1)
+	ctls := make(chan net.Conn, 1)
+	go func() {
+		ctl, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, switchRequestLen)
+		if _, err := io.ReadFull(ctl, buf); err != nil {
+			ctl.Close()
+			return
+		}
+		sun := buf[12 : 12+sockaddrUnLen]
+		requests <- switchRequest{
+			magic:   binary.LittleEndian.Uint32(buf[0:4]),
+			version: binary.LittleEndian.Uint32(buf[4:8]),
+			port:    binary.LittleEndian.Uint32(buf[8:12]) >> 8,
+			sock:    string(bytes.TrimRight(sun[2:], "\x00")),
+			descr:   string(bytes.TrimRight(buf[12+sockaddrUnLen:], "\x00")),
+		}
+
+		reply := make([]byte, sockaddrUnLen)
+		binary.LittleEndian.PutUint16(reply, 1)
+		copy(reply[2:], filepath.Join(dir, "data"))
+		if refuse {
+			reply = reply[:2]
+		}
+		ctl.Write(reply)
+		ctls <- ctl
+	}()
+	return requests, ctls, data
+}
+
+func TestVdeRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+		port   uint32
+		refuse bool
+		fails  bool
+	}{
+		{"any port", "", 0, false, false},
+		{"port", "[5]", 5, false, false},
+		{"refused", "", 0, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			requests, _, _ := fakeSwitch(t, dir, test.refuse)
+
+			conn, err := Open("vde://" + dir + test.suffix)
+			if test.fails {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected to a switch refusing the port")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			request := <-requests
+			if request.magic != switchMagic || request.version != switchVersion {
+				t.Errorf("magic %x version %d", request.magic, request.version)
+			}
+			if request.port != test.port {
+				t.Errorf("requested port %d, want %d", request.port, test.port)
+			}
+			if filepath.Dir(request.sock) != dir {
+				t.Errorf("data socket %s is not in the switch directory %s", request.sock, dir)
+			}
+			if !strings.HasPrefix(request.descr, Description) {
+				t.Errorf("description %q", request.descr)
+			}
+		})
+	}
+}
+
+func TestVdeInvalidPort(t *testing.T) {
+	if conn, err := Open("vde://" + t.TempDir() + "[x]"); err == nil {
+		conn.Close()
+		t.Error("opened a switch with an invalid port")
+	}
+}
+
+func TestVdeFrames(t *testing.T) {
+	dir := t.TempDir()
+	requests, ctls, data := fakeSwitch(t, dir, false)
+
+	conn, err := Open("vde://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := <-requests
+	frames := receiver(conn)
+
+	// frames sent by the plug reach the data socket of the switch
+	frame := testFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01", "to the switch")
+	if _, err := conn.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, EthBufSize)
+	data.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := data.ReadFromUnix(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], frame) || from.Name != request.sock {
+		t.Errorf("switch received %x from %s", buf[:n], from.Name)
+	}
+
+	// frames of the switch are received by the plug
+	frame = testFrame("02:00:00:00:00:01", "02:00:00:00:00:02", "from the switch")
+	if _, err := data.WriteToUnix(frame, &net.UnixAddr{Name: request.sock, Net: "unixgram"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectFrame(frames, time.Second); !bytes.Equal(got, frame) {
+		t.Fatalf("received %x, want %x", got, frame)
+	}
+
+	// the switch removing the port hangs up the connection, its data socket is removed on Close
+	(<-ctls).Close()
+	select {
+	case frame, ok := <-frames:
+		if ok {
+			t.Fatalf("received %x after the hang up", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the hang up of the switch has not been noticed")
+	}
+	conn.Close()
+	if _, err := os.Stat(request.sock); !os.IsNotExist(err) {
+		t.Errorf("data socket %s left behind: %v", request.sock, err)
+	}
+}
@@ -0,0 +1,81 @@
+// Connections to VDE networks given in VNL syntax (e.g. vxvde://239.1.2.3)
+//
+// The most common schemes (vde, vxvde, udp and tap) are implemented in Go, any other
+// scheme is opened through libvdeplug when the plugin is built with cgo. The embedded
+// scheme reaches the networks served inside the plugin itself.
+package vdeplug
+
+import (
+	"errors"
+	"strings"
+)
+
+// size of the buffers holding an ethernet frame, same as VDE_ETHBUFSIZE of libvdeplug
+const EthBufSize = 9216 + 14 + 4
+
+// description of the plugin sent to the VDE switches
+const Description = "vde_plug_docker"
+
+// ErrClosed is returned by Recv and Send once the connection has been closed
+var ErrClosed = errors.New("vdeplug: connection closed")
+
+// Connection to a VDE network, it carries one ethernet frame per call
+type Conn interface {
+	// Receives a frame from the VDE network, returns 0 and nil error when the network hangs up
+	Recv(buf []byte) (int, error)
+
+	// Sends a frame to the VDE network
+	Send(buf []byte) (int, error)
+
+	// Closes the connection, pending Recv calls return ErrClosed
+	Close() error
+}
+
+// Opens a native connection to the VNL given without the scheme
+type opener func(vnl string) (Conn, error)
+
+// key-value pairs where keys are the VNL schemes implemented in Go and values are their openers
+var schemes = map[string]opener{
+	"vde":   openVde,
+	"vxvde": openVxvde,
+	"udp":   openUdp,
+	"tap":   openTap,
+
+	// networks served inside the plugin, such as the embedded switches
+	"embedded": openEmbedded,
+}
+
+// Opens a connection to the VDE network at vnl, schemes without a native implementation
+// go through libvdeplug
+func Open(vnl string) (Conn, error) {
+	if scheme, rest, ok := strings.Cut(vnl, "://"); ok {
+		if open := schemes[scheme]; open != nil {
+			return open(rest)
+		}
+	} else if strings.HasPrefix(vnl, "/") {
+		// plain paths are vde switches, as in libvdeplug
+		return openVde(vnl)
+	}
+	return openLibvdeplug(vnl)
+}
+
+// Returns true if the scheme of vnl is implemented in Go
+func Native(vnl string) bool {
+	scheme, _, ok := strings.Cut(vnl, "://")
+	return !ok && strings.HasPrefix(vnl, "/") || schemes[scheme] != nil
+}
+
+// Splits the VNL options, given as /key=value suffixes, from the address part
+func splitOptions(vnl string) (string, map[string]string) {
+	options := make(map[string]string)
+	parts := strings.Split(vnl, "/")
+	addr := parts[0]
+	for _, part := range parts[1:] {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			options[key] = value
+		} else if part != "" {
+			options[part] = ""
+		}
+	}
+	return addr, options
+}
@@ -0,0 +1,249 @@
+package vdeplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaults of the vxvde scheme, same as libvdeplug
+const (
+	vxvdeGroupDefault = "239.0.0.1"
+	vxvdePortDefault  = 14789
+	vxvdeVniDefault   = 1
+	vxvdeTtlDefault   = 1
+	vxvdeHdrLen       = 8
+	vxvdeFlagVni      = 0x08
+)
+
+// Connection to a vxvde network (vxvde://group/port=N/vni=N/ttl=N): frames are encapsulated in
+// VXLAN headers and sent to a multicast group, peers are learnt from their source MAC address
+// so that frames to known destinations are sent in unicast
+type vxvdeConn struct {
+	mcast *net.UDPConn
+	ucast *net.UDPConn
+	group *net.UDPAddr
+	vni   uint32
+	self  map[string]bool
+
+	// key-value pairs where keys are MAC addresses and values are the addresses of the peers
+	mutex sync.RWMutex
+	peers map[string]*net.UDPAddr
+
+	// frames received from both sockets
+	frames chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func openVxvde(vnl string) (Conn, error) {
+	addr, options := splitOptions(vnl)
+	if addr == "" {
+		addr = vxvdeGroupDefault
+	}
+	group := net.ParseIP(addr)
+	if group == nil || !group.IsMulticast() {
+		return nil, fmt.Errorf("vxvde: %s is not a multicast address", addr)
+	}
+
+	port, vni, ttl := vxvdePortDefault, vxvdeVniDefault, vxvdeTtlDefault
+	for key, dest := range map[string]*int{"port": &port, "vni": &vni, "ttl": &ttl} {
+		if value, ok := options[key]; ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("vxvde: invalid %s %s", key, value)
+			}
+			*dest = n
+		}
+	}
+
+	network := "udp4"
+	if group.To4() == nil {
+		network = "udp6"
+	}
+	var ifi *net.Interface
+	if name := options["if"]; name != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// shared socket receiving the multicast traffic of the group
+	groupaddr := &net.UDPAddr{IP: group, Port: port}
+	mcast, err := net.ListenMulticastUDP(network, ifi, groupaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// private socket sending the frames and receiving the unicast replies, its address identifies this peer
+	ucast, err := net.ListenUDP(network, &net.UDPAddr{})
+	if err != nil {
+		mcast.Close()
+		return nil, err
+	}
+	if err := setMulticastOptions(ucast, network, ifi, ttl); err != nil {
+		mcast.Close()
+		ucast.Close()
+		return nil, err
+	}
+	return newVxvdeConn(mcast, ucast, groupaddr, uint32(vni)), nil
+}
+
+// Returns the connection of the VNI vni receiving the frames from mcast and ucast, it sends them from
+// ucast to group or to the peers learnt
+func newVxvdeConn(mcast, ucast *net.UDPConn, group *net.UDPAddr, vni uint32) *vxvdeConn {
+	conn := &vxvdeConn{
+		mcast:  mcast,
+		ucast:  ucast,
+		group:  group,
+		vni:    vni,
+		self:   make(map[string]bool),
+		peers:  make(map[string]*net.UDPAddr),
+		frames: make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+
+	// the frames sent by this peer come back through the group
+	localport := ucast.LocalAddr().(*net.UDPAddr).Port
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				conn.self[(&net.UDPAddr{IP: ipnet.IP, Port: localport}).String()] = true
+			}
+		}
+	}
+
+	go conn.receive(conn.mcast)
+	go conn.receive(conn.ucast)
+	return conn
+}
+
+// Sets TTL, loopback and interface of the multicast frames sent by the private socket
+func setMulticastOptions(sock *net.UDPConn, network string, ifi *net.Interface, ttl int) error {
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if network == "udp4" {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl)
+			if serr == nil {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_LOOP, 1)
+			}
+			if serr == nil && ifi != nil {
+				serr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(ifi.Index)})
+			}
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl)
+			if serr == nil {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_LOOP, 1)
+			}
+			if serr == nil && ifi != nil {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifi.Index)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Decapsulates the datagrams of a socket, drops the ones sent by this peer or with another VNI
+func (this *vxvdeConn) receive(sock *net.UDPConn) {
+	for {
+		buf := make([]byte, EthBufSize+vxvdeHdrLen)
+		n, from, err := sock.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if this.self[from.String()] {
+			continue
+		}
+		frame := vxvdeDecap(buf[:n], this.vni)
+		if frame == nil {
+			continue
+		}
+
+		// learn where the source MAC address lives
+		this.mutex.Lock()
+		this.peers[string(frame[6:12])] = from
+		this.mutex.Unlock()
+
+		select {
+		case this.frames <- frame:
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// Returns frame in a VXLAN header carrying vni
+func vxvdeEncap(frame []byte, vni uint32) []byte {
+	packet := make([]byte, vxvdeHdrLen+len(frame))
+	packet[0] = vxvdeFlagVni
+	binary.BigEndian.PutUint32(packet[4:8], vni<<8)
+	copy(packet[vxvdeHdrLen:], frame)
+	return packet
+}
+
+// Returns the frame in packet, nil if packet is not a VXLAN packet of vni holding an ethernet frame
+func vxvdeDecap(packet []byte, vni uint32) []byte {
+	if len(packet) < vxvdeHdrLen+14 || packet[0]&vxvdeFlagVni == 0 {
+		return nil
+	}
+	if binary.BigEndian.Uint32(packet[4:8])>>8 != vni {
+		return nil
+	}
+	return packet[vxvdeHdrLen:]
+}
+
+func (this *vxvdeConn) Recv(buf []byte) (int, error) {
+	select {
+	case frame := <-this.frames:
+		return copy(buf, frame), nil
+	case <-this.done:
+		return 0, ErrClosed
+	}
+}
+
+func (this *vxvdeConn) Send(buf []byte) (int, error) {
+	if len(buf) < 14 {
+		return 0, syscall.EINVAL
+	}
+	packet := vxvdeEncap(buf, this.vni)
+
+	// unicast destinations already seen are reached directly, the others through the group
+	dest := this.group
+	if buf[0]&0x01 == 0 {
+		this.mutex.RLock()
+		if peer := this.peers[string(buf[0:6])]; peer != nil {
+			dest = peer
+		}
+		this.mutex.RUnlock()
+	}
+	if _, err := this.ucast.WriteToUDP(packet, dest); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (this *vxvdeConn) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+		this.mcast.Close()
+		this.ucast.Close()
+	})
+	return nil
+}
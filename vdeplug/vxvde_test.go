@@ -0,0 +1,168 @@
+package vdeplug
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// ethernet frame from src to dst carrying payload
+func testFrame(dst, src string, payload string) []byte {
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	frame := append(append(append([]byte{}, d...), s...), 0x88, 0xb5)
+	return append(frame, payload...)
+}
+
+func TestVxvdeEncap(t *testing.T) {
+	frame := testFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:01", "hello")
+	tests := []struct {
+		name   string
+		packet []byte
+		vni    uint32
+		want   []byte
+	}{
+		{"same vni", vxvdeEncap(frame, 42), 42, frame},
+		{"largest vni", vxvdeEncap(frame, 0xffffff), 0xffffff, frame},
+		{"other vni", vxvdeEncap(frame, 42), 43, nil},
+		{"no vni flag", append([]byte{0, 0, 0, 0, 0, 0, 42, 0}, frame...), 42, nil},
+		{"short", vxvdeEncap(frame[:13], 42), 42, nil},
+		{"header only", vxvdeEncap(nil, 42)[:vxvdeHdrLen], 42, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := vxvdeDecap(test.packet, test.vni); !bytes.Equal(got, test.want) {
+				t.Errorf("decapsulated %x, want %x", got, test.want)
+			}
+		})
+	}
+
+	// VXLAN header: flags, 3 reserved bytes, 24 bit VNI and a reserved byte
+	if got := vxvdeEncap(frame, 0x123456)[:vxvdeHdrLen]; !bytes.Equal(got, []byte{0x08, 0, 0, 0, 0x12, 0x34, 0x56, 0}) {
+		t.Errorf("header %x", got)
+	}
+}
+
+// vxvde connection whose group is a plain UDP socket on the loopback, so that no multicast route is needed
+func newTestVxvde(t *testing.T, vni uint32, group *net.UDPConn) *vxvdeConn {
+	mcast, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ucast, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group == nil {
+		group = mcast
+	}
+	conn := newVxvdeConn(mcast, ucast, group.LocalAddr().(*net.UDPAddr), vni)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// channel of the frames received by conn, closed when Recv fails
+func receiver(conn Conn) chan []byte {
+	frames := make(chan []byte, 16)
+	go func() {
+		defer close(frames)
+		for {
+			buf := make([]byte, EthBufSize)
+			n, err := conn.Recv(buf)
+			if n == 0 || err != nil {
+				return
+			}
+			frames <- buf[:n]
+		}
+	}()
+	return frames
+}
+
+// returns the next frame of frames, nil if none arrives in time
+func expectFrame(frames chan []byte, timeout time.Duration) []byte {
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestVxvdeLearning(t *testing.T) {
+	// the group of a has b as its only member
+	b := newTestVxvde(t, 7, nil)
+	a := newTestVxvde(t, 7, b.mcast)
+
+	// a broadcast reaches b through the group, b learns where a lives
+	broadcast := testFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:0a", "who has")
+	aframes, bframes := receiver(a), receiver(b)
+	if _, err := a.Send(broadcast); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectFrame(bframes, time.Second); !bytes.Equal(got, broadcast) {
+		t.Fatalf("b received %x, want %x", got, broadcast)
+	}
+
+	// the reply of b goes to a in unicast, the group of b is its own socket
+	reply := testFrame("02:00:00:00:00:0a", "02:00:00:00:00:0b", "is at")
+	if _, err := b.Send(reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectFrame(aframes, time.Second); !bytes.Equal(got, reply) {
+		t.Fatalf("a received %x, want %x", got, reply)
+	}
+	b.mutex.RLock()
+	peer := b.peers[string(reply[0:6])]
+	b.mutex.RUnlock()
+	if peer == nil || peer.String() != a.ucast.LocalAddr().String() {
+		t.Errorf("b learnt %v for a, want %v", peer, a.ucast.LocalAddr())
+	}
+}
+
+func TestVxvdeFilter(t *testing.T) {
+	conn := newTestVxvde(t, 7, nil)
+	sender, err := net.DialUDP("udp4", nil, conn.mcast.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	frames := receiver(conn)
+	frame := testFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:0c", "vni")
+	for _, packet := range [][]byte{
+		vxvdeEncap(frame, 8),
+		frame,
+		vxvdeEncap(frame[:10], 7),
+	} {
+		if _, err := sender.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := expectFrame(frames, 200*time.Millisecond); got != nil {
+		t.Fatalf("received %x from another VNI or a malformed packet", got)
+	}
+
+	// the frames sent by the connection itself come back through the group and are dropped
+	if _, err := conn.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectFrame(frames, 200*time.Millisecond); got != nil {
+		t.Fatalf("received its own frame %x", got)
+	}
+
+	if _, err := sender.Write(vxvdeEncap(frame, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectFrame(frames, time.Second); !bytes.Equal(got, frame) {
+		t.Fatalf("received %x, want %x", got, frame)
+	}
+}
+
+func TestVxvdeClose(t *testing.T) {
+	conn := newTestVxvde(t, 1, nil)
+	conn.Close()
+	if _, err := conn.Recv(make([]byte, EthBufSize)); err != ErrClosed {
+		t.Errorf("Recv after Close returned %v, want ErrClosed", err)
+	}
+}
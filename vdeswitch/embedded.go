@@ -0,0 +1,352 @@
+package vdeswitch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"phocs/vde_plug_docker/vdeplug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// time after which a MAC address not seen is forgotten, as in vde_switch
+const AgingTime = 300 * time.Second
+
+// frames queued for each port of the embedded switch, further frames are dropped
+const PortQueueLen = 256
+
+// port of the uplink, the ports of the endpoints start from 1
+const uplinkPort = 0
+
+// ErrSwitchClosed is returned by Send once the switch has been stopped
+var ErrSwitchClosed = errors.New("vdeswitch: switch closed")
+
+// Learning ethernet switch running inside the plugin, the endpoints open its ports at embedded://name
+// and the frames that leave the host go through the uplink
+type Embedded struct {
+	name string
+
+	// ports and MAC address table
+	mutex    sync.Mutex
+	ports    map[int]*port
+	nextPort int
+	table    map[[6]byte]macEntry
+
+	// connection to the uplink VNL, replaced by SetUplink
+	uplinkMutex sync.Mutex
+	uplink      *uplink
+
+	// closed when the switch is stopped
+	done chan struct{}
+	once sync.Once
+}
+
+// port and last time a MAC address has been seen
+type macEntry struct {
+	port int
+	seen time.Time
+}
+
+// Starts an embedded switch reachable at embedded://name, connected to the uplink VNL if not empty
+func StartEmbedded(name string, uplink string) (*Embedded, error) {
+	this := &Embedded{
+		name:     name,
+		ports:    make(map[int]*port),
+		nextPort: uplinkPort + 1,
+		table:    make(map[[6]byte]macEntry),
+		done:     make(chan struct{}),
+	}
+	if err := vdeplug.RegisterEmbedded(name, this.open); err != nil {
+		return nil, err
+	}
+	this.SetUplink(uplink)
+	go this.age()
+	log.Debugf("Embedded switch started: [ %s ] uplink [ %s ]", name, uplink)
+	return this, nil
+}
+
+// Returns the VNL of the switch
+func (this *Embedded) VNL() string {
+	return "embedded://" + this.name
+}
+
+// Connects the switch to another uplink VNL, an empty vnl disconnects it
+func (this *Embedded) SetUplink(vnl string) {
+	var up *uplink
+	if vnl != "" {
+		up = startUplink(this, vnl)
+	}
+	this.uplinkMutex.Lock()
+	old := this.uplink
+	this.uplink = up
+	this.uplinkMutex.Unlock()
+
+	// the old uplink may be forwarding a frame to the switch
+	if old != nil {
+		old.stop()
+	}
+}
+
+// Stops the switch, the ports hang up
+func (this *Embedded) Close() error {
+	this.once.Do(func() {
+		vdeplug.UnregisterEmbedded(this.name)
+		close(this.done)
+		this.SetUplink("")
+		log.Debugf("Embedded switch stopped: [ %s ]", this.name)
+	})
+	return nil
+}
+
+// Opens a new port of the switch
+func (this *Embedded) open() (vdeplug.Conn, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	select {
+	case <-this.done:
+		return nil, ErrSwitchClosed
+	default:
+	}
+	p := &port{sw: this, id: this.nextPort, queue: make(chan []byte, PortQueueLen), closed: make(chan struct{})}
+	this.ports[p.id] = p
+	this.nextPort++
+	return p, nil
+}
+
+// Removes a port and the MAC addresses learnt on it
+func (this *Embedded) detach(id int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.ports, id)
+	for mac, entry := range this.table {
+		if entry.port == id {
+			delete(this.table, mac)
+		}
+	}
+}
+
+// Learns the source address of a frame received on port src and forwards it,
+// to the port of its destination if known, otherwise to every other port
+func (this *Embedded) forward(src int, frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	var dst, from [6]byte
+	copy(dst[:], frame[0:6])
+	copy(from[:], frame[6:12])
+	now := time.Now()
+
+	this.mutex.Lock()
+	// multicast source addresses are bogus
+	if from[0]&1 == 0 {
+		this.table[from] = macEntry{port: src, seen: now}
+	}
+	var targets []*port
+	toUplink := false
+	if entry, ok := this.table[dst]; ok && dst[0]&1 == 0 && now.Sub(entry.seen) < AgingTime {
+		// known destination, frames for the port they come from are not forwarded
+		switch p := this.ports[entry.port]; {
+		case entry.port == src:
+		case entry.port == uplinkPort:
+			toUplink = true
+		case p != nil:
+			targets = append(targets, p)
+		}
+	} else {
+		// broadcast, multicast or unknown destination
+		for id, p := range this.ports {
+			if id != src {
+				targets = append(targets, p)
+			}
+		}
+		toUplink = src != uplinkPort
+	}
+	this.mutex.Unlock()
+
+	if toUplink {
+		this.uplinkMutex.Lock()
+		up := this.uplink
+		this.uplinkMutex.Unlock()
+		if up != nil {
+			up.send(frame)
+		}
+	}
+	for _, p := range targets {
+		p.deliver(frame)
+	}
+}
+
+// Forgets the MAC addresses not seen for AgingTime
+func (this *Embedded) age() {
+	ticker := time.NewTicker(AgingTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.done:
+			return
+		case now := <-ticker.C:
+			this.expire(now)
+		}
+	}
+}
+
+// Forgets the MAC addresses not seen for AgingTime at now
+func (this *Embedded) expire(now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for mac, entry := range this.table {
+		if now.Sub(entry.seen) >= AgingTime {
+			delete(this.table, mac)
+		}
+	}
+}
+
+// Port of the embedded switch opened by an endpoint, frames are handed over in memory
+type port struct {
+	sw     *Embedded
+	id     int
+	queue  chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Queues a copy of a frame for the endpoint, drops it if the endpoint can't keep up
+func (this *port) deliver(frame []byte) {
+	select {
+	case this.queue <- append([]byte(nil), frame...):
+	default:
+	}
+}
+
+// Receives the next frame forwarded to the port, returns 0 when the switch is stopped
+func (this *port) Recv(buf []byte) (int, error) {
+	select {
+	case frame := <-this.queue:
+		return copy(buf, frame), nil
+	case <-this.closed:
+		return 0, vdeplug.ErrClosed
+	case <-this.sw.done:
+		return 0, nil
+	}
+}
+
+// Forwards a frame sent by the endpoint
+func (this *port) Send(buf []byte) (int, error) {
+	select {
+	case <-this.closed:
+		return 0, vdeplug.ErrClosed
+	case <-this.sw.done:
+		return 0, ErrSwitchClosed
+	default:
+	}
+	this.sw.forward(this.id, buf)
+	return len(buf), nil
+}
+
+func (this *port) Close() error {
+	this.once.Do(func() {
+		close(this.closed)
+		this.sw.detach(this.id)
+	})
+	return nil
+}
+
+// Connection of the embedded switch to its uplink VNL, opened again when it hangs up
+type uplink struct {
+	sw  *Embedded
+	vnl string
+
+	mutex sync.RWMutex
+	conn  vdeplug.Conn
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startUplink(sw *Embedded, vnl string) *uplink {
+	this := &uplink{sw: sw, vnl: vnl, done: make(chan struct{})}
+	this.wg.Add(1)
+	go this.run()
+	return this
+}
+
+// Connects to the uplink with exponential backoff and forwards the frames it receives to the switch
+func (this *uplink) run() {
+	defer this.wg.Done()
+	buf := make([]byte, vdeplug.EthBufSize)
+	delay := RestartMinDelay
+	for {
+		conn, err := vdeplug.Open(this.vnl)
+		if err != nil {
+			log.Debugf("Embedded switch [ %s ]: uplink [ %s ] in %s: [ %s ]", this.sw.name, this.vnl, delay, err)
+			select {
+			case <-this.done:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > RestartMaxDelay {
+				delay = RestartMaxDelay
+			}
+			continue
+		}
+		delay = RestartMinDelay
+		if !this.setConn(conn) {
+			return
+		}
+		log.Infof("Embedded switch [ %s ]: uplink connected to [ %s ]", this.sw.name, this.vnl)
+
+		for {
+			n, err := conn.Recv(buf)
+			if n == 0 || err != nil {
+				break
+			}
+			this.sw.forward(uplinkPort, buf[:n])
+		}
+		this.setConn(nil)
+		conn.Close()
+
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+		log.Warnf("Embedded switch [ %s ]: uplink [ %s ] disconnected", this.sw.name, this.vnl)
+	}
+}
+
+// Replaces the uplink connection, returns false and closes conn if the uplink has been stopped
+func (this *uplink) setConn(conn vdeplug.Conn) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	select {
+	case <-this.done:
+		if conn != nil {
+			conn.Close()
+			return false
+		}
+	default:
+	}
+	this.conn = conn
+	return true
+}
+
+// Sends a frame to the uplink, it is dropped while the uplink is disconnected
+func (this *uplink) send(frame []byte) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.conn != nil {
+		this.conn.Send(frame)
+	}
+}
+
+// Disconnects the uplink and waits for its goroutine to exit
+func (this *uplink) stop() {
+	this.mutex.Lock()
+	close(this.done)
+	if this.conn != nil {
+		this.conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+}
@@ -0,0 +1,334 @@
+package vdeswitch
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"phocs/vde_plug_docker/vdeplug"
+)
+
+var (
+	macA = "02:00:00:00:00:0a"
+	macB = "02:00:00:00:00:0b"
+	macC = "02:00:00:00:00:0c"
+	macU = "02:00:00:00:00:ee"
+)
+
+// connection to a fake uplink VNL, the test delivers the frames and hangs it up
+type fakeConn struct {
+	frames chan []byte
+	sent   chan []byte
+	hangup chan struct{}
+	closed chan struct{}
+	closes int32
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		frames: make(chan []byte, 16),
+		sent:   make(chan []byte, 16),
+		hangup: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (this *fakeConn) Recv(buf []byte) (int, error) {
+	select {
+	case frame := <-this.frames:
+		return copy(buf, frame), nil
+	case <-this.hangup:
+		return 0, nil
+	case <-this.closed:
+		return 0, vdeplug.ErrClosed
+	}
+}
+
+func (this *fakeConn) Send(buf []byte) (int, error) {
+	this.sent <- append([]byte(nil), buf...)
+	return len(buf), nil
+}
+
+func (this *fakeConn) Close() error {
+	atomic.AddInt32(&this.closes, 1)
+	this.once.Do(func() { close(this.closed) })
+	return nil
+}
+
+// ethernet frame from src to dst, the MAC addresses are written as strings
+func testFrame(dst, src string, payload string) []byte {
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	frame := append(append(append([]byte{}, d...), s...), 0x88, 0xb5)
+	return append(frame, payload...)
+}
+
+// Starts a switch named after the test, its uplink is a fake network whose connections are sent on the returned channel
+func startTestSwitch(t *testing.T, withUplink bool) (*Embedded, chan *fakeConn) {
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	conns := make(chan *fakeConn, 16)
+	uplink := ""
+	if withUplink {
+		err := vdeplug.RegisterEmbedded(name+"_uplink", func() (vdeplug.Conn, error) {
+			conn := newFakeConn()
+			conns <- conn
+			return conn, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uplink = "embedded://" + name + "_uplink"
+	}
+	sw, err := StartEmbedded(name, uplink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sw.Close()
+		vdeplug.UnregisterEmbedded(name + "_uplink")
+	})
+	return sw, conns
+}
+
+// port of the switch opened as an endpoint does, with the frames it receives
+type testPort struct {
+	conn   vdeplug.Conn
+	frames chan []byte
+}
+
+func openPort(t *testing.T, sw *Embedded) *testPort {
+	conn, err := vdeplug.Open(sw.VNL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &testPort{conn: conn, frames: make(chan []byte, 16)}
+	go func() {
+		defer close(this.frames)
+		buf := make([]byte, vdeplug.EthBufSize)
+		for {
+			n, err := conn.Recv(buf)
+			if n == 0 || err != nil {
+				return
+			}
+			this.frames <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return this
+}
+
+func (this *testPort) send(t *testing.T, frame []byte) {
+	if _, err := this.conn.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns the next frame received by the port, nil if none is received in time
+func (this *testPort) expect(timeout time.Duration) []byte {
+	select {
+	case frame := <-this.frames:
+		return frame
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Checks that exactly the ports in want receive frame
+func expectDelivery(t *testing.T, ports map[string]*testPort, frame []byte, want ...string) {
+	t.Helper()
+	for name, p := range ports {
+		wanted := false
+		for _, w := range want {
+			wanted = wanted || w == name
+		}
+		timeout := time.Second
+		if !wanted {
+			timeout = 50 * time.Millisecond
+		}
+		got := p.expect(timeout)
+		if wanted && !bytes.Equal(got, frame) {
+			t.Errorf("port %s received %x, want %x", name, got, frame)
+		}
+		if !wanted && got != nil {
+			t.Errorf("port %s received %x", name, got)
+		}
+	}
+}
+
+func TestEmbeddedForward(t *testing.T) {
+	sw, _ := startTestSwitch(t, false)
+	ports := map[string]*testPort{"p1": openPort(t, sw), "p2": openPort(t, sw), "p3": openPort(t, sw)}
+
+	tests := []struct {
+		name     string
+		from     string
+		frame    []byte
+		received []string
+	}{
+		// A is learnt on p1, the broadcast is not echoed back to it
+		{"broadcast", "p1", testFrame("ff:ff:ff:ff:ff:ff", macA, "hello"), []string{"p2", "p3"}},
+		{"to learnt", "p2", testFrame(macA, macB, "to A"), []string{"p1"}},
+		{"to unknown", "p1", testFrame(macC, macA, "to C"), []string{"p2", "p3"}},
+		{"to learnt again", "p1", testFrame(macB, macA, "to B"), []string{"p2"}},
+		{"multicast", "p3", testFrame("01:00:5e:00:00:01", macC, "group"), []string{"p1", "p2"}},
+		// the destination is on the port of the sender
+		{"to own port", "p1", testFrame(macA, macA, "loop"), nil},
+		{"runt", "p1", testFrame(macB, macA, "")[:13], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ports[test.from].send(t, test.frame)
+			expectDelivery(t, ports, test.frame, test.received...)
+		})
+	}
+}
+
+func TestEmbeddedAging(t *testing.T) {
+	sw, _ := startTestSwitch(t, false)
+	ports := map[string]*testPort{"p1": openPort(t, sw), "p2": openPort(t, sw), "p3": openPort(t, sw)}
+
+	// learn A on p1 and B on p2
+	ports["p1"].send(t, testFrame("ff:ff:ff:ff:ff:ff", macA, "A"))
+	expectDelivery(t, ports, testFrame("ff:ff:ff:ff:ff:ff", macA, "A"), "p2", "p3")
+	ports["p2"].send(t, testFrame("ff:ff:ff:ff:ff:ff", macB, "B"))
+	expectDelivery(t, ports, testFrame("ff:ff:ff:ff:ff:ff", macB, "B"), "p1", "p3")
+
+	// A was seen AgingTime ago, the frames for it are flooded
+	var a [6]byte
+	mac, _ := net.ParseMAC(macA)
+	copy(a[:], mac)
+	sw.mutex.Lock()
+	sw.table[a] = macEntry{port: sw.table[a].port, seen: time.Now().Add(-AgingTime)}
+	sw.mutex.Unlock()
+	frame := testFrame(macA, macC, "to stale A")
+	ports["p3"].send(t, frame)
+	expectDelivery(t, ports, frame, "p1", "p2")
+
+	// the sweep forgets A and keeps B
+	sw.expire(time.Now())
+	sw.mutex.Lock()
+	_, stale := sw.table[a]
+	entries := len(sw.table)
+	sw.mutex.Unlock()
+	if stale || entries != 2 {
+		t.Errorf("stale entry kept %v, %d entries, want B and C", stale, entries)
+	}
+	sw.expire(time.Now().Add(AgingTime))
+	sw.mutex.Lock()
+	entries = len(sw.table)
+	sw.mutex.Unlock()
+	if entries != 0 {
+		t.Errorf("%d entries after AgingTime", entries)
+	}
+
+	// a closed port forgets its addresses
+	ports["p2"].send(t, testFrame("ff:ff:ff:ff:ff:ff", macB, "B again"))
+	expectDelivery(t, ports, testFrame("ff:ff:ff:ff:ff:ff", macB, "B again"), "p1", "p3")
+	ports["p2"].conn.Close()
+	delete(ports, "p2")
+	frame = testFrame(macB, macA, "to gone B")
+	ports["p1"].send(t, frame)
+	expectDelivery(t, ports, frame, "p3")
+}
+
+func TestEmbeddedUplink(t *testing.T) {
+	sw, conns := startTestSwitch(t, true)
+	first := <-conns
+	ports := map[string]*testPort{"p1": openPort(t, sw), "p2": openPort(t, sw)}
+	waitUplink(t, sw, first)
+
+	// frames of the ports for unknown destinations leave through the uplink
+	frame := testFrame("ff:ff:ff:ff:ff:ff", macA, "to everyone")
+	ports["p1"].send(t, frame)
+	expectDelivery(t, ports, frame, "p2")
+	if got := expectSent(first, time.Second); !bytes.Equal(got, frame) {
+		t.Errorf("uplink sent %x, want %x", got, frame)
+	}
+
+	// frames of the uplink reach the ports, U is learnt on the uplink
+	frame = testFrame(macA, macU, "from the uplink")
+	first.frames <- frame
+	expectDelivery(t, ports, frame, "p1")
+	frame = testFrame(macU, macB, "to U")
+	ports["p2"].send(t, frame)
+	expectDelivery(t, ports, frame)
+	if got := expectSent(first, time.Second); !bytes.Equal(got, frame) {
+		t.Errorf("uplink sent %x, want %x", got, frame)
+	}
+
+	// frames for the ports are not sent back to the uplink
+	frame = testFrame(macA, macB, "local")
+	ports["p2"].send(t, frame)
+	expectDelivery(t, ports, frame, "p1")
+	if got := expectSent(first, 50*time.Millisecond); got != nil {
+		t.Errorf("uplink sent %x", got)
+	}
+
+	// the uplink hangs up, the switch connects again
+	close(first.hangup)
+	var second *fakeConn
+	select {
+	case second = <-conns:
+	case <-time.After(10 * RestartMinDelay):
+		t.Fatal("the uplink did not reconnect")
+	}
+	waitUplink(t, sw, second)
+	if atomic.LoadInt32(&first.closes) == 0 {
+		t.Error("first uplink connection not closed")
+	}
+	frame = testFrame("ff:ff:ff:ff:ff:ff", macA, "after the reconnect")
+	ports["p1"].send(t, frame)
+	expectDelivery(t, ports, frame, "p2")
+	if got := expectSent(second, time.Second); !bytes.Equal(got, frame) {
+		t.Errorf("uplink sent %x, want %x", got, frame)
+	}
+	frame = testFrame(macB, macU, "from the new uplink")
+	second.frames <- frame
+	expectDelivery(t, ports, frame, "p2")
+
+	// the switch stops, the uplink is closed and the ports hang up
+	sw.Close()
+	if atomic.LoadInt32(&second.closes) == 0 {
+		t.Error("second uplink connection not closed")
+	}
+	for name, p := range ports {
+		if _, ok := <-p.frames; ok {
+			t.Errorf("port %s received a frame after Close", name)
+		}
+	}
+	if _, err := vdeplug.Open(sw.VNL()); err == nil {
+		t.Error("opened a port of a stopped switch")
+	}
+}
+
+// waits until the switch sends to the uplink through conn
+func waitUplink(t *testing.T, sw *Embedded, conn *fakeConn) {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sw.uplinkMutex.Lock()
+		up := sw.uplink
+		sw.uplinkMutex.Unlock()
+		up.mutex.RLock()
+		connected := up.conn == vdeplug.Conn(conn)
+		up.mutex.RUnlock()
+		if connected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the uplink is not connected")
+		}
+	}
+}
+
+func expectSent(conn *fakeConn, timeout time.Duration) []byte {
+	select {
+	case frame := <-conn.sent:
+		return frame
+	case <-time.After(timeout):
+		return nil
+	}
+}
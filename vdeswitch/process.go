@@ -0,0 +1,167 @@
+package vdeswitch
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vde_switch executable, found in PATH unless it is a path
+var Command = "vde_switch"
+
+// ports of a vde_switch, one for each endpoint of the network and one for the uplinks
+const NumPorts = 256
+
+// time given to a vde_switch to create its control socket
+const StartTimeout = 5 * time.Second
+
+// bounds of the exponential backoff between restarts of a vde_switch that exited
+const (
+	RestartMinDelay = 100 * time.Millisecond
+	RestartMaxDelay = 30 * time.Second
+)
+
+// vde_switch process supervised by the plugin, restarted if it exits.
+// Its standard input is a pipe held by the plugin, the switch exits when the plugin goes away
+type Process struct {
+	dir string
+
+	// running process, replaced on restart
+	mutex   sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+
+	// closed when the switch is stopped
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// Starts a vde_switch with its control directory at dir
+func StartProcess(dir string) (*Process, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return nil, err
+	}
+	this := &Process{dir: dir, done: make(chan struct{})}
+	if err := this.start(); err != nil {
+		return nil, err
+	}
+	this.wg.Add(1)
+	go this.supervise()
+	log.Debugf("Switch started: [ %s ]", dir)
+	return this, nil
+}
+
+// Runs the vde_switch and waits for its control socket
+func (this *Process) start() error {
+	// the control socket left by a switch that crashed would look ready
+	ctl := filepath.Join(this.dir, "ctl")
+	os.Remove(ctl)
+
+	cmd := exec.Command(Command, "--sock", this.dir, "--numports", strconv.Itoa(NumPorts))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// the switch is ready when its control socket exists
+	for deadline := time.Now().Add(StartTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(ctl); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			stdin.Close()
+			cmd.Process.Kill()
+			cmd.Wait()
+			return errors.New("vde_switch " + this.dir + ": control socket not created")
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	// the switch has been stopped while restarting
+	select {
+	case <-this.done:
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("vde_switch " + this.dir + ": stopped")
+	default:
+	}
+	this.cmd, this.stdin, this.started = cmd, stdin, time.Now()
+	return nil
+}
+
+// Waits for the vde_switch to exit and starts it again with exponential backoff, until the switch is stopped
+func (this *Process) supervise() {
+	defer this.wg.Done()
+	delay := RestartMinDelay
+	for {
+		this.mutex.Lock()
+		cmd, started := this.cmd, this.started
+		this.mutex.Unlock()
+		err := cmd.Wait()
+
+		// a switch that has been running for a while is not crashing in a loop
+		if time.Since(started) > RestartMaxDelay {
+			delay = RestartMinDelay
+		}
+
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+		log.Warnf("Switch [ %s ]: vde_switch exited: [ %v ]", this.dir, err)
+
+		// the endpoints plugged to the switch reconnect on their own
+		for {
+			select {
+			case <-this.done:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > RestartMaxDelay {
+				delay = RestartMaxDelay
+			}
+			if err := this.start(); err != nil {
+				log.Warnf("Switch [ %s ]: restart: [ %s ]", this.dir, err)
+				continue
+			}
+			log.Infof("Switch [ %s ]: restarted", this.dir)
+			break
+		}
+	}
+}
+
+// Returns the VNL of the switch
+func (this *Process) VNL() string {
+	return "vde://" + this.dir
+}
+
+// Stops the vde_switch and removes its control directory
+func (this *Process) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+		this.mutex.Lock()
+		// closing the standard input asks the switch to exit, killing it covers a stuck one
+		this.stdin.Close()
+		this.cmd.Process.Kill()
+		this.mutex.Unlock()
+		this.wg.Wait()
+		log.Debugf("Switch stopped: [ %s ]", this.dir)
+	})
+	return os.RemoveAll(this.dir)
+}
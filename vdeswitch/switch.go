@@ -0,0 +1,23 @@
+// Switches managed by the plugin for the networks created without a VNL
+package vdeswitch
+
+import (
+	"path/filepath"
+)
+
+// Switch of a managed network, the endpoints are plugged to its VNL
+type Switch interface {
+	// Returns the VNL of the switch
+	VNL() string
+
+	// Stops the switch and removes its control directory
+	Close() error
+}
+
+// directory holding the control directories of the managed switches
+const RunDir = "/run/vde_plug_docker"
+
+// Returns the control directory of the switch of a network
+func Dir(networkID string) string {
+	return filepath.Join(RunDir, networkID)
+}